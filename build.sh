@@ -4,4 +4,5 @@ CGO_ENABLED=1
 GOOS=windows
 CC=x86_64-w64-mingw32-gcc
 
-go build -o proxmoxbackupgo_cli.exe
\ No newline at end of file
+go build -o proxmoxbackupgo_cli.exe ./directorybackup
+go build -o proxmoxbackupgorestore_cli.exe ./directoryrestore
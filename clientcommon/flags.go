@@ -0,0 +1,38 @@
+package clientcommon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Flag which can be given several times, each value is appended
+type ArrayFlags []string
+
+func (i *ArrayFlags) String() string {
+	return fmt.Sprintf("%v", *i)
+}
+
+// Set is an implementation of the flag.Value interface
+func (i *ArrayFlags) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+// Accepts a plain number of bytes or a K, M, G, T suffixed size
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(s), "B"))
+	mult := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(s, suffix) {
+			mult = int64(1) << (10 * (i + 1))
+			s = strings.TrimSuffix(s, suffix)
+			break
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return v * mult, nil
+}
@@ -125,6 +125,8 @@ func SendMail(from, to, subject, body string, c *smtp.Client) error {
 type MailCtx struct {
 	NewChunks    uint64
 	ReusedChunks uint64
+	Excluded     uint64
+	Warnings     []string
 	Datastore    string
 	Error        error
 	Hostname     string
@@ -153,6 +155,9 @@ func (m *MailCtx) Success() bool {
 
 func (m *MailCtx) Status() string {
 	if m.Success() {
+		if len(m.Warnings) > 0 {
+			return "Warning"
+		}
 		return "Success"
 	}
 	return "Failed"
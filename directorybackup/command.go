@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// At most this many stderr lines of a failed command end up in the error, all of them are logged
+const commandStderrLines = 20
+
+// How long stderr may stay open once stdout ended, a background child of the command can hold it forever
+var commandStderrDelay = 5 * time.Second
+
+// Output of a backup source command. The command is started on the first read, so its timeout only runs
+// while the stream is consumed. Once stdout ends the exit status is checked, a failure is returned as
+// read error, which aborts the snapshot instead of storing truncated output
+type commandStream struct {
+	cfg    *CommandConfig
+	cmd    *exec.Cmd
+	ctx    context.Context
+	cancel context.CancelFunc
+	stdout io.ReadCloser
+	//Closed once stderr is consumed, lines holds what goes to the error
+	stderrDone chan struct{}
+	lines      []string
+	dropped    int
+	err        error
+}
+
+func newCommandStream(cfg *CommandConfig) *commandStream {
+	return &commandStream{cfg: cfg}
+}
+
+func (s *commandStream) start() error {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if s.cfg.timeout > 0 {
+		s.ctx, s.cancel = context.WithTimeout(context.Background(), s.cfg.timeout)
+	}
+	s.cmd = exec.CommandContext(s.ctx, s.cfg.Command[0], s.cfg.Command[1:]...)
+	s.cmd.Env = append(os.Environ(), s.cfg.Env...)
+	s.cmd.Dir = s.cfg.Dir
+	var err error
+	if s.stdout, err = s.cmd.StdoutPipe(); err != nil {
+		return err
+	}
+	stderr, err := s.cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Running %s for %s\n", strings.Join(s.cfg.Command, " "), s.cfg.Name)
+	if err := s.cmd.Start(); err != nil {
+		return fmt.Errorf("command %s: %w", s.cfg.Name, err)
+	}
+
+	//Children of the command may keep the pipes open after it is killed
+	context.AfterFunc(s.ctx, func() {
+		s.stdout.Close()
+		stderr.Close()
+	})
+
+	s.stderrDone = make(chan struct{})
+	go func() {
+		defer close(s.stderrDone)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			fmt.Printf("%s: %s\n", s.cfg.Name, line)
+			if len(s.lines) < commandStderrLines {
+				s.lines = append(s.lines, line)
+			} else {
+				s.dropped++
+			}
+		}
+	}()
+	return nil
+}
+
+// Waits for the command once its stdout ended. Wait closes stderr, so the rest of it is only read
+// for a while before, what a child left running writes afterwards is lost
+func (s *commandStream) finish() error {
+	select {
+	case <-s.stderrDone:
+	case <-time.After(commandStderrDelay):
+	}
+	err := s.cmd.Wait()
+	<-s.stderrDone
+	defer s.cancel()
+	if err != nil && errors.Is(s.ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("command %s killed after timeout %s", s.cfg.Name, s.cfg.timeout)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("command %s failed: %v", s.cfg.Name, err)
+		if len(s.lines) > 0 {
+			msg += ": " + strings.Join(s.lines, " / ")
+		}
+		if s.dropped > 0 {
+			msg += fmt.Sprintf(" / %d more lines on stderr", s.dropped)
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+func (s *commandStream) Read(b []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.cmd == nil {
+		if s.err = s.start(); s.err != nil {
+			return 0, s.err
+		}
+	}
+	n, err := s.stdout.Read(b)
+	if err == io.EOF || (err != nil && s.ctx.Err() != nil) {
+		if s.err = s.finish(); s.err == nil {
+			s.err = io.EOF
+		}
+		return n, s.err
+	}
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// Kills a command whose output was not read to the end, the backup failed before
+func (s *commandStream) Close() {
+	if s.cmd != nil && s.err == nil {
+		s.cmd.Process.Kill()
+		s.stdout.Close()
+		s.cmd.Wait()
+		s.cancel()
+	}
+}
+
+// Splits a -command line into program and arguments the way a POSIX shell does, without running one:
+// single quotes keep everything literally, double quotes and backslashes escape as in sh
+func splitCommandLine(line string) ([]string, error) {
+	ret := make([]string, 0)
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			//Inside double quotes a backslash only escapes the characters special there
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", c) {
+				word.WriteRune('\\')
+			}
+			if c != '\n' {
+				word.WriteRune(c)
+			} else if quote == 0 && word.Len() == 0 {
+				inWord = false
+			}
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				ret = append(ret, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, fmt.Errorf("unterminated quote or escape in %s", line)
+	}
+	if inWord {
+		ret = append(ret, word.String())
+	}
+	return ret, nil
+}
@@ -0,0 +1,75 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"pg_dump -Fp app", []string{"pg_dump", "-Fp", "app"}},
+		{"  spaced\targs  ", []string{"spaced", "args"}},
+		{`sh -c 'echo "a b"; exit 1'`, []string{"sh", "-c", `echo "a b"; exit 1`}},
+		{`printf "%s\n" "a \"quoted\" \$HOME"`, []string{"printf", `%s\n`, `a "quoted" $HOME`}},
+		{`path\ with\ spaces 'it'\''s'`, []string{"path with spaces", "it's"}},
+		{`empty '' ""`, []string{"empty", "", ""}},
+		{"line \\\n continued", []string{"line", "continued"}},
+		{"", []string{}},
+	}
+	for _, tt := range tests {
+		got, err := splitCommandLine(tt.line)
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("split %q = %q (%v), want %q", tt.line, got, err, tt.want)
+		}
+	}
+	for _, line := range []string{`'open`, `"open`, `trailing\`} {
+		if got, err := splitCommandLine(line); err == nil {
+			t.Errorf("split %q = %q, want an error", line, got)
+		}
+	}
+}
+
+func TestCommandStream(t *testing.T) {
+	commandStderrDelay = 200 * time.Millisecond
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		out     string
+		err     string //Part of the read error, "" when the command succeeds
+	}{
+		{name: "output", script: "echo hello", out: "hello\n"},
+		{name: "stderr of a successful command", script: "echo out; echo note >&2", out: "out\n"},
+		{name: "failure", script: "echo partial; echo broken >&2; exit 3", out: "partial\n", err: "broken"},
+		{name: "child keeps stderr open", script: "sleep 30 >/dev/null & echo done", out: "done\n"},
+		{name: "timeout", script: "sleep 30", timeout: 100 * time.Millisecond, err: "killed after timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newCommandStream(&CommandConfig{Name: "test", Command: []string{"sh", "-c", tt.script}, timeout: tt.timeout})
+			start := time.Now()
+			out, err := io.ReadAll(s)
+			if time.Since(start) > 5*time.Second {
+				t.Errorf("command took %s", time.Since(start))
+			}
+			if string(out) != tt.out {
+				t.Errorf("output %q, want %q", out, tt.out)
+			}
+			if tt.err == "" && err != nil {
+				t.Errorf("error %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("error %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"clientcommon"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type MailSendConfig struct {
@@ -27,27 +35,164 @@ type SMTPConfig struct {
 	Template *MailTemplate    `json:"template"`
 }
 
+// One pxar archive of the snapshot, Name is completed to name.pxar.didx
+type ArchiveConfig struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+
+	tar    io.Reader   //Tar stream archived instead of Path
+	stream *streamFile //Stream stored as the only file of the archive instead of Path
+}
+
+// Stream wrapped in a pxar archive as a regular file, or stored as it is in a raw name.didx
+type streamFile struct {
+	r       io.Reader
+	name    string
+	mode    fs.FileMode
+	mtime   time.Time
+	raw     bool
+	command *commandStream //Program producing r, nil for STDIN
+}
+
+func (s *streamFile) source() string {
+	if s.command != nil {
+		return "command " + s.command.cfg.Name
+	}
+	return "STDIN"
+}
+
+// Program whose stdout is backed up as a stream, Name is the archive name as for backupstream
+type CommandConfig struct {
+	Name    string   `json:"name"`
+	Command []string `json:"command"` //Program and arguments, run without a shell
+	Env     []string `json:"env"`     //KEY=value added to the environment of directorybackup
+	Dir     string   `json:"dir"`
+	Timeout string   `json:"timeout"` //Duration after which the program is killed and the backup fails
+	PXAR    bool     `json:"pxar"`    //As streampxar, for this command only
+
+	timeout time.Duration
+}
+
 type Config struct {
-	BaseURL          string      `json:"baseurl"`
-	CertFingerprint  string      `json:"certfingerprint"`
-	AuthID           string      `json:"authid"`
-	Secret           string      `json:"secret"`
-	Datastore        string      `json:"datastore"`
-	Namespace        string      `json:"namespace"`
-	BackupID         string      `json:"backup-id"`
-	BackupSourceDir  string      `json:"backupdir"`
-	BackupStreamName string      `json:"backupstreamname"`
-	PxarOut          string      `json:"pxarout"`
-	SMTP             *SMTPConfig `json:"smtp"`
-	UseVSS 			 bool        `json:"usevss"`
+	BaseURL          string          `json:"baseurl"`
+	CertFingerprint  string          `json:"certfingerprint"`
+	AuthID           string          `json:"authid"`
+	Secret           string          `json:"secret"`
+	Datastore        string          `json:"datastore"`
+	Namespace        string          `json:"namespace"`
+	BackupID         string          `json:"backup-id"`
+	BackupSourceDir  string          `json:"backupdir"`
+	BackupStreamName string          `json:"backupstreamname"`
+	BackupTarName    string          `json:"backuptarname"`
+	PxarOut          string          `json:"pxarout"`
+	SMTP             *SMTPConfig     `json:"smtp"`
+	UseVSS           bool            `json:"usevss"`
+	FollowSymlinks   bool            `json:"followsymlinks"`
+	SkipXattrs       bool            `json:"skipxattrs"`
+	SkipACLs         bool            `json:"skipacls"`
+	SkipFCaps        bool            `json:"skipfcaps"`
+	SkipQuotaProjID  bool            `json:"skipquotaprojid"`
+	Exclude          []string        `json:"exclude"`
+	Include          []string        `json:"include"`
+	MaxFileSize      string          `json:"maxfilesize"`
+	MinAge           string          `json:"minage"`
+	OneFileSystem    bool            `json:"onefilesystem"`
+	IncludeMounts    []string        `json:"includemounts"`
+	Archives         []ArchiveConfig `json:"archives"`
+	//legacy writes plain .pxar archives, data and metadata write split .mpxar/.ppxar archives,
+	//metadata also reuses payloads of files unchanged since the previous snapshot
+	ChangeDetectionMode string `json:"changedetectionmode"`
+	//backupstream is stored as name.pxar holding the single file name instead of a raw name.didx
+	StreamPXAR  bool   `json:"streampxar"`
+	StreamMode  string `json:"streammode"`  //Octal permissions of the file, 0644 by default
+	StreamMTime string `json:"streammtime"` //RFC3339, the backup start by default
+	//Where backuptar and streampxar keep the stream until it ended, the system temporary directory by default
+	SpoolDir string `json:"spooldir"`
+	//Programs run by directorybackup, each one is stored like backupstream
+	Commands       []CommandConfig `json:"commands"`
+	CommandTimeout string          `json:"commandtimeout"` //Default for commands without their own timeout
+
+	maxFileSize int64
+	minAge      time.Duration
+	streamMode  fs.FileMode
+	streamMTime time.Time
+}
+
+var archiveNameRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._\-]*$`)
+
+// backupdir is kept as the backup.pxar archive, followed by the archives listed explicitly, the tar stream
+// and the streams, which are raw name.didx unless they are wrapped in a pxar archive
+func (c *Config) archives() []ArchiveConfig {
+	ret := make([]ArchiveConfig, 0)
+	if c.BackupSourceDir != "" {
+		ret = append(ret, ArchiveConfig{Name: "backup", Path: c.BackupSourceDir})
+	}
+	ret = append(ret, c.Archives...)
+	if c.BackupTarName != "" {
+		ret = append(ret, ArchiveConfig{Name: c.BackupTarName, tar: os.Stdin})
+	}
+	stream := func(name string, r io.Reader, pxar bool) ArchiveConfig {
+		name = strings.TrimSuffix(name, ".didx")
+		return ArchiveConfig{Name: name, stream: &streamFile{r: r, name: name, mode: c.streamMode, mtime: c.streamMTime, raw: !pxar}}
+	}
+	if c.BackupStreamName != "" {
+		ret = append(ret, stream(c.BackupStreamName, os.Stdin, c.StreamPXAR))
+	}
+	for i := range c.Commands {
+		command := newCommandStream(&c.Commands[i])
+		a := stream(c.Commands[i].Name, command, c.Commands[i].PXAR || c.StreamPXAR)
+		a.stream.command = command
+		ret = append(ret, a)
+	}
+	for i := range ret {
+		if ret[i].stream != nil && ret[i].stream.raw {
+			ret[i].Name += ".didx"
+			continue
+		}
+		ret[i].Name = strings.TrimSuffix(strings.TrimSuffix(ret[i].Name, ".didx"), ".pxar") + ".pxar.didx"
+	}
+	return ret
+}
+
+func (c *Config) splitArchives() bool {
+	return c.ChangeDetectionMode == "data" || c.ChangeDetectionMode == "metadata"
 }
 
 func (c *Config) valid() bool {
-	baseValid := c.BaseURL != "" && c.AuthID != "" && c.Secret != "" && c.Datastore != "" && (c.BackupSourceDir != "" || c.BackupStreamName != "")
+	baseValid := c.BaseURL != "" && c.AuthID != "" && c.Secret != "" && c.Datastore != "" && (c.BackupSourceDir != "" || c.BackupStreamName != "" || c.BackupTarName != "" || len(c.Archives) > 0 || len(c.Commands) > 0)
 	if !baseValid {
 		return baseValid
 	}
 
+	if c.BackupStreamName != "" && c.BackupTarName != "" {
+		fmt.Println("-backupstream and -backuptar both read STDIN, only one can be used")
+		return false
+	}
+
+	switch c.ChangeDetectionMode {
+	case "", "legacy", "data", "metadata":
+	default:
+		fmt.Printf("Invalid change detection mode %s\n", c.ChangeDetectionMode)
+		return false
+	}
+
+	for _, cmd := range c.Commands {
+		if len(cmd.Command) == 0 {
+			fmt.Printf("Command %s has nothing to run\n", cmd.Name)
+			return false
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, a := range c.archives() {
+		name := strings.TrimSuffix(strings.TrimSuffix(a.Name, ".didx"), ".pxar")
+		if (a.Path == "" && a.tar == nil && a.stream == nil) || !archiveNameRe.MatchString(name) || names[name] {
+			fmt.Printf("Invalid or duplicate archive %s=%s\n", name, a.Path)
+			return false
+		}
+		names[name] = true
+	}
+
 	if c.SMTP != nil {
 		mailCfgValid := c.SMTP.Host != "" && c.SMTP.Port != "" && c.SMTP.Username != "" && c.SMTP.Password != ""
 		if len(c.SMTP.Mails) == 0 {
@@ -64,6 +209,11 @@ func (c *Config) valid() bool {
 
 func loadConfig() *Config {
 	// Define flags
+	var excludes clientcommon.ArrayFlags
+	var includes clientcommon.ArrayFlags
+	var includeMounts clientcommon.ArrayFlags
+	var archives clientcommon.ArrayFlags
+	var commands clientcommon.ArrayFlags
 	baseURLFlag := flag.String("baseurl", "", "Base URL for the proxmox backup server, example: https://192.168.1.10:8007")
 	certFingerprintFlag := flag.String("certfingerprint", "", "Certificate fingerprint for SSL connection, example: ea:7d:06:f9...")
 	authIDFlag := flag.String("authid", "", "Authentication ID (PBS Api token)")
@@ -72,9 +222,29 @@ func loadConfig() *Config {
 	namespaceFlag := flag.String("namespace", "", "Namespace (optional)")
 	backupIDFlag := flag.String("backup-id", "", "Backup ID (optional - if not specified, the hostname is used as the default)")
 	backupSourceDirFlag := flag.String("backupdir", "", "Backup source directory, must not be symlink")
+	flag.Var(&archives, "archive", "Can be specified multiple times, name=path adds the directory path as name.pxar to the snapshot")
 	backupStreamNameFlag := flag.String("backupstream", "", "Filename for stream backup")
+	streamPXARFlag := flag.Bool("stream-pxar", false, "Store the -backupstream and -command data as the only file of a browsable name.pxar with catalog, instead of a raw name.didx (optional)")
+	streamModeFlag := flag.String("stream-mode", "", "Octal permissions of the -stream-pxar file, example: 0640 (optional - 0644 by default)")
+	streamMTimeFlag := flag.String("stream-mtime", "", "Modification time of the -stream-pxar file, RFC3339 (optional - backup start by default)")
+	flag.Var(&commands, "command", "Can be specified multiple times, name=program args runs the program without a shell, args are split with shell quoting rules, and stores its stdout like -backupstream name, the backup fails if it exits non-zero (optional)")
+	commandTimeoutFlag := flag.String("command-timeout", "", "Duration after which a -command still running is killed and the backup fails, example: 2h (optional)")
+	spoolDirFlag := flag.String("spool-dir", "", "Directory for the temporary copy of -backuptar and -stream-pxar streams, needs room for the whole uncompressed stream (optional - system temporary directory by default)")
+	backupTarNameFlag := flag.String("backuptar", "", "Archive name for a tar stream read from STDIN, stored as a browsable name.pxar with catalog, example: tar c -C /srv . | directorybackup -backuptar srv")
 	pxarOutFlag := flag.String("pxarout", "", "Output PXAR archive for debug purposes (optional)")
 	noVSSFlag := flag.Bool("novss", false, "Disable VSS ( For filesystems that don't support it, for example veracrypt )")
+	followSymlinksFlag := flag.Bool("follow-symlinks", false, "Archive the target of symlinks instead of the links themselves (optional)")
+	skipXattrsFlag := flag.Bool("skip-xattrs", false, "Do not store extended attributes (optional)")
+	skipACLsFlag := flag.Bool("skip-acls", false, "Do not store POSIX ACLs (optional)")
+	skipFCapsFlag := flag.Bool("skip-fcaps", false, "Do not store file capabilities (optional)")
+	skipQuotaProjIDFlag := flag.Bool("skip-quota-projid", false, "Do not store quota project ids (optional)")
+	flag.Var(&excludes, "exclude", "Can be specified multiple times, exclude pattern with .pxarexclude syntax relative to backupdir (optional)")
+	flag.Var(&includes, "include", "Can be specified multiple times, pattern re-including paths matched by exclude (optional)")
+	maxFileSizeFlag := flag.String("max-file-size", "", "Skip files larger than this, example: 500M (optional)")
+	minAgeFlag := flag.String("min-age", "", "Skip files modified more recently than this, example: 10m (optional)")
+	allFileSystemsFlag := flag.Bool("all-file-systems", false, "Descend into mount points, by default on linux they are archived as empty directories (optional)")
+	flag.Var(&includeMounts, "include-mount", "Can be specified multiple times, mount point to descend into even in one file system mode (optional)")
+	changeDetectionModeFlag := flag.String("change-detection-mode", "", "legacy|data|metadata , data and metadata write split .mpxar/.ppxar archives, metadata skips reading files whose size, mtime, type, permissions and owner did not change since the previous snapshot, inodes are not compared as pxar does not store them (optional)")
 
 	mailHostFlag := flag.String("mail-host", "", "mail notification system: mail server host(optional)")
 	mailPortFlag := flag.String("mail-port", "", "mail notification system: mail server port(optional)")
@@ -92,7 +262,8 @@ func loadConfig() *Config {
 	flag.Parse()
 
 	config := &Config{
-		UseVSS: true,
+		UseVSS:        true,
+		OneFileSystem: runtime.GOOS == "linux",
 	}
 	if *configFile != "" {
 		file, err := os.ReadFile(*configFile)
@@ -135,12 +306,140 @@ func loadConfig() *Config {
 	if *backupStreamNameFlag != "" {
 		config.BackupStreamName = *backupStreamNameFlag
 	}
+	if *streamPXARFlag {
+		config.StreamPXAR = true
+	}
+	if *streamModeFlag != "" {
+		config.StreamMode = *streamModeFlag
+	}
+	if *streamMTimeFlag != "" {
+		config.StreamMTime = *streamMTimeFlag
+	}
+	if *spoolDirFlag != "" {
+		config.SpoolDir = *spoolDirFlag
+	}
+	if *backupTarNameFlag != "" {
+		config.BackupTarName = *backupTarNameFlag
+	}
 	if *pxarOutFlag != "" {
 		config.PxarOut = *pxarOutFlag
 	}
 	if *noVSSFlag {
 		config.UseVSS = false
 	}
+	if *followSymlinksFlag {
+		config.FollowSymlinks = true
+	}
+	if *skipXattrsFlag {
+		config.SkipXattrs = true
+	}
+	if *skipACLsFlag {
+		config.SkipACLs = true
+	}
+	if *skipFCapsFlag {
+		config.SkipFCaps = true
+	}
+	if *skipQuotaProjIDFlag {
+		config.SkipQuotaProjID = true
+	}
+	if *allFileSystemsFlag {
+		config.OneFileSystem = false
+	}
+	if *changeDetectionModeFlag != "" {
+		config.ChangeDetectionMode = *changeDetectionModeFlag
+	}
+	config.IncludeMounts = append(config.IncludeMounts, includeMounts...)
+	for _, a := range archives {
+		name, path, ok := strings.Cut(a, "=")
+		if !ok {
+			fmt.Printf("Invalid archive %s, expected name=path\n", a)
+			os.Exit(1)
+		}
+		config.Archives = append(config.Archives, ArchiveConfig{Name: name, Path: path})
+	}
+	for _, c := range commands {
+		name, cmdline, ok := strings.Cut(c, "=")
+		if !ok {
+			fmt.Printf("Invalid command %s, expected name=program args\n", c)
+			os.Exit(1)
+		}
+		argv, err := splitCommandLine(cmdline)
+		if err != nil {
+			fmt.Printf("Invalid command %s: %v\n", c, err)
+			os.Exit(1)
+		}
+		if len(argv) == 0 {
+			fmt.Printf("Invalid command %s, expected name=program args\n", c)
+			os.Exit(1)
+		}
+		config.Commands = append(config.Commands, CommandConfig{Name: name, Command: argv})
+	}
+	if *commandTimeoutFlag != "" {
+		config.CommandTimeout = *commandTimeoutFlag
+	}
+	config.Exclude = append(config.Exclude, excludes...)
+	config.Include = append(config.Include, includes...)
+	if *maxFileSizeFlag != "" {
+		config.MaxFileSize = *maxFileSizeFlag
+	}
+	if *minAgeFlag != "" {
+		config.MinAge = *minAgeFlag
+	}
+
+	if config.MaxFileSize != "" {
+		size, err := clientcommon.ParseSize(config.MaxFileSize)
+		if err != nil {
+			fmt.Printf("Invalid max file size %s: %v\n", config.MaxFileSize, err)
+			os.Exit(1)
+		}
+		config.maxFileSize = size
+	}
+	if config.MinAge != "" {
+		age, err := time.ParseDuration(config.MinAge)
+		if err != nil {
+			fmt.Printf("Invalid min age %s: %v\n", config.MinAge, err)
+			os.Exit(1)
+		}
+		config.minAge = age
+	}
+	config.streamMode = 0o644
+	if config.StreamMode != "" {
+		mode, err := strconv.ParseUint(config.StreamMode, 8, 32)
+		if err != nil || mode > 0o777 {
+			fmt.Printf("Invalid stream mode %s, expected octal permissions\n", config.StreamMode)
+			os.Exit(1)
+		}
+		config.streamMode = fs.FileMode(mode)
+	}
+	config.streamMTime = time.Now()
+	if config.StreamMTime != "" {
+		mtime, err := time.Parse(time.RFC3339, config.StreamMTime)
+		if err != nil {
+			fmt.Printf("Invalid stream mtime %s: %v\n", config.StreamMTime, err)
+			os.Exit(1)
+		}
+		config.streamMTime = mtime
+	}
+	if config.SpoolDir != "" {
+		if info, err := os.Stat(config.SpoolDir); err != nil || !info.IsDir() {
+			fmt.Printf("Invalid spool directory %s: not a directory\n", config.SpoolDir)
+			os.Exit(1)
+		}
+	}
+	for i := range config.Commands {
+		cmd := &config.Commands[i]
+		if cmd.Timeout == "" {
+			cmd.Timeout = config.CommandTimeout
+		}
+		if cmd.Timeout != "" {
+			timeout, err := time.ParseDuration(cmd.Timeout)
+			if err != nil {
+				fmt.Printf("Invalid timeout %s of command %s: %v\n", cmd.Timeout, cmd.Name, err)
+				os.Exit(1)
+			}
+			cmd.timeout = timeout
+		}
+	}
 
 	initSmtpConfigIfNeeded := func() {
 		if config.SMTP == nil {
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"clientcommon"
 	"crypto/sha256"
 	"encoding/binary"
@@ -10,8 +9,8 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"maps"
 	"os"
+	"path/filepath"
 	"pbscommon"
 	"runtime"
 	"slices"
@@ -26,11 +25,11 @@ import (
 
 var defaultMailSubjectTemplate = "Backup {{.Status}}"
 var defaultMailBodyTemplate = `{{if .Success}}Backup complete ({{.FromattedDuration}})
-Chunks New {{.NewChunks}}, Reused {{.ReusedChunks}}.{{else}}Error occurred while working, backup may be not completed.
+Chunks New {{.NewChunks}}, Reused {{.ReusedChunks}}.{{if .Warnings}}
+{{len .Warnings}} warnings:{{range .Warnings}}
+{{.}}{{end}}{{end}}{{else}}Error occurred while working, backup may be not completed.
 Last error is: {{.ErrorStr}}{{end}}`
 
-var didxMagic = []byte{28, 145, 78, 165, 25, 186, 179, 205}
-
 type ChunkState struct {
 	assignments        []string
 	assignments_offset []uint64
@@ -43,11 +42,20 @@ type ChunkState struct {
 	newchunk           *atomic.Uint64
 	reusechunk         *atomic.Uint64
 	knownChunks        *hashmap.Map[string, bool]
+
+	//Run of chunks taken over from a previous index, consecutive injections extend it instead of repeating chunks
+	injectIndex *pbscommon.DynamicIndex
+	injectFirst int
+	injectLast  int
+	injectBase  uint64
+	injectEnd   uint64
 }
 
-type DidxEntry struct {
-	offset uint64
-	digest []byte
+// Results of the archive writers which are not chunk counters, reported at the end of the job
+type BackupReport struct {
+	Excluded uint64
+	Reused   uint64 //Files whose payload was taken from the previous snapshot without reading them
+	Warnings []string
 }
 
 func (c *ChunkState) Init(newchunk *atomic.Uint64, reusechunk *atomic.Uint64, knownChunks *hashmap.Map[string, bool]) {
@@ -67,80 +75,102 @@ func (c *ChunkState) Init(newchunk *atomic.Uint64, reusechunk *atomic.Uint64, kn
 func (c *ChunkState) HandleData(b []byte, client *pbscommon.PBSClient) {
 	chunkpos := c.C.Scan(b)
 
-	if chunkpos == 0 {
-		//No break happened, just append data
-		c.current_chunk = append(c.current_chunk, b...)
-	} else {
-
-		for chunkpos > 0 {
-			//Append data until break position
-			c.current_chunk = append(c.current_chunk, b[:chunkpos]...)
+	for chunkpos > 0 {
+		//Append data until break position
+		c.current_chunk = append(c.current_chunk, b[:chunkpos]...)
+		c.commitChunk(client)
 
-			h := sha256.New()
-			// TODO: error handling inside callback
-			h.Write(c.current_chunk)
-			bindigest := h.Sum(nil)
-			shahash := hex.EncodeToString(bindigest)
-
-			if _, ok := c.knownChunks.GetOrInsert(shahash, true); !ok {
-				fmt.Printf("New chunk[%s] %d bytes\n", shahash, len(c.current_chunk))
-				c.newchunk.Add(1)
-
-				client.UploadDynamicCompressedChunk(c.wrid, shahash, c.current_chunk)
-			} else {
-				fmt.Printf("Reuse chunk[%s] %d bytes\n", shahash, len(c.current_chunk))
-				c.reusechunk.Add(1)
-			}
-
-			// TODO: error handling inside callback
-			binary.Write(c.chunkdigests, binary.LittleEndian, (c.pos + uint64(len(c.current_chunk))))
-			// TODO: error handling inside callback
-			c.chunkdigests.Write(h.Sum(nil))
+		b = b[chunkpos:] //Take remainder of data
+		chunkpos = c.C.Scan(b)
+	}
 
-			c.assignments_offset = append(c.assignments_offset, c.pos)
-			c.assignments = append(c.assignments, shahash)
-			c.pos += uint64(len(c.current_chunk))
-			c.chunkcount += 1
+	//No further break happened, append remaining data
+	c.current_chunk = append(c.current_chunk, b...)
+}
 
-			c.current_chunk = make([]byte, 0)
-			b = b[chunkpos:] //Take remainder of data
-			chunkpos = c.C.Scan(b)
+// Ends the current chunk, uploading it unless the server already has it
+func (c *ChunkState) commitChunk(client *pbscommon.PBSClient) {
+	h := sha256.New()
+	// TODO: error handling inside callback
+	h.Write(c.current_chunk)
+	bindigest := h.Sum(nil)
+	shahash := hex.EncodeToString(bindigest)
 
-		}
+	if _, ok := c.knownChunks.GetOrInsert(shahash, true); !ok {
+		fmt.Printf("New chunk[%s] %d bytes\n", shahash, len(c.current_chunk))
+		c.newchunk.Add(1)
 
-		//No further break happened, append remaining data
-		c.current_chunk = append(c.current_chunk, b...)
+		client.UploadDynamicCompressedChunk(c.wrid, shahash, c.current_chunk)
+	} else {
+		fmt.Printf("Reuse chunk[%s] %d bytes\n", shahash, len(c.current_chunk))
+		c.reusechunk.Add(1)
 	}
+
+	c.appendChunk(shahash, bindigest, uint64(len(c.current_chunk)))
+	c.current_chunk = make([]byte, 0)
 }
 
-func (c *ChunkState) Eof(client *pbscommon.PBSClient) {
-	//Here we write the remainder of data for which cyclic hash did not trigger
+func (c *ChunkState) appendChunk(shahash string, bindigest []byte, size uint64) {
+	// TODO: error handling inside callback
+	binary.Write(c.chunkdigests, binary.LittleEndian, (c.pos + size))
+	// TODO: error handling inside callback
+	c.chunkdigests.Write(bindigest)
 
-	if len(c.current_chunk) > 0 {
-		h := sha256.New()
-		_, err := h.Write(c.current_chunk)
-		if err != nil {
-			panic(err)
+	c.assignments_offset = append(c.assignments_offset, c.pos)
+	c.assignments = append(c.assignments, shahash)
+	c.pos += size
+	c.chunkcount += 1
+}
+
+// Appends the chunks of a previous index covering [offset, offset+length) without reading or uploading them,
+// which forces a chunk boundary at the current position. Returns where offset is now in the stream and the new stream size
+func (c *ChunkState) Inject(client *pbscommon.PBSClient, prev *pbscommon.DynamicIndex, offset uint64, length uint64) (uint64, uint64, error) {
+	if length == 0 || offset+length > prev.Size() {
+		return 0, 0, fmt.Errorf("range %d+%d is outside of previous index", offset, length)
+	}
+	first := prev.ChunkAt(offset)
+	last := prev.ChunkAt(offset + length - 1)
+	//Only chunks of the previous snapshot downloaded in this session may be assigned without upload
+	for i := first; i <= last; i++ {
+		if _, ok := c.knownChunks.Get(prev.Digests[i]); !ok {
+			return 0, 0, fmt.Errorf("chunk %s is not known to the server", prev.Digests[i])
 		}
+	}
 
-		shahash := hex.EncodeToString(h.Sum(nil))
-		binary.Write(c.chunkdigests, binary.LittleEndian, (c.pos + uint64(len(c.current_chunk))))
-		c.chunkdigests.Write(h.Sum(nil))
+	contiguous := c.injectIndex == prev && c.pos == c.injectEnd && len(c.current_chunk) == 0 && first >= c.injectFirst && first <= c.injectLast+1
+	if !contiguous {
+		if len(c.current_chunk) > 0 {
+			c.commitChunk(client)
+		}
+		c.injectIndex = prev
+		c.injectFirst = first
+		c.injectLast = first - 1
+		c.injectBase = c.pos
+	}
 
-		if _, ok := c.knownChunks.GetOrInsert(shahash, true); !ok {
-			fmt.Printf("New chunk[%s] %d bytes\n", shahash, len(c.current_chunk))
-			client.UploadDynamicCompressedChunk(c.wrid, shahash, c.current_chunk)
-			c.newchunk.Add(1)
-		} else {
-			fmt.Printf("Reuse chunk[%s] %d bytes\n", shahash, len(c.current_chunk))
-			c.reusechunk.Add(1)
+	for i := c.injectLast + 1; i <= last; i++ {
+		bindigest, err := hex.DecodeString(prev.Digests[i])
+		if err != nil {
+			return 0, 0, err
 		}
-		c.assignments_offset = append(c.assignments_offset, c.pos)
-		c.assignments = append(c.assignments, shahash)
-		c.pos += uint64(len(c.current_chunk))
-		c.chunkcount += 1
+		size := prev.Ends[i] - prev.ChunkStart(i)
+		fmt.Printf("Reuse chunk[%s] %d bytes\n", prev.Digests[i], size)
+		c.reusechunk.Add(1)
+		c.appendChunk(prev.Digests[i], bindigest, size)
+		c.injectLast = i
+	}
+	c.injectEnd = c.pos
+	c.C.Reset()
+
+	return c.injectBase + offset - prev.ChunkStart(c.injectFirst), c.pos, nil
+}
 
+func (c *ChunkState) Eof(client *pbscommon.PBSClient) {
+	//Here we write the remainder of data for which cyclic hash did not trigger
+	if len(c.current_chunk) > 0 {
+		c.commitChunk(client)
 	}
+
 	//Avoid incurring in request entity too large by chunking assignment PUT requests in blocks of at most 128 chunks
 	for k := 0; k < len(c.assignments); k += 128 {
 		k2 := k + 128
@@ -157,6 +187,14 @@ func main() {
 	var newchunk *atomic.Uint64 = new(atomic.Uint64)
 	var reusechunk *atomic.Uint64 = new(atomic.Uint64)
 
+	//Registered first so it runs after every other deferred cleanup
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	cfg := loadConfig()
 
 	if ok := cfg.valid(); !ok {
@@ -204,17 +242,11 @@ func main() {
 		hostname = "unknown"
 	}
 
-	begin := time.Now()
-	if cfg.BackupSourceDir != "" {
-		err = backup(client, newchunk, reusechunk, cfg.PxarOut, cfg.BackupSourceDir, cfg.UseVSS)
-	} else if cfg.BackupStreamName != "" {
-		sn := cfg.BackupStreamName
-		if !strings.HasSuffix(sn, ".didx") {
-			sn += ".didx"
-		}
-		fmt.Printf("Backing up from STDIN to %s", sn)
-		err = backup_stream(client, newchunk, reusechunk, sn, os.Stdin)
+	report := &BackupReport{}
 
+	begin := time.Now()
+	if len(cfg.archives()) > 0 {
+		err = backup(client, newchunk, reusechunk, report, cfg)
 	} else {
 		panic("No backup dir or stream name specified, exiting")
 	}
@@ -224,6 +256,8 @@ func main() {
 	mailCtx := clientcommon.MailCtx{
 		NewChunks:    newchunk.Load(),
 		ReusedChunks: reusechunk.Load(),
+		Excluded:     report.Excluded,
+		Warnings:     report.Warnings,
 		Error:        err,
 		Hostname:     hostname,
 		Datastore:    cfg.Datastore,
@@ -236,7 +270,12 @@ func main() {
 		mailBodyTemplate = cfg.SMTP.Template.Body
 	}
 
-	fmt.Printf("New %d, Reused %d, backup took %s.\n", newchunk.Load(), reusechunk.Load(), end.Sub(begin))
+	fmt.Printf("New %d, Reused %d, Excluded %d, Unchanged files %d, Warnings %d, backup took %s.\n", newchunk.Load(), reusechunk.Load(), report.Excluded, report.Reused, len(report.Warnings), end.Sub(begin))
+	if err != nil {
+		exitCode = 1
+	} else if len(report.Warnings) > 0 {
+		exitCode = 3
+	}
 	var msg string
 	msg, err = mailCtx.BuildStr(mailBodyTemplate)
 	if err != nil {
@@ -282,34 +321,98 @@ func main() {
 
 }
 
-func backup_stream(client *pbscommon.PBSClient, newchunk, reusechunk *atomic.Uint64, filename string, stream io.Reader) error {
-	knownChunks := hashmap.New[string, bool]()
-	client.Connect(false, "host")
+// Here we download the previous dynamic index to figure out which chunks are the same of what
+// we are going to upload to avoid unnecessary traffic and compression cpu usage.
+// The index is returned for reuse of its chunks, nil if there is no usable previous index
+func loadPreviousChunks(client *pbscommon.PBSClient, filename string, knownChunks *hashmap.Map[string, bool]) (*pbscommon.DynamicIndex, error) {
 	previousDidx, err := client.DownloadPreviousToBytes(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	fmt.Printf("Downloaded previous DIDX: %d bytes\n", len(previousDidx))
 
-	if !bytes.HasPrefix(previousDidx, didxMagic) {
-		fmt.Printf("Previous index has wrong magic (%s)!\n", previousDidx[:8])
+	index, err := pbscommon.ParseDynamicIndex(previousDidx)
+	if err != nil {
+		fmt.Printf("Previous index %s not usable: %v\n", filename, err)
+		return nil, nil
+	}
+	for _, shahash := range index.Digests {
+		fmt.Printf("Previous: %s\n", shahash)
+		knownChunks.Set(shahash, true)
+	}
 
-	} else {
-		//Header as per proxmox documentation is fixed size of 4096 bytes,
-		//then offset of type uint64 and sha256 digests follow , so 40 byte each record until EOF
-		previousDidx = previousDidx[4096:]
-		for i := 0; i*40 < len(previousDidx); i += 1 {
-			e := DidxEntry{}
-			e.offset = binary.LittleEndian.Uint64(previousDidx[i*40 : i*40+8])
-			e.digest = previousDidx[i*40+8 : i*40+40]
-			shahash := hex.EncodeToString(e.digest)
-			fmt.Printf("Previous: %s\n", shahash)
-			knownChunks.Set(shahash, true)
+	fmt.Printf("Known chunks: %d!\n", knownChunks.Len())
+	return index, nil
+}
+
+// Files of the previous snapshot's metadata archive, read through a reader session.
+// Only the most recent snapshot of the group is considered, because the server accepts its
+// chunks without upload in this session. Payload offsets of the metadata archive are only valid
+// for the payload index this session got as previous, so both must come from the same snapshot
+func loadPreviousMetadata(client *pbscommon.PBSClient, filename string, payloadName string, payload *pbscommon.DynamicIndex) (*pbscommon.PXARPrevious, error) {
+	snaps, err := client.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	var prev *pbscommon.BackupManifest
+	for i := range snaps {
+		s := &snaps[i]
+		if s.BackupType != client.Manifest.BackupType || s.BackupID != client.Manifest.BackupID || s.BackupTime >= client.Manifest.BackupTime {
+			continue
+		}
+		if prev == nil || s.BackupTime > prev.BackupTime {
+			prev = s
 		}
 	}
+	if prev == nil || !slices.ContainsFunc(prev.Files, func(f pbscommon.File) bool { return f.Filename == filename }) {
+		fmt.Printf("No previous %s, reading all files\n", filename)
+		return nil, nil
+	}
+	if !slices.ContainsFunc(prev.Files, func(f pbscommon.File) bool { return f.Filename == payloadName && f.Csum == payload.Csum() }) {
+		fmt.Printf("Previous %s does not belong to %s of %s, reading all files\n", payloadName, filename, time.Unix(prev.BackupTime, 0).UTC().Format(time.RFC3339))
+		return nil, nil
+	}
 
-	fmt.Printf("Known chunks: %d!\n", knownChunks.Len())
+	reader := &pbscommon.PBSClient{
+		BaseURL:         client.BaseURL,
+		CertFingerPrint: client.CertFingerPrint,
+		AuthID:          client.AuthID,
+		Secret:          client.Secret,
+		Datastore:       client.Datastore,
+		Namespace:       client.Namespace,
+		Insecure:        client.Insecure,
+		Manifest: pbscommon.BackupManifest{
+			BackupID:   prev.BackupID,
+			BackupTime: prev.BackupTime,
+		},
+	}
+	reader.Connect(true, prev.BackupType)
+
+	data, err := reader.DownloadToBytes(filename)
+	if err != nil {
+		return nil, err
+	}
+	index, err := pbscommon.ParseDynamicIndex(data)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Reading previous %s from %s\n", filename, time.Unix(prev.BackupTime, 0).UTC().Format(time.RFC3339))
+	previous, err := pbscommon.NewPXARPrevious(pbscommon.NewDynamicIndexReader(reader, index), index.Size())
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Previous %s has %d files\n", filename, len(previous.Files))
+	return previous, nil
+}
+
+// Stores a stream as it is, the raw name.didx can only be downloaded whole
+func backup_raw_stream(client *pbscommon.PBSClient, newchunk, reusechunk *atomic.Uint64, knownChunks *hashmap.Map[string, bool], filename string, stream io.Reader) error {
+	_, err := loadPreviousChunks(client, filename, knownChunks)
+	if err != nil {
+		return err
+	}
 
 	streamChunk := ChunkState{}
 	streamChunk.Init(newchunk, reusechunk, knownChunks)
@@ -320,72 +423,64 @@ func backup_stream(client *pbscommon.PBSClient, newchunk, reusechunk *atomic.Uin
 	}
 	B := make([]byte, 65536)
 	for {
-
 		n, err := stream.Read(B)
-
-		b := B[:n]
-
-		streamChunk.HandleData(b, client)
-
+		streamChunk.HandleData(B[:n], client)
 		if err == io.EOF {
 			break
 		}
+		//A failed command must not end up as a complete looking stream
+		if err != nil {
+			return err
+		}
 	}
 
 	streamChunk.Eof(client)
-
-	client.CloseDynamicIndex(streamChunk.wrid, hex.EncodeToString(streamChunk.chunkdigests.Sum(nil)), streamChunk.pos, streamChunk.chunkcount)
-
-	err = client.UploadManifest()
-	if err != nil {
-		return err
-	}
-
-	return client.Finish()
+	return nil
 }
 
-func backup_real(client *pbscommon.PBSClient, newchunk, reusechunk *atomic.Uint64, pxarOut string, backupdir string) error {
-	client.Connect(false, "host")
-	knownChunks := hashmap.New[string, bool]()
-
+// Writes one pxar archive, its directory tables go to the catalog shared by the whole snapshot
+func backup_archive(client *pbscommon.PBSClient, newchunk, reusechunk *atomic.Uint64, report *BackupReport, cfg *Config, knownChunks *hashmap.Map[string, bool], catalog *pbscommon.PXARCatalog, a ArchiveConfig, pxarOut string) error {
 	archive := &pbscommon.PXARArchive{}
-	archive.ArchiveName = "backup.pxar.didx"
-
-	previousDidx, err := client.DownloadPreviousToBytes(archive.ArchiveName)
-	if err != nil {
-		return err
+	archive.ArchiveName = a.Name
+	archive.Catalog = catalog
+	archive.FollowSymlinks = cfg.FollowSymlinks
+	archive.SkipXattrs = cfg.SkipXattrs
+	archive.SkipACLs = cfg.SkipACLs
+	archive.SkipFCaps = cfg.SkipFCaps
+	archive.SkipQuotaProjID = cfg.SkipQuotaProjID
+	archive.OneFileSystem = cfg.OneFileSystem
+	archive.IncludeMountPoints = cfg.IncludeMounts
+	archive.SpoolDir = cfg.SpoolDir
+	//Filters are meant for directory trees, a stream archive always holds its file
+	if a.stream == nil {
+		archive.MaxFileSize = cfg.maxFileSize
+		archive.MinAge = cfg.minAge
+		for _, e := range cfg.Exclude {
+			if p, ok := pbscommon.ParseExcludePattern(e, ""); ok {
+				archive.ExcludePatterns = append(archive.ExcludePatterns, p)
+			}
+		}
+		//Includes come last so they win over excludes matching the same path
+		for _, i := range cfg.Include {
+			if p, ok := pbscommon.ParseExcludePattern("!"+strings.TrimPrefix(i, "!"), ""); ok {
+				archive.ExcludePatterns = append(archive.ExcludePatterns, p)
+			}
+		}
 	}
 
-	fmt.Printf("Downloaded previous DIDX: %d bytes\n", len(previousDidx))
-
-	/*f2, _ := os.Create("test.didx")
-	defer f2.Close()
-
-	f2.Write(previous_didx)*/
-
-	/*
-		Here we download the previous dynamic index to figure out which chunks are the same of what
-		we are going to upload to avoid unnecessary traffic and compression cpu usage
-	*/
-
-	if !bytes.HasPrefix(previousDidx, didxMagic) {
-		fmt.Printf("Previous index has wrong magic (%s)!\n", previousDidx[:8])
+	//Split archives keep the pxar name with the payload in .ppxar and everything else in .mpxar
+	payloadName := ""
+	if cfg.splitArchives() {
+		base := strings.TrimSuffix(a.Name, ".pxar.didx")
+		archive.ArchiveName = base + ".mpxar.didx"
+		payloadName = base + ".ppxar.didx"
+	}
 
-	} else {
-		//Header as per proxmox documentation is fixed size of 4096 bytes,
-		//then offset of type uint64 and sha256 digests follow , so 40 byte each record until EOF
-		previousDidx = previousDidx[4096:]
-		for i := 0; i*40 < len(previousDidx); i += 1 {
-			e := DidxEntry{}
-			e.offset = binary.LittleEndian.Uint64(previousDidx[i*40 : i*40+8])
-			e.digest = previousDidx[i*40+8 : i*40+40]
-			shahash := hex.EncodeToString(e.digest)
-			fmt.Printf("Previous: %s\n", shahash)
-			knownChunks.Set(shahash, true)
-		}
+	_, err := loadPreviousChunks(client, archive.ArchiveName, knownChunks)
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Known chunks: %d!\n", knownChunks.Len())
 	f := &os.File{}
 	if pxarOut != "" {
 		f, err = os.Create(pxarOut)
@@ -394,22 +489,14 @@ func backup_real(client *pbscommon.PBSClient, newchunk, reusechunk *atomic.Uint6
 		}
 		defer f.Close()
 	}
-	/**/
 
 	pxarChunk := ChunkState{}
 	pxarChunk.Init(newchunk, reusechunk, knownChunks)
 
-	pcat1Chunk := ChunkState{}
-	pcat1Chunk.Init(newchunk, reusechunk, knownChunks)
-
 	pxarChunk.wrid, err = client.CreateDynamicIndex(archive.ArchiveName)
 	if err != nil {
 		return err
 	}
-	pcat1Chunk.wrid, err = client.CreateDynamicIndex("catalog.pcat1.didx")
-	if err != nil {
-		return err
-	}
 
 	archive.WriteCB = func(b []byte) {
 
@@ -423,41 +510,185 @@ func backup_real(client *pbscommon.PBSClient, newchunk, reusechunk *atomic.Uint6
 		//
 	}
 
-	archive.CatalogWriteCB = func(b []byte) {
-		pcat1Chunk.HandleData(b, client)
+	payloadChunk := ChunkState{}
+	if payloadName != "" {
+		previousPayload, err := loadPreviousChunks(client, payloadName, knownChunks)
+		if err != nil {
+			return err
+		}
+
+		payloadOut := &os.File{}
+		if pxarOut != "" {
+			payloadOut, err = os.Create(pxarOut + ".ppxar")
+			if err != nil {
+				return err
+			}
+			defer payloadOut.Close()
+		}
+
+		payloadChunk.Init(newchunk, reusechunk, knownChunks)
+		payloadChunk.wrid, err = client.CreateDynamicIndex(payloadName)
+		if err != nil {
+			return err
+		}
+
+		archive.PayloadWriteCB = func(b []byte) {
+			if pxarOut != "" {
+				// TODO: error handling inside callback
+				payloadOut.Write(b)
+			}
+			payloadChunk.HandleData(b, client)
+		}
+
+		if cfg.ChangeDetectionMode == "metadata" && previousPayload != nil {
+			previous, err := loadPreviousMetadata(client, archive.ArchiveName, payloadName, previousPayload)
+			if err != nil {
+				fmt.Printf("Cannot use previous %s, reading all files: %v\n", archive.ArchiveName, err)
+			} else if previous != nil {
+				previous.ReuseCB = func(offset uint64, length uint64) (uint64, uint64, error) {
+					return payloadChunk.Inject(client, previousPayload, offset, length)
+				}
+				archive.Previous = previous
+			}
+		}
 	}
 
 	//This is the entry point of backup job which will start streaming with the PCAT and PXAR write callback
 	//Data to be hashed and eventuall uploaded
 
-	archive.WriteDir(backupdir, "", true)
+	if a.tar != nil {
+		fmt.Printf("Writing %s from tar stream on STDIN\n", archive.ArchiveName)
+		if err := archive.WriteTar(a.tar); err != nil {
+			return err
+		}
+	} else if a.stream != nil {
+		fmt.Printf("Writing %s holding %s from %s\n", archive.ArchiveName, a.stream.name, a.stream.source())
+		if err := archive.WriteStream(a.stream.r, a.stream.name, a.stream.mode, a.stream.mtime); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("Writing %s from %s\n", archive.ArchiveName, a.Path)
+		archive.WriteDir(a.Path, "", true)
+	}
+	report.Excluded += archive.Excluded
+	report.Reused += archive.Reused
+	report.Warnings = append(report.Warnings, archive.Warnings...)
 
 	pxarChunk.Eof(client)
-	pcat1Chunk.Eof(client)
+	if payloadName != "" {
+		payloadChunk.Eof(client)
+	}
+	return nil
+}
+
+func backup_real(client *pbscommon.PBSClient, newchunk, reusechunk *atomic.Uint64, report *BackupReport, cfg *Config, archives []ArchiveConfig) error {
+	//A missing or unreadable backup dir would otherwise produce an empty archive with just a warning
+	for _, a := range archives {
+		if a.Path == "" {
+			continue
+		}
+		if _, err := os.ReadDir(a.Path); err != nil {
+			return err
+		}
+	}
 
-	err = client.UploadManifest()
+	client.Connect(false, "host")
+	knownChunks := hashmap.New[string, bool]()
+
+	//Only pxar archives have catalog entries, a snapshot of raw streams has no catalog at all
+	hasPXAR := false
+	for _, a := range archives {
+		hasPXAR = hasPXAR || a.stream == nil || !a.stream.raw
+	}
+	var catalog *pbscommon.PXARCatalog
+	pcat1Chunk := ChunkState{}
+	if hasPXAR {
+		pcat1Chunk.Init(newchunk, reusechunk, knownChunks)
+		var err error
+		pcat1Chunk.wrid, err = client.CreateDynamicIndex("catalog.pcat1.didx")
+		if err != nil {
+			return err
+		}
+		catalog = &pbscommon.PXARCatalog{
+			WriteCB: func(b []byte) {
+				pcat1Chunk.HandleData(b, client)
+			},
+		}
+	}
+
+	for _, a := range archives {
+		var err error
+		if a.stream != nil && a.stream.raw {
+			fmt.Printf("Writing %s from %s\n", a.Name, a.stream.source())
+			err = backup_raw_stream(client, newchunk, reusechunk, knownChunks, a.Name, a.stream.r)
+		} else {
+			//With more than one archive each debug copy gets the archive name appended
+			pxarOut := cfg.PxarOut
+			if pxarOut != "" && len(archives) > 1 {
+				pxarOut += "." + strings.TrimSuffix(a.Name, ".didx")
+			}
+			err = backup_archive(client, newchunk, reusechunk, report, cfg, knownChunks, catalog, a, pxarOut)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if catalog != nil {
+		catalog.Finish()
+		pcat1Chunk.Eof(client)
+	}
+
+	err := client.UploadManifest()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func backup(client *pbscommon.PBSClient, newchunk, reusechunk *atomic.Uint64, pxarOut string, backupdir string, usevss bool) error {
+func backup(client *pbscommon.PBSClient, newchunk, reusechunk *atomic.Uint64, report *BackupReport, cfg *Config) error {
+	archives := cfg.archives()
+	paths := make([]string, 0)
+	for _, a := range archives {
+		if a.tar != nil {
+			fmt.Printf("Starting backup of tar stream to %s\n", a.Name)
+			continue
+		}
+		if a.stream != nil {
+			fmt.Printf("Starting backup of stream to %s\n", a.Name)
+			//A command left running by a failed backup must not outlive it
+			if a.stream.command != nil {
+				defer a.stream.command.Close()
+			}
+			continue
+		}
+		fmt.Printf("Starting backup of %s to %s\n", a.Path, a.Name)
+		paths = append(paths, a.Path)
+	}
 
-	fmt.Printf("Starting backup of %s\n", backupdir)
 	var err error
-	if usevss {
-		err = snapshot.CreateVSSSnapshot(([]string{backupdir}), func(snaps map[string]snapshot.SnapShot) error {
-			k := maps.Keys(snaps)
-			k2 := slices.Collect(k)
-			SNAP := snaps[k2[0]]
-			backupdir = SNAP.FullPath
+	if cfg.UseVSS {
+		err = snapshot.CreateVSSSnapshot(paths, func(snaps map[string]snapshot.SnapShot) error {
+			//Snapshots are keyed by absolute source path, possibly sharing the same volume snapshot
+			snapArchives := make([]ArchiveConfig, 0)
+			for _, a := range archives {
+				if a.Path == "" {
+					snapArchives = append(snapArchives, a)
+					continue
+				}
+				abs, _ := filepath.Abs(a.Path)
+				SNAP, ok := snaps[abs]
+				if !ok {
+					return fmt.Errorf("no snapshot for %s", a.Path)
+				}
+				snapArchives = append(snapArchives, ArchiveConfig{Name: a.Name, Path: SNAP.FullPath})
+			}
 			//Remove VSS snapshot on windows, on linux for now NOP
-			return backup_real(client, newchunk, reusechunk, pxarOut, backupdir)
+			return backup_real(client, newchunk, reusechunk, report, cfg, snapArchives)
 
 		})
 	} else {
-		err = backup_real(client, newchunk, reusechunk, pxarOut, backupdir)
+		err = backup_real(client, newchunk, reusechunk, report, cfg, archives)
 	}
 
 	if err != nil {
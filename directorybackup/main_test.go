@@ -0,0 +1,156 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"pbscommon"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cornelk/hashmap"
+)
+
+// Previous index of chunks 0..n-1, chunk i has 100*(i+1) bytes, every chunk but unknown is known to the server
+func testPreviousIndex(n int, unknown int, knownChunks *hashmap.Map[string, bool]) *pbscommon.DynamicIndex {
+	prev := &pbscommon.DynamicIndex{}
+	end := uint64(0)
+	for i := 0; i < n; i++ {
+		end += uint64(100 * (i + 1))
+		digest := sha256.Sum256([]byte(fmt.Sprintf("chunk %d", i)))
+		prev.Ends = append(prev.Ends, end)
+		prev.Digests = append(prev.Digests, hex.EncodeToString(digest[:]))
+		if i != unknown {
+			knownChunks.Set(prev.Digests[i], true)
+		}
+	}
+	return prev
+}
+
+func TestChunkStateInject(t *testing.T) {
+	//One step is an injection of [offset, offset+length) or, with length 0, data written in between
+	type step struct {
+		offset uint64
+		length uint64
+		want   uint64 //Position of offset in the new stream
+	}
+	tests := []struct {
+		name    string
+		steps   []step
+		unknown int   //Chunk not known to the server, 0 for none
+		chunks  []int //Chunks of the previous index the new one is made of, -1 for written data
+		err     bool
+	}{
+		{
+			name:   "range inside one chunk",
+			steps:  []step{{250, 20, 150}},
+			chunks: []int{1},
+		},
+		{
+			name:   "range over several chunks",
+			steps:  []step{{50, 300, 50}},
+			chunks: []int{0, 1, 2},
+		},
+		{
+			name:   "consecutive ranges extend the run",
+			steps:  []step{{0, 50, 0}, {50, 100, 50}, {150, 450, 150}},
+			chunks: []int{0, 1, 2},
+		},
+		{
+			name:   "range in a chunk already taken over",
+			steps:  []step{{0, 120, 0}, {110, 20, 110}, {130, 10, 130}},
+			chunks: []int{0, 1},
+		},
+		{
+			name:   "skipped chunks start a new run",
+			steps:  []step{{0, 50, 0}, {700, 10, 200}},
+			chunks: []int{0, 3},
+		},
+		{
+			name:   "going back starts a new run",
+			steps:  []step{{100, 200, 0}, {0, 50, 200}},
+			chunks: []int{1, 0},
+		},
+		{
+			name:   "written data in between ends the run",
+			steps:  []step{{0, 50, 0}, {}, {60, 10, 100 + 26 + 60}},
+			chunks: []int{0, -1, 0},
+		},
+		{
+			name:    "chunk unknown to the server",
+			steps:   []step{{150, 200, 0}},
+			unknown: 2,
+			err:     true,
+		},
+		{
+			name:  "range past the end",
+			steps: []step{{900, 200, 0}},
+			err:   true,
+		},
+		{
+			name:  "empty range",
+			steps: []step{{100, 0, 0}},
+			err:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			knownChunks := hashmap.New[string, bool]()
+			unknown := -1
+			if tt.unknown > 0 {
+				unknown = tt.unknown
+			}
+			prev := testPreviousIndex(4, unknown, knownChunks)
+			//26 bytes below the minimum chunk size, known to the server so committing them uploads nothing
+			data := []byte("written between injections")
+			digest := sha256.Sum256(data)
+			knownChunks.Set(hex.EncodeToString(digest[:]), true)
+
+			c := ChunkState{}
+			c.Init(new(atomic.Uint64), new(atomic.Uint64), knownChunks)
+			for _, s := range tt.steps {
+				if s.offset == 0 && s.length == 0 {
+					c.HandleData(data, nil)
+					continue
+				}
+				pos, size, err := c.Inject(nil, prev, s.offset, s.length)
+				if tt.err {
+					if err == nil {
+						t.Errorf("inject %d+%d succeeded, want an error", s.offset, s.length)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("inject %d+%d: %v", s.offset, s.length, err)
+				}
+				if pos != s.want || size != c.pos {
+					t.Errorf("inject %d+%d at %d, stream size %d, want %d and %d", s.offset, s.length, pos, size, s.want, c.pos)
+				}
+			}
+
+			want := []string{}
+			offsets := []uint64{}
+			end := uint64(0)
+			for _, i := range tt.chunks {
+				offsets = append(offsets, end)
+				if i < 0 {
+					want = append(want, hex.EncodeToString(digest[:]))
+					end += uint64(len(data))
+					continue
+				}
+				want = append(want, prev.Digests[i])
+				end += prev.Ends[i] - prev.ChunkStart(i)
+			}
+			if !slices.Equal(c.assignments, want) || !slices.Equal(c.assignments_offset, offsets) {
+				t.Errorf("chunks %v at %v, want %v at %v", c.assignments, c.assignments_offset, want, offsets)
+			}
+			if c.chunkcount != uint64(len(want)) || c.pos != end {
+				t.Errorf("%d chunks of %d bytes, want %d of %d", c.chunkcount, c.pos, len(want), end)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"clientcommon"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"pbscommon"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Catalog entry as printed by ls and find, size and mtime are only known for regular files
+type catalogItem struct {
+	Path  string `json:"path"`
+	Type  string `json:"type"`
+	Size  uint64 `json:"size,omitempty"`
+	MTime string `json:"mtime,omitempty"`
+}
+
+func newCatalogItem(p string, e *pbscommon.CatalogEntry) catalogItem {
+	item := catalogItem{Path: "/" + p, Type: kindName(e.Kind)}
+	if e.Kind == 'f' {
+		item.Size = e.Size
+		item.MTime = time.Unix(e.MTime, 0).UTC().Format(time.RFC3339)
+	}
+	return item
+}
+
+func printItems(out io.Writer, items []catalogItem, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(items)
+	}
+	for _, i := range items {
+		size, mtime, suffix := "-", "-", ""
+		if i.Type == "file" {
+			size = fmt.Sprintf("%d", i.Size)
+			mtime = i.MTime
+		}
+		if i.Type == "directory" {
+			suffix = "/"
+		}
+		if _, err := fmt.Fprintf(out, "%-10s %14s %-20s %s%s\n", i.Type, size, mtime, i.Path, suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Accepts RFC3339 or a plain date
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+func cmdLs(args []string) int {
+	stdout := dataStdout()
+
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	fs.SetOutput(os.Stderr)
+	conn := addConnectionFlags(fs)
+	pathFlag := fs.String("path", "/", "Directory inside the archive to list")
+	jsonFlag := fs.Bool("json", false, "Print entries as JSON (optional)")
+	fs.Parse(args)
+
+	cfg, err := conn.load()
+	if err != nil {
+		fmt.Println(err)
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	catalog, archive, _, err := cfg.snapshotCatalog()
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	p := strings.Trim(path.Clean("/"+*pathFlag), "/")
+	dir, err := catalog.Lookup(archive, p)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+
+	items := make([]catalogItem, 0)
+	if dir.Kind != 'd' {
+		items = append(items, newCatalogItem(p, dir))
+	} else {
+		entries, err := catalog.ReadDir(dir)
+		if err != nil {
+			fmt.Println(err)
+			return exitFailure
+		}
+		for i := range entries {
+			items = append(items, newCatalogItem(path.Join(p, entries[i].Name), &entries[i]))
+		}
+	}
+	if err := printItems(stdout, items, *jsonFlag); err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	return 0
+}
+
+type findFilter struct {
+	name    string
+	regex   *regexp.Regexp
+	kinds   string
+	minSize int64
+	maxSize int64
+	newer   time.Time
+	older   time.Time
+}
+
+// Size and time conditions only match regular files, the catalog has neither for other entries
+func (f *findFilter) match(p string, e *pbscommon.CatalogEntry) bool {
+	if f.name != "" {
+		if ok, _ := path.Match(f.name, e.Name); !ok {
+			return false
+		}
+	}
+	if f.regex != nil && !f.regex.MatchString("/"+p) {
+		return false
+	}
+	if f.kinds != "" && !strings.ContainsRune(f.kinds, rune(e.Kind)) {
+		return false
+	}
+	if f.minSize >= 0 || f.maxSize >= 0 || !f.newer.IsZero() || !f.older.IsZero() {
+		if e.Kind != 'f' {
+			return false
+		}
+		if (f.minSize >= 0 && e.Size < uint64(f.minSize)) || (f.maxSize >= 0 && e.Size > uint64(f.maxSize)) {
+			return false
+		}
+		if (!f.newer.IsZero() && e.MTime <= f.newer.Unix()) || (!f.older.IsZero() && e.MTime >= f.older.Unix()) {
+			return false
+		}
+	}
+	return true
+}
+
+func cmdFind(args []string) int {
+	stdout := dataStdout()
+
+	fs := flag.NewFlagSet("find", flag.ExitOnError)
+	fs.SetOutput(os.Stderr)
+	conn := addConnectionFlags(fs)
+	pathFlag := fs.String("path", "/", "Directory inside the archive to search below")
+	nameFlag := fs.String("name", "", "Glob matched against the file name, example: *.docx (optional)")
+	regexFlag := fs.String("regex", "", "Regular expression matched against the full path starting with / (optional)")
+	typeFlag := fs.String("type", "", "Entry types to report, any of d f l h b c p s, example: fl (optional)")
+	minSizeFlag := fs.String("min-size", "", "Only files at least this big, K, M, G, T suffixes allowed (optional)")
+	maxSizeFlag := fs.String("max-size", "", "Only files at most this big (optional)")
+	newerFlag := fs.String("newer", "", "Only files modified after this time, RFC3339 or YYYY-MM-DD (optional)")
+	olderFlag := fs.String("older", "", "Only files modified before this time (optional)")
+	jsonFlag := fs.Bool("json", false, "Print entries as JSON (optional)")
+	fs.Parse(args)
+
+	cfg, err := conn.load()
+	if err != nil {
+		fmt.Println(err)
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	filter := &findFilter{name: *nameFlag, kinds: *typeFlag, minSize: -1, maxSize: -1}
+	if _, err = path.Match(filter.name, ""); err == nil && *regexFlag != "" {
+		filter.regex, err = regexp.Compile(*regexFlag)
+	}
+	if err == nil && *minSizeFlag != "" {
+		filter.minSize, err = clientcommon.ParseSize(*minSizeFlag)
+	}
+	if err == nil && *maxSizeFlag != "" {
+		filter.maxSize, err = clientcommon.ParseSize(*maxSizeFlag)
+	}
+	if err == nil && *newerFlag != "" {
+		filter.newer, err = parseTime(*newerFlag)
+	}
+	if err == nil && *olderFlag != "" {
+		filter.older, err = parseTime(*olderFlag)
+	}
+	if err != nil {
+		fmt.Printf("Invalid filter: %v\n", err)
+		return exitFailure
+	}
+
+	catalog, archive, _, err := cfg.snapshotCatalog()
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	items := make([]catalogItem, 0)
+	err = catalog.Walk(archive, *pathFlag, func(p string, e *pbscommon.CatalogEntry) error {
+		if filter.match(p, e) {
+			item := newCatalogItem(p, e)
+			//Text results are printed as found, large trees would otherwise show nothing for a long time
+			if !*jsonFlag {
+				return printItems(stdout, []catalogItem{item}, false)
+			}
+			items = append(items, item)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	if *jsonFlag {
+		if err := printItems(stdout, items, true); err != nil {
+			fmt.Println(err)
+			return exitFailure
+		}
+	}
+	return 0
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"clientcommon"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"pbscommon"
+	"strings"
+)
+
+// Local directory standing for archive path prefix, entries are read the way the archiver reads them
+type localTree struct {
+	root   string
+	prefix string
+}
+
+func (t *localTree) file(p string) string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(p, t.prefix), "/")
+	return filepath.Join(t.root, filepath.FromSlash(rel))
+}
+
+func (t *localTree) lookup(p string) (*diffEntry, error) {
+	e, err := pbscommon.LocalEntry(t.file(p))
+	if err != nil {
+		return nil, err
+	}
+	return &diffEntry{name: e.Name, kind: e.Kind, size: e.Size, mtime: e.MTime, pxar: e}, nil
+}
+
+func (t *localTree) readDir(p string, dir *diffEntry) ([]diffEntry, error) {
+	entries, err := os.ReadDir(t.file(p))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]diffEntry, 0, len(entries))
+	for _, de := range entries {
+		e, err := t.lookup(path.Join(p, de.Name()))
+		if errors.Is(err, fs.ErrNotExist) {
+			//Deleted since the listing, a snapshot entry of that name shows up as missing
+			continue
+		}
+		if err != nil {
+			e = &diffEntry{name: de.Name(), kind: dirEntryKind(de), err: err}
+		}
+		ret = append(ret, *e)
+	}
+	return ret, nil
+}
+
+func dirEntryKind(de fs.DirEntry) byte {
+	switch t := de.Type(); {
+	case t.IsDir():
+		return 'd'
+	case t.IsRegular():
+		return 'f'
+	case t&fs.ModeSymlink != 0:
+		return 'l'
+	case t&fs.ModeNamedPipe != 0:
+		return 'p'
+	case t&fs.ModeSocket != 0:
+		return 's'
+	case t&fs.ModeCharDevice != 0:
+		return 'c'
+	case t&fs.ModeDevice != 0:
+		return 'b'
+	}
+	return '?'
+}
+
+func (t *localTree) open(p string, e *diffEntry) (io.ReadCloser, error) {
+	return os.Open(t.file(p))
+}
+
+// Names used by compare, the snapshot is the old side and the directory the new one
+var compareChanges = map[string]string{
+	"removed":    "missing",
+	"added":      "extra",
+	"modified":   "differs",
+	"unreadable": "unreadable",
+}
+
+func cmdCompare(args []string) int {
+	var excludes clientcommon.ArrayFlags
+	stdout := dataStdout()
+
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	fs.SetOutput(os.Stderr)
+	conn := addConnectionFlags(fs)
+	dirFlag := fs.String("dir", "", "Local directory to check")
+	pathFlag := fs.String("path", "/", "Directory inside the archive the local directory should match")
+	fs.Var(&excludes, "exclude", "Can be specified multiple times, do not compare paths matching the pattern, .pxarexclude syntax relative to archive root (optional)")
+	metadataFlag := fs.Bool("metadata", false, "Also compare mtimes, permissions, ownership, xattrs and ACLs (optional)")
+	jsonFlag := fs.Bool("json", false, "Print differences as JSON (optional)")
+	fs.Parse(args)
+
+	cfg, err := conn.load()
+	if err != nil || *dirFlag == "" {
+		if err != nil {
+			fmt.Println(err)
+		}
+		fmt.Println("-dir is mandatory")
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	client := cfg.client()
+	snap, err := cfg.selectSnapshot(client)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	d, err := pbscommon.OpenSnapshotArchive(cfg.connect(snap), snap, cfg.Archive)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+
+	p := strings.Trim(path.Clean("/"+*pathFlag), "/")
+	local := &localTree{root: *dirFlag, prefix: p}
+	items := make([]diffItem, 0)
+	df := &differ{
+		old:      &pxarTree{decoder: d, resolveHardlinks: true},
+		new:      local,
+		metadata: *metadataFlag,
+		content:  true,
+		excludes: parsePatterns(excludes),
+		counts:   make(map[string]int),
+		tolerant: true,
+		emit: func(item diffItem) error {
+			item.Change = compareChanges[item.Change]
+			if *jsonFlag {
+				items = append(items, item)
+				return nil
+			}
+			_, err := fmt.Fprintf(stdout, "%-8s %s %s\n", item.Change, item.Path, strings.Join(item.Details, ", "))
+			return err
+		},
+	}
+	a, err := df.old.lookup(p)
+	if err != nil {
+		fmt.Printf("%s: %v\n", snapshotName(snap), err)
+		return exitFailure
+	}
+	b, err := local.lookup(p)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+
+	fmt.Printf("Comparing %s with /%s of %s\n", *dirFlag, p, snapshotName(snap))
+	err = df.compare(p, a, b)
+	if err == nil && *jsonFlag {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(items)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	fmt.Printf("Missing %d, Extra %d, Differing %d, Unreadable %d\n", df.counts["removed"], df.counts["added"], df.counts["modified"], df.counts["unreadable"])
+	if df.counts["removed"]+df.counts["added"]+df.counts["modified"] > 0 {
+		return exitDifferences
+	}
+	if df.counts["unreadable"] > 0 {
+		return exitWarnings
+	}
+	return 0
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"pbscommon"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Connection settings use the same JSON keys as the backup client config, so its file can be passed with -config
+type Config struct {
+	BaseURL         string `json:"baseurl"`
+	CertFingerprint string `json:"certfingerprint"`
+	AuthID          string `json:"authid"`
+	Secret          string `json:"secret"`
+	Datastore       string `json:"datastore"`
+	Namespace       string `json:"namespace"`
+	BackupID        string `json:"backup-id"`
+	Snapshot        string `json:"snapshot"`
+	Archive         string `json:"archive"`
+	//Basic authentication of serve
+	ServeUser     string `json:"serve-user"`
+	ServePassword string `json:"serve-password"`
+}
+
+func (c *Config) valid() bool {
+	return c.BaseURL != "" && c.AuthID != "" && c.Secret != "" && c.Datastore != ""
+}
+
+type connectionFlags struct {
+	baseURL         *string
+	certFingerprint *string
+	authID          *string
+	secret          *string
+	datastore       *string
+	namespace       *string
+	backupID        *string
+	snapshot        *string
+	archive         *string
+	config          *string
+}
+
+func addConnectionFlags(fs *flag.FlagSet) *connectionFlags {
+	return &connectionFlags{
+		baseURL:         fs.String("baseurl", "", "Base URL for the proxmox backup server, example: https://192.168.1.10:8007"),
+		certFingerprint: fs.String("certfingerprint", "", "Certificate fingerprint for SSL connection, example: ea:7d:06:f9..."),
+		authID:          fs.String("authid", "", "Authentication ID (PBS Api token)"),
+		secret:          fs.String("secret", "", "Secret for authentication"),
+		datastore:       fs.String("datastore", "", "Datastore name"),
+		namespace:       fs.String("namespace", "", "Namespace (optional)"),
+		backupID:        fs.String("backup-id", "", "Backup ID (optional - if not specified, the hostname is used as the default)"),
+		snapshot:        fs.String("snapshot", "", "Snapshot as type/id/time or just time, example: host/myhost/2026-03-01T00:07:00Z (optional - latest snapshot of the backup id by default)"),
+		archive:         fs.String("archive", "", "Archive name inside the snapshot (optional - backup by default)"),
+		config:          fs.String("config", "", "Path to JSON config file, the backup client config can be used. Flags override the loaded config file"),
+	}
+}
+
+func (f *connectionFlags) load() (*Config, error) {
+	config := &Config{}
+	if *f.config != "" {
+		file, err := os.ReadFile(*f.config)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := json.Unmarshal(file, config); err != nil {
+			return nil, fmt.Errorf("parsing config file: %w", err)
+		}
+	}
+
+	override := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	override(&config.BaseURL, *f.baseURL)
+	override(&config.CertFingerprint, *f.certFingerprint)
+	override(&config.AuthID, *f.authID)
+	override(&config.Secret, *f.secret)
+	override(&config.Datastore, *f.datastore)
+	override(&config.Namespace, *f.namespace)
+	override(&config.BackupID, *f.backupID)
+	override(&config.Snapshot, *f.snapshot)
+	override(&config.Archive, *f.archive)
+
+	if config.BackupID == "" {
+		hostname, _ := os.Hostname()
+		config.BackupID = hostname
+	}
+	if config.Archive == "" {
+		config.Archive = "backup"
+	}
+	if !config.valid() {
+		return nil, fmt.Errorf("baseurl, authid, secret and datastore are mandatory")
+	}
+	return config, nil
+}
+
+func (c *Config) client() *pbscommon.PBSClient {
+	return &pbscommon.PBSClient{
+		BaseURL:         c.BaseURL,
+		CertFingerPrint: c.CertFingerprint,
+		AuthID:          c.AuthID,
+		Secret:          c.Secret,
+		Datastore:       c.Datastore,
+		Namespace:       c.Namespace,
+		Insecure:        c.CertFingerprint != "",
+	}
+}
+
+func snapshotName(m *pbscommon.BackupManifest) string {
+	return fmt.Sprintf("%s/%s/%s", m.BackupType, m.BackupID, time.Unix(m.BackupTime, 0).UTC().Format(time.RFC3339))
+}
+
+// Snapshots of the configured backup group, oldest first
+func (c *Config) groupSnapshots(client *pbscommon.PBSClient) ([]pbscommon.BackupManifest, error) {
+	snaps, err := client.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	backupType, backupID := "host", c.BackupID
+	if parts := strings.Split(c.Snapshot, "/"); len(parts) == 3 {
+		backupType, backupID = parts[0], parts[1]
+	}
+	ret := make([]pbscommon.BackupManifest, 0)
+	for _, s := range snaps {
+		if s.BackupType == backupType && s.BackupID == backupID {
+			ret = append(ret, s)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].BackupTime < ret[j].BackupTime
+	})
+	return ret, nil
+}
+
+// -snapshot accepts type/id/time, just the time, or nothing for the most recent snapshot of the group
+func (c *Config) selectSnapshot(client *pbscommon.PBSClient) (*pbscommon.BackupManifest, error) {
+	snaps, err := c.groupSnapshots(client)
+	if err != nil {
+		return nil, err
+	}
+	if len(snaps) == 0 {
+		return nil, fmt.Errorf("no snapshots found for %s", c.BackupID)
+	}
+	return findSnapshot(snaps, c.Snapshot)
+}
+
+// Snapshot of snaps named by spec, the last one for "" or latest
+func findSnapshot(snaps []pbscommon.BackupManifest, spec string) (*pbscommon.BackupManifest, error) {
+	if spec == "" || spec == "latest" {
+		return &snaps[len(snaps)-1], nil
+	}
+	parts := strings.Split(spec, "/")
+	t, err := time.Parse(time.RFC3339, parts[len(parts)-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", spec, err)
+	}
+	for i := range snaps {
+		if snaps[i].BackupTime == t.Unix() {
+			return &snaps[i], nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %s not found", spec)
+}
+
+// Reader session on a snapshot
+func (c *Config) connect(m *pbscommon.BackupManifest) *pbscommon.PBSClient {
+	client := c.client()
+	client.Manifest.BackupID = m.BackupID
+	client.Manifest.BackupTime = m.BackupTime
+	client.Connect(true, m.BackupType)
+	return client
+}
+
+// Index name the archive is listed with in the catalog, the metadata archive for split archives
+func catalogArchive(m *pbscommon.BackupManifest, name string) string {
+	base := pbscommon.PXARArchiveBase(name)
+	if m.HasFile(base + ".mpxar.didx") {
+		return base + ".mpxar.didx"
+	}
+	return base + ".pxar.didx"
+}
+
+func openCatalog(client *pbscommon.PBSClient, m *pbscommon.BackupManifest) (*pbscommon.CatalogReader, error) {
+	if !m.HasFile("catalog.pcat1.didx") {
+		return nil, fmt.Errorf("snapshot %s has no catalog", snapshotName(m))
+	}
+	r, err := pbscommon.OpenDynamicIndexReader(client, "catalog.pcat1.didx")
+	if err != nil {
+		return nil, err
+	}
+	return pbscommon.NewCatalogReader(r, uint64(r.Size()))
+}
+
+// Catalog of the selected snapshot and the name the configured archive has in it
+func (c *Config) snapshotCatalog() (*pbscommon.CatalogReader, string, *pbscommon.BackupManifest, error) {
+	client := c.client()
+	snap, err := c.selectSnapshot(client)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	catalog, err := openCatalog(c.connect(snap), snap)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return catalog, catalogArchive(snap, c.Archive), snap, nil
+}
+
+// Patterns use the .pxarexclude syntax relative to archive root
+func parsePatterns(lines []string) []pbscommon.ExcludePattern {
+	ret := make([]pbscommon.ExcludePattern, 0)
+	for _, l := range lines {
+		if p, ok := pbscommon.ParseExcludePattern(l, ""); ok {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
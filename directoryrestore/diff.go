@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"clientcommon"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"pbscommon"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry of either side of a diff, cat is set when comparing catalogs, pxar when comparing archives
+type diffEntry struct {
+	name  string
+	kind  byte
+	size  uint64
+	mtime time.Time
+	cat   *pbscommon.CatalogEntry
+	pxar  *pbscommon.PXAREntry
+	//Set when the entry is listed but could not be read, kind then comes from the directory listing
+	err error
+}
+
+type diffTree interface {
+	lookup(p string) (*diffEntry, error)
+	readDir(p string, dir *diffEntry) ([]diffEntry, error)
+	open(p string, e *diffEntry) (io.ReadCloser, error)
+}
+
+type catalogTree struct {
+	catalog *pbscommon.CatalogReader
+	archive string
+}
+
+func catalogDiffEntry(e *pbscommon.CatalogEntry) diffEntry {
+	ret := diffEntry{name: e.Name, kind: e.Kind, size: e.Size, cat: e}
+	if e.Kind == 'f' {
+		ret.mtime = time.Unix(e.MTime, 0)
+	}
+	return ret
+}
+
+func (t *catalogTree) lookup(p string) (*diffEntry, error) {
+	e, err := t.catalog.Lookup(t.archive, p)
+	if err != nil {
+		return nil, err
+	}
+	ret := catalogDiffEntry(e)
+	return &ret, nil
+}
+
+func (t *catalogTree) readDir(p string, dir *diffEntry) ([]diffEntry, error) {
+	entries, err := t.catalog.ReadDir(dir.cat)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]diffEntry, len(entries))
+	for i := range entries {
+		ret[i] = catalogDiffEntry(&entries[i])
+	}
+	return ret, nil
+}
+
+func (t *catalogTree) open(p string, e *diffEntry) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("the catalog has no file content")
+}
+
+type pxarTree struct {
+	decoder *pbscommon.PXARDecoder
+	//Hardlinks are compared as the file they point to, local directories have no hardlink entries
+	resolveHardlinks bool
+}
+
+func (t *pxarTree) entry(e *pbscommon.PXAREntry) (diffEntry, error) {
+	if e.Kind == 'h' && t.resolveHardlinks {
+		target, err := t.decoder.ResolveHardlink(e)
+		if err != nil {
+			return diffEntry{}, err
+		}
+		resolved := *target
+		resolved.Name, resolved.Path = e.Name, e.Path
+		e = &resolved
+	}
+	return diffEntry{name: e.Name, kind: e.Kind, size: e.Size, mtime: e.MTime, pxar: e}, nil
+}
+
+func (t *pxarTree) lookup(p string) (*diffEntry, error) {
+	e, err := t.decoder.Lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := t.entry(e)
+	return &ret, err
+}
+
+func (t *pxarTree) readDir(p string, dir *diffEntry) ([]diffEntry, error) {
+	entries, err := t.decoder.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]diffEntry, len(entries))
+	for i := range entries {
+		if ret[i], err = t.entry(entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (t *pxarTree) open(p string, e *diffEntry) (io.ReadCloser, error) {
+	r, err := t.decoder.OpenPayload(e.pxar)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(r), nil
+}
+
+type diffItem struct {
+	Change    string   `json:"change"` //added, removed, modified or, when comparing a local directory, unreadable
+	Path      string   `json:"path"`
+	Type      string   `json:"type"`
+	OldSize   uint64   `json:"old_size,omitempty"`
+	NewSize   uint64   `json:"new_size,omitempty"`
+	SizeDelta int64    `json:"size_delta,omitempty"`
+	OldMTime  string   `json:"old_mtime,omitempty"`
+	NewMTime  string   `json:"new_mtime,omitempty"`
+	Details   []string `json:"details,omitempty"` //What differs for modified entries
+}
+
+func formatMTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+type differ struct {
+	old diffTree
+	new diffTree
+	//mtimes and, when both sides have them, permissions, ownership, xattrs, ACLs and devices are compared
+	metadata bool
+	//Files of the same size are compared byte by byte
+	content  bool
+	includes []pbscommon.ExcludePattern
+	excludes []pbscommon.ExcludePattern
+	emit     func(diffItem) error
+	counts   map[string]int
+	//Entries which cannot be read are reported as unreadable and the walk goes on, otherwise the error ends it
+	tolerant bool
+}
+
+func (df *differ) report(item diffItem) error {
+	if !isIncluded(df.includes, strings.TrimPrefix(item.Path, "/"), item.Type == "directory") {
+		return nil
+	}
+	df.counts[item.Change]++
+	return df.emit(item)
+}
+
+func (df *differ) unreadable(p string, kind byte, err error) error {
+	if !df.tolerant {
+		return err
+	}
+	return df.report(diffItem{Change: "unreadable", Path: "/" + p, Type: kindName(kind), Details: []string{err.Error()}})
+}
+
+func (df *differ) sameContent(p string, a *diffEntry, b *diffEntry) (bool, error) {
+	ra, err := df.old.open(p, a)
+	if err != nil {
+		return false, err
+	}
+	defer ra.Close()
+	rb, err := df.new.open(p, b)
+	if err != nil {
+		return false, err
+	}
+	defer rb.Close()
+	bufa := make([]byte, 1024*1024)
+	bufb := make([]byte, 1024*1024)
+	for {
+		na, erra := io.ReadFull(ra, bufa)
+		nb, errb := io.ReadFull(rb, bufb)
+		if na != nb || !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+		if erra == io.EOF || erra == io.ErrUnexpectedEOF {
+			return errb == io.EOF || errb == io.ErrUnexpectedEOF, nil
+		}
+		if erra != nil {
+			return false, erra
+		}
+		if errb != nil {
+			return false, errb
+		}
+	}
+}
+
+// Names of what differs, catalogs only know size and mtime of regular files.
+// Directory mtimes are left out, they change whenever an entry is added or removed
+func (df *differ) changes(p string, a *diffEntry, b *diffEntry) ([]string, error) {
+	if a.kind != b.kind {
+		return []string{"type"}, nil
+	}
+	ret := make([]string, 0)
+	if a.size != b.size {
+		ret = append(ret, "size")
+	}
+	if df.metadata && a.kind != 'd' && !a.mtime.Equal(b.mtime) {
+		ret = append(ret, "mtime")
+	}
+	if a.pxar == nil || b.pxar == nil {
+		return ret, nil
+	}
+
+	pa, pb := a.pxar, b.pxar
+	if pa.LinkTarget != pb.LinkTarget {
+		ret = append(ret, "target")
+	}
+	if df.metadata {
+		if pa.Mode&0o7777 != pb.Mode&0o7777 {
+			ret = append(ret, "mode")
+		}
+		if pa.UID != pb.UID || pa.GID != pb.GID {
+			ret = append(ret, "owner")
+		}
+		if !reflect.DeepEqual(pa.Metadata, pb.Metadata) {
+			ret = append(ret, "metadata")
+		}
+		if pa.DevMajor != pb.DevMajor || pa.DevMinor != pb.DevMinor {
+			ret = append(ret, "device")
+		}
+	}
+	if df.content && a.kind == 'f' && a.size == b.size {
+		same, err := df.sameContent(p, a, b)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			ret = append(ret, "content")
+		}
+	}
+	return ret, nil
+}
+
+// Reports an entry only one side has, with everything below it
+func (df *differ) one(change string, tree diffTree, p string, e *diffEntry) error {
+	if e.err != nil {
+		return df.unreadable(p, e.kind, e.err)
+	}
+	item := diffItem{Change: change, Path: "/" + p, Type: kindName(e.kind)}
+	if change == "added" {
+		item.NewSize, item.NewMTime, item.SizeDelta = e.size, formatMTime(e.mtime), int64(e.size)
+	} else {
+		item.OldSize, item.OldMTime, item.SizeDelta = e.size, formatMTime(e.mtime), -int64(e.size)
+	}
+	if err := df.report(item); err != nil {
+		return err
+	}
+	if e.kind != 'd' {
+		return nil
+	}
+	return df.oneChildren(change, tree, p, e)
+}
+
+func (df *differ) compare(p string, a *diffEntry, b *diffEntry) error {
+	if a.err != nil {
+		return df.unreadable(p, a.kind, a.err)
+	}
+	if b.err != nil {
+		return df.unreadable(p, b.kind, b.err)
+	}
+	details, err := df.changes(p, a, b)
+	if err != nil && df.tolerant {
+		return df.unreadable(p, b.kind, err)
+	}
+	if err != nil {
+		return fmt.Errorf("/%s: %w", p, err)
+	}
+	if len(details) > 0 && p != "" {
+		err := df.report(diffItem{
+			Change:    "modified",
+			Path:      "/" + p,
+			Type:      kindName(b.kind),
+			OldSize:   a.size,
+			NewSize:   b.size,
+			SizeDelta: int64(b.size) - int64(a.size),
+			OldMTime:  formatMTime(a.mtime),
+			NewMTime:  formatMTime(b.mtime),
+			Details:   details,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if a.kind != 'd' || b.kind != 'd' {
+		return nil
+	}
+
+	oldChildren, err := df.old.readDir(p, a)
+	if err != nil {
+		return df.unreadable(p, a.kind, err)
+	}
+	newChildren, err := df.new.readDir(p, b)
+	if err != nil {
+		return df.unreadable(p, b.kind, err)
+	}
+	sort.Slice(oldChildren, func(i, j int) bool { return oldChildren[i].name < oldChildren[j].name })
+	sort.Slice(newChildren, func(i, j int) bool { return newChildren[i].name < newChildren[j].name })
+	i, j := 0, 0
+	for i < len(oldChildren) || j < len(newChildren) {
+		var oc, nc *diffEntry
+		switch {
+		case j >= len(newChildren) || (i < len(oldChildren) && oldChildren[i].name < newChildren[j].name):
+			oc = &oldChildren[i]
+			i++
+		case i >= len(oldChildren) || newChildren[j].name < oldChildren[i].name:
+			nc = &newChildren[j]
+			j++
+		default:
+			oc, nc = &oldChildren[i], &newChildren[j]
+			i++
+			j++
+		}
+		var name string
+		var isDir bool
+		if oc != nil {
+			name, isDir = oc.name, oc.kind == 'd'
+		} else {
+			name, isDir = nc.name, nc.kind == 'd'
+		}
+		cp := path.Join(p, name)
+		if pbscommon.IsExcluded(df.excludes, cp, isDir) {
+			continue
+		}
+		switch {
+		case nc == nil:
+			err = df.one("removed", df.old, cp, oc)
+		case oc == nil:
+			err = df.one("added", df.new, cp, nc)
+		case oc.kind != nc.kind && (oc.kind == 'd' || nc.kind == 'd'):
+			//A directory replaced by a file or the other way round, its entries are gone or new
+			if err = df.compare(cp, oc, nc); err == nil && oc.kind == 'd' {
+				err = df.oneChildren("removed", df.old, cp, oc)
+			} else if err == nil {
+				err = df.oneChildren("added", df.new, cp, nc)
+			}
+		default:
+			err = df.compare(cp, oc, nc)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (df *differ) oneChildren(change string, tree diffTree, p string, dir *diffEntry) error {
+	children, err := tree.readDir(p, dir)
+	if err != nil {
+		return df.unreadable(p, dir.kind, err)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+	for i := range children {
+		cp := path.Join(p, children[i].name)
+		if pbscommon.IsExcluded(df.excludes, cp, children[i].kind == 'd') {
+			continue
+		}
+		if err := df.one(change, tree, cp, &children[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printDiffItem(out io.Writer, item diffItem) error {
+	var err error
+	switch item.Change {
+	case "added":
+		if item.Type == "file" {
+			_, err = fmt.Fprintf(out, "A %s (%s, %d bytes)\n", item.Path, item.Type, item.NewSize)
+		} else {
+			_, err = fmt.Fprintf(out, "A %s (%s)\n", item.Path, item.Type)
+		}
+	case "removed":
+		_, err = fmt.Fprintf(out, "D %s (%s)\n", item.Path, item.Type)
+	default:
+		parts := make([]string, 0)
+		for _, d := range item.Details {
+			switch d {
+			case "size":
+				parts = append(parts, fmt.Sprintf("size %d -> %d (%+d)", item.OldSize, item.NewSize, item.SizeDelta))
+			case "mtime":
+				parts = append(parts, fmt.Sprintf("mtime %s -> %s", item.OldMTime, item.NewMTime))
+			default:
+				parts = append(parts, d)
+			}
+		}
+		_, err = fmt.Fprintf(out, "M %s %s\n", item.Path, strings.Join(parts, ", "))
+	}
+	return err
+}
+
+func cmdDiff(args []string) int {
+	var includes, excludes clientcommon.ArrayFlags
+	stdout := dataStdout()
+
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.SetOutput(os.Stderr)
+	conn := addConnectionFlags(fs)
+	fromFlag := fs.String("from", "", "Older snapshot to compare, same syntax as -snapshot (optional - the snapshot before -snapshot by default)")
+	pathFlag := fs.String("path", "/", "Only compare below this directory of the archive")
+	fs.Var(&includes, "include", "Can be specified multiple times, only report paths matching the pattern, .pxarexclude syntax relative to archive root (optional)")
+	fs.Var(&excludes, "exclude", "Can be specified multiple times, do not compare paths matching the pattern (optional)")
+	contentFlag := fs.Bool("content", false, "Compare the pxar archives instead of the catalogs: metadata, exact mtimes and file content (optional - downloads the archives)")
+	jsonFlag := fs.Bool("json", false, "Print changes as JSON (optional)")
+	fs.Parse(args)
+
+	cfg, err := conn.load()
+	if err != nil {
+		fmt.Println(err)
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	client := cfg.client()
+	snaps, err := cfg.groupSnapshots(client)
+	if err == nil && len(snaps) == 0 {
+		err = fmt.Errorf("no snapshots found for %s", cfg.BackupID)
+	}
+	var oldSnap, newSnap *pbscommon.BackupManifest
+	if err == nil {
+		newSnap, err = findSnapshot(snaps, cfg.Snapshot)
+	}
+	if err == nil && *fromFlag != "" {
+		oldSnap, err = findSnapshot(snaps, *fromFlag)
+	} else if err == nil {
+		for i := range snaps {
+			if snaps[i].BackupTime < newSnap.BackupTime {
+				oldSnap = &snaps[i]
+			}
+		}
+		if oldSnap == nil {
+			err = fmt.Errorf("%s is the first snapshot, there is nothing to compare it to", snapshotName(newSnap))
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+
+	df := &differ{
+		metadata: true,
+		content:  *contentFlag,
+		includes: parsePatterns(includes),
+		excludes: parsePatterns(excludes),
+		counts:   make(map[string]int),
+	}
+	open := func(m *pbscommon.BackupManifest) (diffTree, error) {
+		client := cfg.connect(m)
+		if *contentFlag {
+			d, err := pbscommon.OpenSnapshotArchive(client, m, cfg.Archive)
+			return &pxarTree{decoder: d}, err
+		}
+		catalog, err := openCatalog(client, m)
+		return &catalogTree{catalog: catalog, archive: catalogArchive(m, cfg.Archive)}, err
+	}
+	if df.old, err = open(oldSnap); err == nil {
+		df.new, err = open(newSnap)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+
+	p := strings.Trim(path.Clean("/"+*pathFlag), "/")
+	a, err := df.old.lookup(p)
+	if err != nil {
+		fmt.Printf("%s: %v\n", snapshotName(oldSnap), err)
+		return exitFailure
+	}
+	b, err := df.new.lookup(p)
+	if err != nil {
+		fmt.Printf("%s: %v\n", snapshotName(newSnap), err)
+		return exitFailure
+	}
+
+	fmt.Printf("Comparing %s with %s\n", snapshotName(oldSnap), snapshotName(newSnap))
+	items := make([]diffItem, 0)
+	df.emit = func(item diffItem) error {
+		if *jsonFlag {
+			items = append(items, item)
+			return nil
+		}
+		return printDiffItem(stdout, item)
+	}
+	err = df.compare(p, a, b)
+	if err == nil && *jsonFlag {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(items)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	fmt.Printf("Added %d, Removed %d, Modified %d\n", df.counts["added"], df.counts["removed"], df.counts["modified"])
+	return 0
+}
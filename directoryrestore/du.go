@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"pbscommon"
+	"sort"
+	"strings"
+)
+
+type duTotal struct {
+	size  uint64
+	files uint64
+}
+
+// Sizes of regular files summed per directory below root, directories deeper than depth are
+// counted in their ancestor at depth. Hardlinks are counted once, the catalog has no size for them
+func diskUsage(catalog *pbscommon.CatalogReader, archive string, root string, depth int) (map[string]*duTotal, error) {
+	ret := map[string]*duTotal{root: {}}
+	err := catalog.Walk(archive, root, func(p string, e *pbscommon.CatalogEntry) error {
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+		parts := strings.Split(rel, "/")
+		if e.Kind == 'd' && len(parts) <= depth {
+			if _, ok := ret[p]; !ok {
+				ret[p] = &duTotal{}
+			}
+		}
+		if e.Kind != 'f' {
+			return nil
+		}
+		for d := 0; d <= depth && d < len(parts); d++ {
+			t := ret[path.Join(append([]string{root}, parts[:d]...)...)]
+			t.size += e.Size
+			t.files++
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func humanSize(size int64) string {
+	sign := ""
+	if size < 0 {
+		sign, size = "-", -size
+	}
+	if size < 1024 {
+		return fmt.Sprintf("%s%d B", sign, size)
+	}
+	v := float64(size)
+	unit := 0
+	for v >= 1024 && unit < 5 {
+		v /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%s%.1f %s", sign, v, []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}[unit])
+}
+
+type duItem struct {
+	Path    string `json:"path"`
+	Size    uint64 `json:"size"`
+	Files   uint64 `json:"files"`
+	OldSize uint64 `json:"old_size,omitempty"`
+	Delta   int64  `json:"delta,omitempty"`
+}
+
+func cmdDu(args []string) int {
+	stdout := dataStdout()
+
+	fs := flag.NewFlagSet("du", flag.ExitOnError)
+	fs.SetOutput(os.Stderr)
+	conn := addConnectionFlags(fs)
+	pathFlag := fs.String("path", "/", "Directory inside the archive to analyze")
+	depthFlag := fs.Int("depth", 1, "Directory levels below -path to report, deeper directories are summed into their parent")
+	topFlag := fs.Int("top", 20, "Number of directories to show, 0 for all")
+	compareFlag := fs.Bool("compare", false, "Compare with -from and sort by growth (optional)")
+	fromFlag := fs.String("from", "", "Snapshot to compare with, same syntax as -snapshot (optional - the snapshot before -snapshot by default)")
+	cacheFlag := fs.String("cache-dir", defaultCacheDir(), "Directory where downloaded catalogs are kept, empty disables the cache")
+	jsonFlag := fs.Bool("json", false, "Print the directories as JSON (optional)")
+	fs.Parse(args)
+
+	cfg, err := conn.load()
+	if err != nil {
+		fmt.Println(err)
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	snaps, err := cfg.groupSnapshots(cfg.client())
+	if err == nil && len(snaps) == 0 {
+		err = fmt.Errorf("no snapshots found for %s", cfg.BackupID)
+	}
+	var snap, prev *pbscommon.BackupManifest
+	if err == nil {
+		snap, err = findSnapshot(snaps, cfg.Snapshot)
+	}
+	if err == nil && *compareFlag && *fromFlag != "" {
+		prev, err = findSnapshot(snaps, *fromFlag)
+	} else if err == nil && *compareFlag {
+		for i := range snaps {
+			if snaps[i].BackupTime < snap.BackupTime {
+				prev = &snaps[i]
+			}
+		}
+		if prev == nil {
+			err = fmt.Errorf("%s is the first snapshot, there is nothing to compare it to", snapshotName(snap))
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+
+	cache := newCatalogCache(cfg, *cacheFlag)
+	root := strings.Trim(path.Clean("/"+*pathFlag), "/")
+	usage := func(m *pbscommon.BackupManifest) (map[string]*duTotal, error) {
+		catalog, err := cache.open(cfg, m)
+		if err != nil {
+			return nil, err
+		}
+		return diskUsage(catalog, catalogArchive(m, cfg.Archive), root, *depthFlag)
+	}
+	fmt.Printf("Analyzing /%s of %s\n", root, snapshotName(snap))
+	current, err := usage(snap)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	items := make([]duItem, 0, len(current))
+	for p, t := range current {
+		items = append(items, duItem{Path: "/" + p, Size: t.size, Files: t.files})
+	}
+
+	if prev != nil {
+		fmt.Printf("Comparing with %s\n", snapshotName(prev))
+		previous, err := usage(prev)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Println(err)
+			return exitFailure
+		}
+		for i := range items {
+			if t, ok := previous[strings.TrimPrefix(items[i].Path, "/")]; ok {
+				items[i].OldSize = t.size
+			}
+			items[i].Delta = int64(items[i].Size) - int64(items[i].OldSize)
+		}
+		//Directories which are gone shrank to nothing
+		for p, t := range previous {
+			if _, ok := current[p]; !ok {
+				items = append(items, duItem{Path: "/" + p, OldSize: t.size, Delta: -int64(t.size)})
+			}
+		}
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].Delta > items[j].Delta || (items[i].Delta == items[j].Delta && items[i].Path < items[j].Path)
+		})
+	} else {
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].Size > items[j].Size || (items[i].Size == items[j].Size && items[i].Path < items[j].Path)
+		})
+	}
+	if *topFlag > 0 && len(items) > *topFlag {
+		items = items[:*topFlag]
+	}
+
+	if *jsonFlag {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(items)
+	} else {
+		for _, i := range items {
+			if prev != nil {
+				_, err = fmt.Fprintf(stdout, "%12s %12s %12s  %s\n", humanSize(int64(i.Size)), humanSize(int64(i.OldSize)), humanSize(i.Delta), i.Path)
+			} else {
+				_, err = fmt.Fprintf(stdout, "%12s %10d files  %s\n", humanSize(int64(i.Size)), i.Files, i.Path)
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	return 0
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"pbscommon"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Name of an archive entry inside the tar or zip, the exported directory itself becomes the top level
+// directory, nothing when the whole archive is exported
+func exportName(root string, p string) string {
+	if root == "" {
+		return p
+	}
+	return path.Base(root) + strings.TrimPrefix(p, root)
+}
+
+// Hardlinks can only be kept when their target is exported too, otherwise the content is copied
+func exportHardlink(d *pbscommon.PXARDecoder, root string, e *pbscommon.PXAREntry) (*pbscommon.PXAREntry, string, error) {
+	if root == "" || isBelow(e.LinkTarget, root) {
+		return e, exportName(root, e.LinkTarget), nil
+	}
+	target, err := d.ResolveHardlink(e)
+	return target, "", err
+}
+
+func tarHeader(name string, e *pbscommon.PXAREntry) *tar.Header {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(e.Mode & 0o7777),
+		Uid:     int(e.UID),
+		Gid:     int(e.GID),
+		ModTime: e.MTime,
+		Format:  tar.FormatPAX,
+	}
+	for _, x := range e.Metadata.Xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords["SCHILY.xattr."+x.Name] = string(x.Value)
+	}
+	if len(e.Metadata.FCaps) > 0 {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords["SCHILY.xattr.security.capability"] = string(e.Metadata.FCaps)
+	}
+	return hdr
+}
+
+// Writes the entries returned by d, a decoder from Subtree(root), as a POSIX tar stream.
+// Mode, ownership, mtime, symlinks, hardlinks, devices and xattrs are kept, sockets are skipped
+func writeTar(w io.Writer, d *pbscommon.PXARDecoder, root string) error {
+	tw := tar.NewWriter(w)
+	for {
+		e, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := exportName(root, e.Path)
+		if name == "" || e.Kind == 's' {
+			continue
+		}
+		hdr := tarHeader(name, e)
+		var content *io.SectionReader
+		switch e.Kind {
+		case 'd':
+			hdr.Typeflag, hdr.Name = tar.TypeDir, name+"/"
+		case 'f':
+			hdr.Typeflag, hdr.Size = tar.TypeReg, int64(e.Size)
+			content, err = d.OpenPayload(e)
+		case 'l':
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.LinkTarget
+		case 'h':
+			var target *pbscommon.PXAREntry
+			target, hdr.Linkname, err = exportHardlink(d, root, e)
+			if err == nil && hdr.Linkname == "" {
+				hdr = tarHeader(name, target)
+				hdr.Typeflag, hdr.Size = tar.TypeReg, int64(target.Size)
+				content, err = d.OpenPayload(target)
+			} else {
+				hdr.Typeflag = tar.TypeLink
+			}
+		case 'b', 'c':
+			hdr.Typeflag = tar.TypeBlock
+			if e.Kind == 'c' {
+				hdr.Typeflag = tar.TypeChar
+			}
+			hdr.Devmajor, hdr.Devminor = int64(e.DevMajor), int64(e.DevMinor)
+		case 'p':
+			hdr.Typeflag = tar.TypeFifo
+		}
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if content != nil {
+			if _, err := io.Copy(tw, content); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// Writes the entries returned by d, a decoder from Subtree(root), as a zip file.
+// Zip has no ownership, devices or fifos, those are skipped, hardlinks are stored as copies
+// and symlinks the Info-ZIP way, the target as content
+func writeZip(w io.Writer, d *pbscommon.PXARDecoder, root string) error {
+	zw := zip.NewWriter(w)
+	for {
+		e, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := exportName(root, e.Path)
+		if name == "" {
+			continue
+		}
+		if e.Kind == 'h' {
+			if e, err = d.ResolveHardlink(e); err != nil {
+				return err
+			}
+		}
+		hdr := &zip.FileHeader{Name: name, Modified: e.MTime}
+		hdr.SetMode(e.FileMode())
+		var content io.Reader
+		switch e.Kind {
+		case 'd':
+			hdr.Name += "/"
+		case 'f':
+			hdr.Method = zip.Deflate
+			if content, err = d.OpenPayload(e); err != nil {
+				return err
+			}
+		case 'l':
+			content = strings.NewReader(e.LinkTarget)
+		default:
+			continue
+		}
+		out, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if content != nil {
+			if _, err := io.Copy(out, content); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+// Format and compression implied by the output file name, tar without compression for stdout
+func exportFormat(output string) (string, string) {
+	lower := strings.ToLower(output)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip", "none"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar", "gzip"
+	case strings.HasSuffix(lower, ".tar.zst"), strings.HasSuffix(lower, ".tzst"):
+		return "tar", "zstd"
+	}
+	return "tar", "none"
+}
+
+// Compressed writer on top of w, closing it flushes the compressor but not w
+func compressWriter(w io.Writer, compress string) (io.WriteCloser, error) {
+	switch compress {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func cmdExport(args []string) int {
+	stdout := dataStdout()
+
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.SetOutput(os.Stderr)
+	conn := addConnectionFlags(fs)
+	pathFlag := fs.String("path", "/", "File or directory inside the archive to export")
+	outputFlag := fs.String("output", "-", "File to write, - for stdout")
+	formatFlag := fs.String("format", "", "tar|zip (optional - zip for a .zip output, tar otherwise)")
+	compressFlag := fs.String("compress", "", "none|gzip|zstd , compression of tar streams (optional - from the output extension .tar.gz, .tgz, .tar.zst or .tzst, none otherwise)")
+	fs.Parse(args)
+
+	cfg, err := conn.load()
+	if err != nil {
+		fmt.Println(err)
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	format, compress := exportFormat(*outputFlag)
+	if *formatFlag != "" {
+		format = *formatFlag
+	}
+	if *compressFlag != "" {
+		compress = *compressFlag
+	}
+	if format != "tar" && format != "zip" {
+		fmt.Printf("Invalid format %s\n", format)
+		return exitFailure
+	}
+	if compress != "none" && compress != "gzip" && compress != "zstd" {
+		fmt.Printf("Invalid compression %s\n", compress)
+		return exitFailure
+	}
+	if format == "zip" && compress != "none" {
+		fmt.Println("zip files are already compressed, -compress only applies to tar")
+		return exitFailure
+	}
+
+	client := cfg.client()
+	snap, err := cfg.selectSnapshot(client)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	d, err := pbscommon.OpenSnapshotArchive(cfg.connect(snap), snap, cfg.Archive)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	root := strings.Trim(path.Clean("/"+*pathFlag), "/")
+	sub, err := d.Subtree(root)
+	if err != nil {
+		fmt.Printf("/%s not found in %s of %s: %v\n", root, cfg.Archive, snapshotName(snap), err)
+		return exitFailure
+	}
+
+	out := stdout
+	if *outputFlag != "-" {
+		if out, err = os.Create(*outputFlag); err != nil {
+			fmt.Println(err)
+			return exitFailure
+		}
+	}
+	begin := time.Now()
+	fmt.Printf("Exporting /%s of %s as %s (compression %s) to %s\n", root, snapshotName(snap), format, compress, *outputFlag)
+	buf := bufio.NewWriterSize(out, 1<<20)
+	cw, err := compressWriter(buf, compress)
+	if err == nil {
+		if format == "zip" {
+			err = writeZip(cw, sub, root)
+		} else {
+			err = writeTar(cw, sub, root)
+		}
+	}
+	if err == nil {
+		err = cw.Close()
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if out != stdout {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(*outputFlag)
+		}
+	}
+	if err != nil {
+		fmt.Println("Export failed: " + err.Error())
+		return exitFailure
+	}
+	fmt.Printf("Export took %s\n", time.Since(begin))
+	return 0
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"pbscommon"
+	"strings"
+	"time"
+)
+
+func kindName(kind byte) string {
+	switch kind {
+	case 'd':
+		return "directory"
+	case 'f':
+		return "file"
+	case 'l':
+		return "symlink"
+	case 'h':
+		return "hardlink"
+	case 'b':
+		return "block device"
+	case 'c':
+		return "character device"
+	case 'p':
+		return "fifo"
+	case 's':
+		return "socket"
+	}
+	return "unknown"
+}
+
+// Writes a regular file to out, "-" for stdout, the file itself gets the mode and mtime of the entry
+func extractFile(d *pbscommon.PXARDecoder, e *pbscommon.PXAREntry, out string, stdout *os.File) error {
+	src, err := d.OpenPayload(e)
+	if err != nil {
+		return err
+	}
+	if out == "-" {
+		_, err = io.Copy(stdout, src)
+		return err
+	}
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(out, fileMode(e.Mode)); err != nil {
+		return err
+	}
+	return os.Chtimes(out, e.MTime, e.MTime)
+}
+
+func cmdExtract(args []string) int {
+	stdout := dataStdout()
+
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	fs.SetOutput(os.Stderr)
+	conn := addConnectionFlags(fs)
+	pathFlag := fs.String("path", "", "Path of the file or directory inside the archive, example: /home/user/report.txt")
+	outputFlag := fs.String("output", "-", "Where to write a file, - for stdout")
+	targetFlag := fs.String("target", "", "Directory to extract a directory to, created if missing (mandatory when -path is a directory)")
+	onConflictFlag := fs.String("on-conflict", "skip", "overwrite|skip|newer , what to do with files already existing in target")
+	noOwnerFlag := fs.Bool("no-owner", false, "Do not restore ownership, by default it is restored when running as root (optional)")
+	fs.Parse(args)
+
+	cfg, err := conn.load()
+	if err != nil || *pathFlag == "" {
+		if err != nil {
+			fmt.Println(err)
+		}
+		fmt.Println("-path is mandatory")
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	if *onConflictFlag != "overwrite" && *onConflictFlag != "skip" && *onConflictFlag != "newer" {
+		fmt.Printf("Invalid conflict policy %s\n", *onConflictFlag)
+		return exitFailure
+	}
+	client := cfg.client()
+	snap, err := cfg.selectSnapshot(client)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	return runExtract(cfg, snap, *pathFlag, &extractOptions{
+		output:     *outputFlag,
+		target:     *targetFlag,
+		onConflict: *onConflictFlag,
+		noOwner:    *noOwnerFlag,
+		stdout:     stdout,
+	})
+}
+
+type extractOptions struct {
+	output     string //Files only, "-" for stdout
+	target     string //Directories only
+	onConflict string
+	noOwner    bool
+	stdout     *os.File
+}
+
+// Extracts path p of the configured archive of snapshot snap, returns the exit code
+func runExtract(cfg *Config, snap *pbscommon.BackupManifest, p string, opts *extractOptions) int {
+	p = strings.Trim(p, "/")
+	client := cfg.connect(snap)
+
+	//The catalog is small compared to the archive and tells whether the path exists before any archive chunk is read
+	catalog, err := openCatalog(client, snap)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	ce, err := catalog.Lookup(catalogArchive(snap, cfg.Archive), p)
+	if err != nil {
+		fmt.Printf("/%s not found in %s of %s: %v\n", p, cfg.Archive, snapshotName(snap), err)
+		return exitFailure
+	}
+	if ce.Kind != 'd' && ce.Kind != 'f' && ce.Kind != 'h' {
+		fmt.Printf("/%s is a %s, only files and directories can be extracted\n", p, kindName(ce.Kind))
+		return exitFailure
+	}
+	if ce.Kind == 'd' && opts.target == "" {
+		fmt.Printf("/%s is a directory, -target is mandatory\n", p)
+		return exitFailure
+	}
+
+	d, err := pbscommon.OpenSnapshotArchive(client, snap, cfg.Archive)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	begin := time.Now()
+
+	if ce.Kind == 'd' {
+		sub, err := d.Subtree(p)
+		if err != nil {
+			fmt.Println(err)
+			return exitFailure
+		}
+		fmt.Printf("Extracting directory /%s from %s to %s\n", p, snapshotName(snap), opts.target)
+		report, err := restoreArchive(sub, &RestoreOptions{
+			Target:     opts.target,
+			Root:       p,
+			OnConflict: opts.onConflict,
+			NoOwner:    opts.noOwner,
+		})
+		fmt.Printf("Restored %d, Skipped %d, Failed %d, Warnings %d, extraction took %s.\n", report.Restored, report.Skipped, len(report.Failed), len(report.Warnings), time.Since(begin))
+		if err != nil {
+			fmt.Println("Extraction aborted: " + err.Error())
+			return exitFailure
+		}
+		if len(report.Failed) > 0 || len(report.Warnings) > 0 {
+			return exitWarnings
+		}
+		return 0
+	}
+
+	e, err := d.Lookup(p)
+	if err == nil {
+		e, err = d.ResolveHardlink(e)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	fmt.Printf("Extracting /%s from %s: %d bytes, modified %s\n", p, snapshotName(snap), e.Size, e.MTime.Format(time.RFC3339))
+	if err := extractFile(d, e, opts.output, opts.stdout); err != nil {
+		fmt.Printf("Extraction failed: %v\n", err)
+		return exitFailure
+	}
+	fmt.Printf("Extracted %d bytes in %s\n", e.Size, time.Since(begin))
+	return 0
+}
@@ -0,0 +1,5 @@
+module directoryrestore
+
+go 1.24.4
+
+require github.com/klauspost/compress v1.18.0
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"pbscommon"
+	"strings"
+	"time"
+)
+
+// Catalogs never change once a snapshot is finished, so they are kept as files named after the snapshot.
+// An empty dir disables the cache, catalogs are then read lazily chunk by chunk
+type catalogCache struct {
+	dir string
+}
+
+func newCatalogCache(cfg *Config, dir string) *catalogCache {
+	if dir == "" {
+		return &catalogCache{}
+	}
+	server := cfg.BaseURL
+	if u, err := url.Parse(cfg.BaseURL); err == nil && u.Host != "" {
+		server = u.Host
+	}
+	parts := []string{dir, server, cfg.Datastore}
+	if cfg.Namespace != "" {
+		parts = append(parts, cfg.Namespace)
+	}
+	for i := 1; i < len(parts); i++ {
+		parts[i] = strings.NewReplacer("/", "_", ":", "_", "\\", "_").Replace(parts[i])
+	}
+	return &catalogCache{dir: filepath.Join(parts...)}
+}
+
+func defaultCacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "directoryrestore", "catalogs")
+	}
+	return ""
+}
+
+func (c *catalogCache) file(m *pbscommon.BackupManifest) string {
+	return filepath.Join(c.dir, m.BackupType, m.BackupID, fmt.Sprintf("%d.pcat1", m.BackupTime))
+}
+
+func (c *catalogCache) open(cfg *Config, m *pbscommon.BackupManifest) (*pbscommon.CatalogReader, error) {
+	if c.dir != "" {
+		if data, err := os.ReadFile(c.file(m)); err == nil {
+			return pbscommon.NewCatalogReader(bytes.NewReader(data), uint64(len(data)))
+		}
+	}
+	if !m.HasFile("catalog.pcat1.didx") {
+		return nil, fmt.Errorf("snapshot %s has no catalog", snapshotName(m))
+	}
+	r, err := pbscommon.OpenDynamicIndexReader(cfg.connect(m), "catalog.pcat1.didx")
+	if err != nil {
+		return nil, err
+	}
+	if c.dir == "" {
+		return pbscommon.NewCatalogReader(r, uint64(r.Size()))
+	}
+
+	data := make([]byte, r.Size())
+	if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.file(m)), 0o700); err == nil {
+		//Written under a temporary name first, an interrupted run must not leave a truncated catalog behind
+		tmp := c.file(m) + ".tmp"
+		if err := os.WriteFile(tmp, data, 0o600); err == nil {
+			os.Rename(tmp, c.file(m))
+		}
+	}
+	return pbscommon.NewCatalogReader(bytes.NewReader(data), uint64(len(data)))
+}
+
+// Drops cached catalogs of snapshots of the group which do not exist anymore
+func (c *catalogCache) prune(snaps []pbscommon.BackupManifest) {
+	if c.dir == "" || len(snaps) == 0 {
+		return
+	}
+	keep := make(map[string]bool)
+	for i := range snaps {
+		keep[c.file(&snaps[i])] = true
+	}
+	files, _ := filepath.Glob(filepath.Join(c.dir, snaps[0].BackupType, snaps[0].BackupID, "*.pcat1"))
+	for _, f := range files {
+		if !keep[f] {
+			os.Remove(f)
+		}
+	}
+}
+
+// What a snapshot holds at the path, Kind 0 when the path does not exist
+type versionState struct {
+	Kind  byte
+	Size  uint64
+	MTime int64
+	Error string
+}
+
+func (s versionState) String() string {
+	switch {
+	case s.Error != "":
+		return "unavailable: " + s.Error
+	case s.Kind == 0:
+		return "missing"
+	case s.Kind == 'f':
+		return fmt.Sprintf("file, %d bytes, modified %s", s.Size, time.Unix(s.MTime, 0).UTC().Format(time.RFC3339))
+	}
+	return kindName(s.Kind)
+}
+
+// Consecutive snapshots holding the same version of the path
+type historyRun struct {
+	state versionState
+	first *pbscommon.BackupManifest
+	last  *pbscommon.BackupManifest
+	count int
+}
+
+type historyItem struct {
+	Version   int    `json:"version,omitempty"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Snapshots int    `json:"snapshots"`
+	Type      string `json:"type,omitempty"`
+	Size      uint64 `json:"size,omitempty"`
+	MTime     string `json:"mtime,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func fileHistory(cfg *Config, cache *catalogCache, snaps []pbscommon.BackupManifest, p string) []historyRun {
+	runs := make([]historyRun, 0)
+	for i := range snaps {
+		m := &snaps[i]
+		state := versionState{}
+		catalog, err := cache.open(cfg, m)
+		if err == nil {
+			var e *pbscommon.CatalogEntry
+			e, err = catalog.Lookup(catalogArchive(m, cfg.Archive), p)
+			if err == nil {
+				state = versionState{Kind: e.Kind, Size: e.Size, MTime: e.MTime}
+			}
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			state.Error = err.Error()
+		}
+		if n := len(runs); n > 0 && runs[n-1].state == state {
+			runs[n-1].last = m
+			runs[n-1].count++
+			continue
+		}
+		runs = append(runs, historyRun{state: state, first: m, last: m, count: 1})
+	}
+	return runs
+}
+
+func cmdHistory(args []string) int {
+	stdout := dataStdout()
+
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	fs.SetOutput(os.Stderr)
+	conn := addConnectionFlags(fs)
+	pathFlag := fs.String("path", "", "Path inside the archive, example: /home/user/report.txt")
+	jsonFlag := fs.Bool("json", false, "Print the timeline as JSON (optional)")
+	extractFlag := fs.Int("extract", 0, "Extract this version number of the timeline (optional)")
+	outputFlag := fs.String("output", "-", "Where -extract writes a file, - for stdout")
+	targetFlag := fs.String("target", "", "Where -extract writes a directory")
+	cacheFlag := fs.String("cache-dir", defaultCacheDir(), "Directory where downloaded catalogs are kept, empty disables the cache")
+	fs.Parse(args)
+
+	cfg, err := conn.load()
+	if err != nil || *pathFlag == "" {
+		if err != nil {
+			fmt.Println(err)
+		}
+		fmt.Println("-path is mandatory")
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	p := strings.Trim(path.Clean("/"+*pathFlag), "/")
+
+	snaps, err := cfg.groupSnapshots(cfg.client())
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	if len(snaps) == 0 {
+		fmt.Printf("no snapshots found for %s\n", cfg.BackupID)
+		return exitFailure
+	}
+	cache := newCatalogCache(cfg, *cacheFlag)
+	cache.prune(snaps)
+	runs := fileHistory(cfg, cache, snaps, p)
+
+	//Only runs where the path exists get a version number, -extract refers to it
+	items := make([]historyItem, len(runs))
+	version := 0
+	var selected *historyRun
+	for i, r := range runs {
+		items[i] = historyItem{
+			From:      time.Unix(r.first.BackupTime, 0).UTC().Format(time.RFC3339),
+			To:        time.Unix(r.last.BackupTime, 0).UTC().Format(time.RFC3339),
+			Snapshots: r.count,
+			Error:     r.state.Error,
+		}
+		if r.state.Kind != 0 {
+			version++
+			items[i].Version = version
+			items[i].Type = kindName(r.state.Kind)
+			if r.state.Kind == 'f' {
+				items[i].Size = r.state.Size
+				items[i].MTime = time.Unix(r.state.MTime, 0).UTC().Format(time.RFC3339)
+			}
+			if version == *extractFlag {
+				selected = &runs[i]
+			}
+		}
+	}
+
+	//When extracting, stdout may carry the file, the timeline then goes to stderr
+	out := stdout
+	if *extractFlag != 0 {
+		out = os.Stdout
+	}
+	if *jsonFlag {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(items)
+	} else {
+		fmt.Fprintf(out, "History of /%s in %s/%s\n", p, snaps[0].BackupType, snaps[0].BackupID)
+		for i, r := range runs {
+			v := "-"
+			if items[i].Version != 0 {
+				v = fmt.Sprintf("%d", items[i].Version)
+			}
+			if _, err = fmt.Fprintf(out, "%4s  %s .. %s  %4d snapshot(s)  %s\n", v, items[i].From, items[i].To, r.count, r.state); err != nil {
+				break
+			}
+		}
+		if version > 0 && *extractFlag == 0 {
+			fmt.Println("Run again with -extract <version> to extract one of them")
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+
+	if *extractFlag == 0 {
+		return 0
+	}
+	if selected == nil {
+		fmt.Printf("Version %d does not exist, there are %d versions\n", *extractFlag, version)
+		return exitFailure
+	}
+	//Every snapshot of the run holds the same version
+	return runExtract(cfg, selected.last, p, &extractOptions{
+		output:     *outputFlag,
+		target:     *targetFlag,
+		onConflict: "skip",
+		stdout:     stdout,
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Exit codes, 3 mirrors the backup client: the command finished but some entries had problems.
+// 2 is returned by compare when the directory does not match the snapshot
+const (
+	exitFailure     = 1
+	exitDifferences = 2
+	exitWarnings    = 3
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands = []command{
+	{"restore", "Restore a directory archive of a snapshot to a local directory", cmdRestore},
+	{"extract", "Extract a single file to stdout or a path, or one directory to a local directory", cmdExtract},
+	{"ls", "List a directory of a snapshot from its catalog", cmdLs},
+	{"find", "Search a snapshot catalog by name, regex, type, size or mtime", cmdFind},
+	{"history", "Show the versions of a path across the snapshots of the backup group", cmdHistory},
+	{"diff", "Show added, removed and modified entries between two snapshots", cmdDiff},
+	{"du", "Show the largest directories of a snapshot, or the ones which grew the most", cmdDu},
+	{"compare", "Check that a local directory matches a snapshot", cmdCompare},
+	{"export", "Write a directory or file of a snapshot as a tar, optionally compressed, or zip stream", cmdExport},
+	{"serve", "Browse and download a snapshot over HTTP and WebDAV", cmdServe},
+	{"pxar", "List, dump, extract, create and verify local pxar archive files, no server needed", cmdPxar},
+}
+
+// For commands writing data or JSON to stdout, messages, including the ones printed by pbscommon,
+// are sent to stderr from then on and the real stdout is returned
+func dataStdout() *os.File {
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	return stdout
+}
+
+func usage() {
+	fmt.Printf("Usage: %s <command> [options]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Printf("  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Printf("\nRun %s <command> -help for the options of a command\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitFailure)
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			os.Exit(c.run(os.Args[2:]))
+		}
+	}
+	usage()
+	os.Exit(exitFailure)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"clientcommon"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"pbscommon"
+	"strings"
+	"time"
+)
+
+// Actions of the pxar command, they only work on local files, like the debug copies written by -pxarout
+var pxarCommands = []command{
+	{"list", "List the entries of an archive", cmdPxarList},
+	{"dump", "Print every record of an archive with its offset, including goodbye tables", cmdPxarDump},
+	{"extract", "Extract an archive, or a file or directory of it", cmdPxarExtract},
+	{"create", "Write a directory as archive, with catalog on request", cmdPxarCreate},
+	{"verify", "Check the structure of an archive: record sizes, goodbye tables, hardlinks and payload references", cmdPxarVerify},
+}
+
+func pxarUsage() {
+	fmt.Printf("Usage: %s pxar <action> [options] <archive>\n\nActions:\n", os.Args[0])
+	for _, c := range pxarCommands {
+		fmt.Printf("  %-10s %s\n", c.name, c.usage)
+	}
+	fmt.Printf("\nSplit archives are read from the metadata archive, the payload archive is found by the .ppxar suffix\n")
+}
+
+func cmdPxar(args []string) int {
+	if len(args) > 0 {
+		for _, c := range pxarCommands {
+			if c.name == args[0] {
+				return c.run(args[1:])
+			}
+		}
+	}
+	pxarUsage()
+	return exitFailure
+}
+
+// Options after the archive name are accepted too
+func parsePxarFlags(fs *flag.FlagSet, args []string) string {
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return ""
+	}
+	name := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	if fs.NArg() > 0 {
+		return ""
+	}
+	return name
+}
+
+// Plain archive, or metadata archive of a split one with the payload archive next to it as
+// written by -pxarout, unless payload names it
+func openLocalPxar(name string, payload string) (*pbscommon.PXARDecoder, func(), error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if payload == "" {
+		if _, err := os.Stat(name + ".ppxar"); err == nil {
+			payload = name + ".ppxar"
+		}
+	}
+	if payload == "" {
+		return pbscommon.NewPXARDecoder(f, uint64(info.Size())), func() { f.Close() }, nil
+	}
+	p, err := os.Open(payload)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return pbscommon.NewSplitPXARDecoder(f, uint64(info.Size()), p), func() { f.Close(); p.Close() }, nil
+}
+
+func pxarFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("pxar "+name, flag.ExitOnError)
+	fs.SetOutput(os.Stderr)
+	payloadFlag := fs.String("payload", "", "Payload archive of a split archive (optional - <archive>.ppxar when it exists)")
+	return fs, payloadFlag
+}
+
+func cmdPxarList(args []string) int {
+	stdout := dataStdout()
+
+	fs, payloadFlag := pxarFlags("list")
+	pathFlag := fs.String("path", "/", "Directory inside the archive to list, with everything below it")
+	name := parsePxarFlags(fs, args)
+	if name == "" {
+		fmt.Println("Archive file is mandatory")
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	d, closer, err := openLocalPxar(name, *payloadFlag)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	defer closer()
+	if d, err = d.Subtree(strings.Trim(path.Clean("/"+*pathFlag), "/")); err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+
+	out := bufio.NewWriter(stdout)
+	for {
+		e, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Flush()
+			fmt.Println(err)
+			return exitFailure
+		}
+		target := ""
+		switch e.Kind {
+		case 'l':
+			target = " -> " + e.LinkTarget
+		case 'h':
+			target = " link to /" + e.LinkTarget
+		}
+		if e.Kind == 'h' {
+			fmt.Fprintf(out, "%-10s %11s %14s %-20s /%s%s\n", "hardlink", "-", "-", "-", e.Path, target)
+			continue
+		}
+		fmt.Fprintf(out, "%-10s %5d/%-5d %14d %-20s /%s%s\n", e.FileMode(), e.UID, e.GID, e.Size, e.MTime.UTC().Format(time.RFC3339), e.Path, target)
+	}
+	if err := out.Flush(); err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	return 0
+}
+
+func cmdPxarDump(args []string) int {
+	stdout := dataStdout()
+
+	fs, payloadFlag := pxarFlags("dump")
+	goodbyeFlag := fs.Bool("goodbye", false, "Print the items of goodbye tables too (optional)")
+	name := parsePxarFlags(fs, args)
+	if name == "" {
+		fmt.Println("Archive file is mandatory")
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	d, closer, err := openLocalPxar(name, *payloadFlag)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	defer closer()
+
+	out := bufio.NewWriter(stdout)
+	problems := 0
+	err = d.Walk(func(item *pbscommon.PXARItem) error {
+		indent := strings.Repeat("  ", item.Depth)
+		fmt.Fprintf(out, "%12d %8d %s%-14s %s\n", item.Offset, item.Size, indent, pbscommon.PXARTypeName(item.Type), item.Value)
+		if *goodbyeFlag {
+			for i, gi := range item.Goodbye {
+				fmt.Fprintf(out, "%12s %8s %s  [%d] hash %016x offset %d len %d\n", "", "", indent, i, gi.Hash, gi.Offset, gi.Len)
+			}
+		}
+		for _, p := range item.Problems {
+			fmt.Fprintf(out, "%12s %8s %s  ERROR: %s\n", "", "", indent, p)
+		}
+		problems += len(item.Problems)
+		return nil
+	})
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	if problems > 0 {
+		fmt.Printf("%d problems found\n", problems)
+		return exitFailure
+	}
+	return 0
+}
+
+func cmdPxarVerify(args []string) int {
+	fs, payloadFlag := pxarFlags("verify")
+	name := parsePxarFlags(fs, args)
+	if name == "" {
+		fmt.Println("Archive file is mandatory")
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	d, closer, err := openLocalPxar(name, *payloadFlag)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	defer closer()
+
+	problems, err := d.Verify()
+	for _, p := range problems {
+		fmt.Println("Problem: " + p)
+	}
+	if err != nil {
+		fmt.Println("Verification aborted: " + err.Error())
+		return exitFailure
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%s: %d problems found\n", name, len(problems))
+		return exitFailure
+	}
+	fmt.Printf("%s: OK\n", name)
+	return 0
+}
+
+func cmdPxarExtract(args []string) int {
+	stdout := dataStdout()
+
+	fs, payloadFlag := pxarFlags("extract")
+	pathFlag := fs.String("path", "/", "File or directory inside the archive to extract")
+	targetFlag := fs.String("target", "", "Directory to extract a directory to, created if missing (mandatory when -path is a directory)")
+	outputFlag := fs.String("output", "-", "Where to write a file, - for stdout")
+	onConflictFlag := fs.String("on-conflict", "skip", "overwrite|skip|newer , what to do with files already existing in target")
+	noOwnerFlag := fs.Bool("no-owner", false, "Do not restore ownership, by default it is restored when running as root (optional)")
+	name := parsePxarFlags(fs, args)
+	if name == "" {
+		fmt.Println("Archive file is mandatory")
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	if *onConflictFlag != "overwrite" && *onConflictFlag != "skip" && *onConflictFlag != "newer" {
+		fmt.Printf("Invalid conflict policy %s\n", *onConflictFlag)
+		return exitFailure
+	}
+	d, closer, err := openLocalPxar(name, *payloadFlag)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	defer closer()
+
+	p := strings.Trim(path.Clean("/"+*pathFlag), "/")
+	e, err := d.Lookup(p)
+	if err == nil {
+		e, err = d.ResolveHardlink(e)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	begin := time.Now()
+	switch e.Kind {
+	case 'd':
+		if *targetFlag == "" {
+			fmt.Printf("/%s is a directory, -target is mandatory\n", p)
+			return exitFailure
+		}
+		sub, err := d.Subtree(p)
+		if err != nil {
+			fmt.Println(err)
+			return exitFailure
+		}
+		fmt.Printf("Extracting /%s of %s to %s\n", p, name, *targetFlag)
+		report, err := restoreArchive(sub, &RestoreOptions{
+			Target:     *targetFlag,
+			Root:       p,
+			OnConflict: *onConflictFlag,
+			NoOwner:    *noOwnerFlag,
+		})
+		fmt.Printf("Restored %d, Skipped %d, Failed %d, Warnings %d, extraction took %s.\n", report.Restored, report.Skipped, len(report.Failed), len(report.Warnings), time.Since(begin))
+		if err != nil {
+			fmt.Println("Extraction aborted: " + err.Error())
+			return exitFailure
+		}
+		if len(report.Failed) > 0 || len(report.Warnings) > 0 {
+			return exitWarnings
+		}
+	case 'f':
+		if err := extractFile(d, e, *outputFlag, stdout); err != nil {
+			fmt.Printf("Extraction failed: %v\n", err)
+			return exitFailure
+		}
+		fmt.Printf("Extracted %d bytes in %s\n", e.Size, time.Since(begin))
+	default:
+		fmt.Printf("/%s is a %s, only files and directories can be extracted\n", p, kindName(e.Kind))
+		return exitFailure
+	}
+	return 0
+}
+
+// Output file written through a buffer, write errors are kept for Close
+type pxarOutput struct {
+	f   *os.File
+	w   *bufio.Writer
+	err error
+}
+
+func createPxarOutput(name string) (*pxarOutput, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &pxarOutput{f: f, w: bufio.NewWriterSize(f, 1<<20)}, nil
+}
+
+func (o *pxarOutput) write(b []byte) {
+	if o.err == nil {
+		_, o.err = o.w.Write(b)
+	}
+}
+
+func (o *pxarOutput) Close() error {
+	if o.err == nil {
+		o.err = o.w.Flush()
+	}
+	if err := o.f.Close(); o.err == nil {
+		o.err = err
+	}
+	return o.err
+}
+
+func cmdPxarCreate(args []string) int {
+	var excludes clientcommon.ArrayFlags
+	fs := flag.NewFlagSet("pxar create", flag.ExitOnError)
+	fs.SetOutput(os.Stderr)
+	sourceFlag := fs.String("source", "", "Directory to archive")
+	splitFlag := fs.Bool("split", false, "Write a split archive, the payload goes to <archive>.ppxar (optional)")
+	catalogFlag := fs.String("catalog", "", "Also write the catalog to this file (optional)")
+	fs.Var(&excludes, "exclude", "Can be specified multiple times, .pxarexclude syntax relative to the source directory (optional)")
+	oneFileSystemFlag := fs.Bool("one-file-system", false, "Do not descend into mount points (optional)")
+	name := parsePxarFlags(fs, args)
+	if name == "" || *sourceFlag == "" {
+		fmt.Println("-source and the archive file are mandatory")
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	info, err := os.Stat(*sourceFlag)
+	if err != nil || !info.IsDir() {
+		fmt.Printf("%s is not a directory\n", *sourceFlag)
+		return exitFailure
+	}
+
+	base := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	archive := &pbscommon.PXARArchive{
+		ArchiveName:     base + ".pxar.didx",
+		ExcludePatterns: parsePatterns(excludes),
+		OneFileSystem:   *oneFileSystemFlag,
+	}
+	outputs := make([]*pxarOutput, 0)
+	create := func(name string) *pxarOutput {
+		o, cerr := createPxarOutput(name)
+		if cerr != nil {
+			err = cerr
+			return nil
+		}
+		outputs = append(outputs, o)
+		return o
+	}
+	if out := create(name); out != nil {
+		archive.WriteCB = out.write
+	}
+	if *splitFlag && err == nil {
+		archive.ArchiveName = base + ".mpxar.didx"
+		if payload := create(name + ".ppxar"); payload != nil {
+			archive.PayloadWriteCB = payload.write
+		}
+	}
+	archive.CatalogWriteCB = func([]byte) {}
+	if *catalogFlag != "" && err == nil {
+		if catalog := create(*catalogFlag); catalog != nil {
+			archive.CatalogWriteCB = catalog.write
+		}
+	}
+
+	begin := time.Now()
+	if err == nil {
+		fmt.Printf("Archiving %s to %s\n", *sourceFlag, name)
+		archive.WriteDir(*sourceFlag, "", true)
+	}
+	for _, o := range outputs {
+		if cerr := o.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		for _, o := range outputs {
+			os.Remove(o.f.Name())
+		}
+		fmt.Println("Archive creation failed: " + err.Error())
+		return exitFailure
+	}
+	fmt.Printf("Excluded %d, Warnings %d, archiving took %s.\n", archive.Excluded, len(archive.Warnings), time.Since(begin))
+	if len(archive.Warnings) > 0 {
+		return exitWarnings
+	}
+	return 0
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"clientcommon"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"pbscommon"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RestoreOptions struct {
+	Target string
+	//Directory of the archive restored as Target, "" for the whole archive
+	Root string
+	//With includes only matching paths and their content are restored, excludes win over includes
+	Includes []pbscommon.ExcludePattern
+	Excludes []pbscommon.ExcludePattern
+	//What to do with paths already existing in target: overwrite, skip or newer (overwrite older files only)
+	OnConflict string
+	UIDMap     map[uint32]uint32
+	GIDMap     map[uint32]uint32
+	//Ownership is only restored when running as root, NoOwner disables it altogether
+	NoOwner bool
+}
+
+type RestoreReport struct {
+	Restored uint64
+	Skipped  uint64
+	Failed   []string //Entries which could not be restored
+	Warnings []string //Entries restored without some of their metadata
+}
+
+type restoreDir struct {
+	dest  string
+	entry *pbscommon.PXAREntry
+}
+
+type restorer struct {
+	opts    *RestoreOptions
+	decoder *pbscommon.PXARDecoder
+	report  *RestoreReport
+	chown   bool
+	//Subtrees left out, either excluded or their directory could not be restored
+	skipped []string
+	//Directory metadata is applied once their content is written, otherwise mtimes would change again
+	dirs []restoreDir
+}
+
+func (r *restorer) fail(e *pbscommon.PXAREntry, format string, args ...any) {
+	msg := "/" + e.Path + ": " + fmt.Sprintf(format, args...)
+	fmt.Println("Failed: " + msg)
+	r.report.Failed = append(r.report.Failed, msg)
+	if e.Kind == 'd' {
+		r.skipped = append(r.skipped, e.Path)
+	}
+}
+
+func (r *restorer) warn(e *pbscommon.PXAREntry, format string, args ...any) {
+	msg := "/" + e.Path + ": " + fmt.Sprintf(format, args...)
+	fmt.Println("Warning: " + msg)
+	r.report.Warnings = append(r.report.Warnings, msg)
+}
+
+func isBelow(path string, dir string) bool {
+	return dir == "" || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+func (r *restorer) selected(e *pbscommon.PXAREntry) bool {
+	for _, s := range r.skipped {
+		if isBelow(e.Path, s) {
+			return false
+		}
+	}
+	if e.Path == r.opts.Root {
+		return true
+	}
+	isDir := e.Kind == 'd'
+	if pbscommon.IsExcluded(r.opts.Excludes, e.Path, isDir) {
+		if isDir {
+			r.skipped = append(r.skipped, e.Path)
+		}
+		return false
+	}
+	return isIncluded(r.opts.Includes, e.Path, isDir)
+}
+
+// Without includes everything is, otherwise when the path itself or one of its parent directories matches
+func isIncluded(includes []pbscommon.ExcludePattern, path string, isDir bool) bool {
+	if len(includes) == 0 {
+		return true
+	}
+	for p := path; p != ""; {
+		for i := range includes {
+			if includes[i].Match(p, p != path || isDir) && !includes[i].Negate {
+				return true
+			}
+		}
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+	}
+	return false
+}
+
+// Names come from the archive, anything which could escape the target directory is refused
+func (r *restorer) dest(e *pbscommon.PXAREntry) (string, error) {
+	if e.Path == r.opts.Root {
+		return r.opts.Target, nil
+	}
+	if !isBelow(e.Path, r.opts.Root) {
+		return "", fmt.Errorf("outside of restored directory /%s", r.opts.Root)
+	}
+	if e.Name == "" || e.Name == "." || e.Name == ".." || strings.ContainsAny(e.Name, "/"+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid file name %q", e.Name)
+	}
+	//Parents of hardlink targets come from the path stored in the hardlink, not from the walk
+	for _, name := range strings.Split(e.Path, "/") {
+		if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+			return "", fmt.Errorf("invalid path %q", e.Path)
+		}
+	}
+	rel := e.Path
+	if r.opts.Root != "" {
+		rel = strings.TrimPrefix(e.Path, r.opts.Root+"/")
+	}
+	return filepath.Join(r.opts.Target, filepath.FromSlash(rel)), nil
+}
+
+// Whether path, once cleaned, is the target directory or below it
+func (r *restorer) insideTarget(path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(r.opts.Target), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// Checks the directories between the target and path, which is below it. A symlink among them, restored
+// earlier from the archive or already in the target, would send the write outside the target, so it is refused.
+// With create missing directories are made, as they are when only some paths are included
+func (r *restorer) checkParents(path string, create bool) error {
+	target := filepath.Clean(r.opts.Target)
+	rel, err := filepath.Rel(target, filepath.Clean(path))
+	if err != nil || !r.insideTarget(path) {
+		return fmt.Errorf("%s is outside of the target directory", path)
+	}
+	if rel == "." {
+		return nil
+	}
+	names := strings.Split(rel, string(filepath.Separator))
+	dir := target
+	for _, name := range names[:len(names)-1] {
+		dir = filepath.Join(dir, name)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) && create {
+			if err := os.Mkdir(dir, 0o755); err != nil && !os.IsExist(err) {
+				return err
+			}
+			if info, err = os.Lstat(dir); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("parent %s is a symlink", dir)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("parent %s is not a directory", dir)
+		}
+	}
+	return nil
+}
+
+func fileMode(mode uint64) os.FileMode {
+	ret := os.FileMode(mode & 0o777)
+	if mode&pbscommon.ISUID != 0 {
+		ret |= os.ModeSetuid
+	}
+	if mode&pbscommon.ISGID != 0 {
+		ret |= os.ModeSetgid
+	}
+	if mode&pbscommon.ISVTX != 0 {
+		ret |= os.ModeSticky
+	}
+	return ret
+}
+
+func (r *restorer) mapOwner(e *pbscommon.PXAREntry) (int, int) {
+	uid, gid := e.UID, e.GID
+	if v, ok := r.opts.UIDMap[uid]; ok {
+		uid = v
+	}
+	if v, ok := r.opts.GIDMap[gid]; ok {
+		gid = v
+	}
+	return int(uid), int(gid)
+}
+
+// Order matters: chown clears setuid bits and file capabilities, setting ACLs changes the mode group bits
+func (r *restorer) applyMetadata(dest string, e *pbscommon.PXAREntry) {
+	if r.chown {
+		uid, gid := r.mapOwner(e)
+		if err := os.Lchown(dest, uid, gid); err != nil {
+			r.warn(e, "cannot set owner: %v", err)
+		}
+	}
+	if e.Kind == 'l' {
+		//Symlinks have no permissions of their own and chmod or chtimes would change the target
+		if err := pbscommon.RestoreMetadata(dest, e); err != nil {
+			r.warn(e, "cannot restore xattrs: %v", err)
+		}
+		return
+	}
+	if err := os.Chmod(dest, fileMode(e.Mode)); err != nil {
+		r.warn(e, "cannot set permissions: %v", err)
+	}
+	if err := pbscommon.RestoreMetadata(dest, e); err != nil {
+		r.warn(e, "cannot restore xattrs or ACLs: %v", err)
+	}
+	if err := os.Chtimes(dest, e.MTime, e.MTime); err != nil {
+		r.warn(e, "cannot set mtime: %v", err)
+	}
+}
+
+func (r *restorer) writeFile(dest string, e *pbscommon.PXAREntry) error {
+	src, err := r.decoder.OpenPayload(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Hardlinks point to an entry earlier in the archive, if it was not restored the content is written instead
+func (r *restorer) writeHardlink(dest string, e *pbscommon.PXAREntry) error {
+	target, err := r.decoder.ResolveHardlink(e)
+	if err != nil {
+		return err
+	}
+	//The target has to be the regular file restored earlier, not something a symlink leads to
+	if targetDest, err := r.dest(target); err == nil && r.checkParents(targetDest, false) == nil {
+		if info, err := os.Lstat(targetDest); err == nil && info.Mode().IsRegular() {
+			if err := os.Link(targetDest, dest); err == nil {
+				return nil
+			}
+		}
+	}
+	if err := r.writeFile(dest, target); err != nil {
+		return err
+	}
+	r.applyMetadata(dest, target)
+	return nil
+}
+
+// Returns false when the entry has to be left alone because of the conflict policy
+func (r *restorer) resolveConflict(dest string, e *pbscommon.PXAREntry) (bool, error) {
+	existing, err := os.Lstat(dest)
+	if err != nil {
+		return true, nil
+	}
+	if e.Kind == 'd' && existing.IsDir() {
+		return true, nil
+	}
+	switch r.opts.OnConflict {
+	case "skip":
+		return false, nil
+	case "newer":
+		if !e.MTime.After(existing.ModTime()) {
+			return false, nil
+		}
+	}
+	return true, os.Remove(dest)
+}
+
+func (r *restorer) restoreEntry(e *pbscommon.PXAREntry) {
+	dest, err := r.dest(e)
+	if err != nil {
+		r.fail(e, "%v", err)
+		return
+	}
+	if e.Path == r.opts.Root {
+		if err := os.MkdirAll(dest, 0o700); err != nil {
+			r.fail(e, "%v", err)
+			return
+		}
+		if len(r.opts.Includes) == 0 {
+			r.dirs = append(r.dirs, restoreDir{dest: dest, entry: e})
+		}
+		return
+	}
+
+	//Parents are missing when only some paths are included
+	if err := r.checkParents(dest, true); err != nil {
+		r.fail(e, "%v", err)
+		return
+	}
+	write, err := r.resolveConflict(dest, e)
+	if err != nil {
+		r.fail(e, "cannot replace existing file: %v", err)
+		return
+	}
+	if !write {
+		fmt.Printf("Skipping existing /%s\n", e.Path)
+		r.report.Skipped++
+		if e.Kind == 'd' {
+			r.skipped = append(r.skipped, e.Path)
+		}
+		return
+	}
+
+	switch e.Kind {
+	case 'd':
+		err = os.Mkdir(dest, 0o700)
+		if os.IsExist(err) {
+			err = nil
+		}
+	case 'f':
+		err = r.writeFile(dest, e)
+	case 'h':
+		err = r.writeHardlink(dest, e)
+	case 'l':
+		err = os.Symlink(e.LinkTarget, dest)
+	default:
+		err = mknod(dest, e)
+	}
+	if err != nil {
+		r.fail(e, "%v", err)
+		return
+	}
+
+	switch e.Kind {
+	case 'd':
+		r.dirs = append(r.dirs, restoreDir{dest: dest, entry: e})
+	case 'h':
+	default:
+		r.applyMetadata(dest, e)
+	}
+	r.report.Restored++
+}
+
+func restoreArchive(d *pbscommon.PXARDecoder, opts *RestoreOptions) (*RestoreReport, error) {
+	r := &restorer{
+		opts:    opts,
+		decoder: d,
+		report:  &RestoreReport{},
+		chown:   !opts.NoOwner && canChown(),
+	}
+	for {
+		e, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return r.report, err
+		}
+		if r.selected(e) {
+			r.restoreEntry(e)
+		}
+	}
+	//Deepest first, a parent mtime is not touched anymore once set. A later entry of the same name may
+	//have replaced a directory by a symlink, chmod and chtimes would follow it
+	for i := len(r.dirs) - 1; i >= 0; i-- {
+		if info, err := os.Lstat(r.dirs[i].dest); err != nil || !info.IsDir() || r.checkParents(r.dirs[i].dest, false) != nil {
+			continue
+		}
+		r.applyMetadata(r.dirs[i].dest, r.dirs[i].entry)
+	}
+	return r.report, nil
+}
+
+// from:to pairs of numeric ids
+func parseIDMap(pairs []string) (map[uint32]uint32, error) {
+	ret := make(map[uint32]uint32)
+	for _, p := range pairs {
+		from, to, ok := strings.Cut(p, ":")
+		f, err1 := strconv.ParseUint(from, 10, 32)
+		t, err2 := strconv.ParseUint(to, 10, 32)
+		if !ok || err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid id mapping %s, expected from:to", p)
+		}
+		ret[uint32(f)] = uint32(t)
+	}
+	return ret, nil
+}
+
+func cmdRestore(args []string) int {
+	var includes, excludes, uidMaps, gidMaps clientcommon.ArrayFlags
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	targetFlag := fs.String("target", "", "Directory to restore to, created if missing")
+	fs.Var(&includes, "include", "Can be specified multiple times, only restore paths matching the pattern, .pxarexclude syntax relative to archive root (optional)")
+	fs.Var(&excludes, "exclude", "Can be specified multiple times, do not restore paths matching the pattern (optional)")
+	onConflictFlag := fs.String("on-conflict", "skip", "overwrite|skip|newer , what to do with files already existing in target, newer only replaces files older than the backup")
+	fs.Var(&uidMaps, "map-uid", "Can be specified multiple times, from:to restores files owned by uid from as owned by uid to (optional)")
+	fs.Var(&gidMaps, "map-gid", "Can be specified multiple times, from:to restores files of group gid from with group gid to (optional)")
+	noOwnerFlag := fs.Bool("no-owner", false, "Do not restore ownership, by default it is restored when running as root (optional)")
+	fs.Parse(args)
+
+	cfg, err := conn.load()
+	if err != nil || *targetFlag == "" {
+		if err != nil {
+			fmt.Println(err)
+		}
+		fmt.Println("-target is mandatory")
+		fs.PrintDefaults()
+		return exitFailure
+	}
+	opts := &RestoreOptions{
+		Target:     *targetFlag,
+		Includes:   parsePatterns(includes),
+		Excludes:   parsePatterns(excludes),
+		OnConflict: *onConflictFlag,
+		NoOwner:    *noOwnerFlag,
+	}
+	if opts.OnConflict != "overwrite" && opts.OnConflict != "skip" && opts.OnConflict != "newer" {
+		fmt.Printf("Invalid conflict policy %s\n", opts.OnConflict)
+		return exitFailure
+	}
+	if opts.UIDMap, err = parseIDMap(uidMaps); err == nil {
+		opts.GIDMap, err = parseIDMap(gidMaps)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+
+	client := cfg.client()
+	snap, err := cfg.selectSnapshot(client)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	client = cfg.connect(snap)
+	d, err := pbscommon.OpenSnapshotArchive(client, snap, cfg.Archive)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+
+	fmt.Printf("Restoring %s from %s to %s\n", cfg.Archive, snapshotName(snap), opts.Target)
+	begin := time.Now()
+	report, err := restoreArchive(d, opts)
+	fmt.Printf("Restored %d, Skipped %d, Failed %d, Warnings %d, restore took %s.\n", report.Restored, report.Skipped, len(report.Failed), len(report.Warnings), time.Since(begin))
+	for _, f := range report.Failed {
+		fmt.Println("Failed: " + f)
+	}
+	if err != nil {
+		fmt.Println("Restore aborted: " + err.Error())
+		return exitFailure
+	}
+	if len(report.Failed) > 0 || len(report.Warnings) > 0 {
+		return exitWarnings
+	}
+	return 0
+}
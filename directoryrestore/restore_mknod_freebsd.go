@@ -0,0 +1,14 @@
+//go:build freebsd
+// +build freebsd
+
+package main
+
+import (
+	"pbscommon"
+	"syscall"
+)
+
+// Devices, fifos and sockets, permissions are applied afterwards like for every other entry
+func mknod(dest string, e *pbscommon.PXAREntry) error {
+	return syscall.Mknod(dest, uint32(e.Mode&(pbscommon.IFMT|0o7777)), uint64(pbscommon.MakeDevice(e.DevMajor, e.DevMinor)))
+}
@@ -0,0 +1,194 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"pbscommon"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeTestArchive(t *testing.T, root string) []byte {
+	var archive bytes.Buffer
+	a := &pbscommon.PXARArchive{
+		ArchiveName:    "test.pxar.didx",
+		WriteCB:        func(b []byte) { archive.Write(b) },
+		CatalogWriteCB: func(b []byte) {},
+	}
+	a.WriteDir(root, "", true)
+	if len(a.Warnings) > 0 {
+		t.Fatalf("warnings writing archive: %v", a.Warnings)
+	}
+	return archive.Bytes()
+}
+
+// Renames the entry from to to, both one byte long, so the archive holds two entries named to
+func renameEntry(t *testing.T, data []byte, from string, to string) {
+	var record [16]byte
+	binary.LittleEndian.PutUint64(record[0:8], pbscommon.PXAR_FILENAME)
+	binary.LittleEndian.PutUint64(record[8:16], 16+uint64(len(from))+1)
+	i := bytes.Index(data, append(record[:], from+"\x00"...))
+	if i < 0 {
+		t.Fatalf("entry %s not found", from)
+	}
+	copy(data[i+16:], to)
+}
+
+func restoreTestArchive(t *testing.T, data []byte, opts *RestoreOptions) *RestoreReport {
+	opts.NoOwner = true
+	if opts.OnConflict == "" {
+		opts.OnConflict = "overwrite"
+	}
+	report, err := restoreArchive(pbscommon.NewPXARDecoder(bytes.NewReader(data), uint64(len(data))), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func mustWrite(t *testing.T, name string, data string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkUntouched(t *testing.T, outside string) {
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "keep" {
+			t.Errorf("%s was written outside the target", e.Name())
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "keep")); string(data) != "outside" {
+		t.Errorf("file outside the target changed to %q", data)
+	}
+}
+
+func TestRestoreContainment(t *testing.T) {
+	tests := []struct {
+		name string
+		//Builds the archive and prepares target, outside holds the file keep
+		setup    func(t *testing.T, src string, target string, outside string) []byte
+		includes []string
+		conflict string
+	}{
+		{
+			name: "include below symlink in target",
+			setup: func(t *testing.T, src string, target string, outside string) []byte {
+				mustWrite(t, filepath.Join(src, "a", "x"), "archive")
+				os.Symlink(outside, filepath.Join(target, "a"))
+				return writeTestArchive(t, src)
+			},
+			includes: []string{"a/x"},
+		},
+		{
+			name: "hardlink target below symlink in target",
+			setup: func(t *testing.T, src string, target string, outside string) []byte {
+				mustWrite(t, filepath.Join(src, "a", "keep"), "archive")
+				os.Link(filepath.Join(src, "a", "keep"), filepath.Join(src, "h"))
+				os.Symlink(outside, filepath.Join(target, "a"))
+				return writeTestArchive(t, src)
+			},
+			includes: []string{"h"},
+		},
+		{
+			name: "directory named like an earlier symlink, overwrite",
+			setup: func(t *testing.T, src string, target string, outside string) []byte {
+				os.Symlink(outside, filepath.Join(src, "a"))
+				mustWrite(t, filepath.Join(src, "b", "x"), "archive")
+				data := writeTestArchive(t, src)
+				renameEntry(t, data, "b", "a")
+				return data
+			},
+		},
+		{
+			name: "directory named like an earlier symlink, skip",
+			setup: func(t *testing.T, src string, target string, outside string) []byte {
+				os.Symlink(outside, filepath.Join(src, "a"))
+				mustWrite(t, filepath.Join(src, "b", "x"), "archive")
+				data := writeTestArchive(t, src)
+				renameEntry(t, data, "b", "a")
+				return data
+			},
+			conflict: "skip",
+		},
+		{
+			name: "hardlink target below a symlink restored earlier",
+			setup: func(t *testing.T, src string, target string, outside string) []byte {
+				os.Symlink(outside, filepath.Join(src, "a"))
+				mustWrite(t, filepath.Join(src, "b", "keep"), "archive")
+				os.Link(filepath.Join(src, "b", "keep"), filepath.Join(src, "h"))
+				data := writeTestArchive(t, src)
+				renameEntry(t, data, "b", "a")
+				copy(data[bytes.Index(data, []byte("b/keep\x00")):], "a")
+				return data
+			},
+			includes: []string{"a", "h"},
+			conflict: "skip",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, target, outside := t.TempDir(), t.TempDir(), t.TempDir()
+			mustWrite(t, filepath.Join(outside, "keep"), "outside")
+			data := tt.setup(t, src, target, outside)
+			restoreTestArchive(t, data, &RestoreOptions{Target: target, Includes: parsePatterns(tt.includes), OnConflict: tt.conflict})
+			checkUntouched(t, outside)
+
+			//A hardlink to a file outside the target would expose it through the restore
+			var outsideStat syscall.Stat_t
+			syscall.Stat(filepath.Join(outside, "keep"), &outsideStat)
+			if outsideStat.Nlink != 1 {
+				t.Errorf("file outside the target has %d links", outsideStat.Nlink)
+			}
+		})
+	}
+}
+
+func TestRestoreConflict(t *testing.T) {
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	future := time.Now().Add(time.Hour)
+	tests := []struct {
+		conflict string
+		existing time.Time
+		want     string
+		skipped  uint64
+	}{
+		{"overwrite", old, "archive", 0},
+		{"overwrite", future, "archive", 0},
+		{"skip", old, "existing", 1},
+		{"newer", old, "archive", 0},
+		{"newer", future, "existing", 1},
+	}
+
+	src := t.TempDir()
+	mustWrite(t, filepath.Join(src, "f"), "archive")
+	data := writeTestArchive(t, src)
+	for _, tt := range tests {
+		t.Run(tt.conflict+" "+tt.existing.Format(time.DateOnly), func(t *testing.T) {
+			target := t.TempDir()
+			mustWrite(t, filepath.Join(target, "f"), "existing")
+			os.Chtimes(filepath.Join(target, "f"), tt.existing, tt.existing)
+			report := restoreTestArchive(t, data, &RestoreOptions{Target: target, OnConflict: tt.conflict})
+			if got, _ := os.ReadFile(filepath.Join(target, "f")); string(got) != tt.want {
+				t.Errorf("file is %q, want %q", got, tt.want)
+			}
+			if report.Skipped != tt.skipped || len(report.Failed) > 0 {
+				t.Errorf("skipped %d failed %v, want %d skipped", report.Skipped, report.Failed, tt.skipped)
+			}
+		})
+	}
+}
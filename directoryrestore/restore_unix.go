@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+)
+
+func canChown() bool {
+	return os.Geteuid() == 0
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"pbscommon"
+)
+
+func canChown() bool {
+	return false
+}
+
+func mknod(dest string, e *pbscommon.PXAREntry) error {
+	return fmt.Errorf("special files can't be restored on windows")
+}
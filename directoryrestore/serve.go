@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"pbscommon"
+	"strings"
+	"time"
+)
+
+// Read only view of a snapshot archive: HTML listings and downloads under /files/, WebDAV under /dav/.
+// Both have their own prefix, so no archive path can shadow the other one.
+// Files support Range requests, directories can be downloaded as zip or tar with ?download=zip|tar
+type snapshotServer struct {
+	fsys     *pbscommon.PXARFS
+	title    string
+	user     string
+	password string
+}
+
+const (
+	filesPrefix = "/files"
+	davPrefix   = "/dav"
+)
+
+func (s *snapshotServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.user != "" {
+		user, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(s.user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="directoryrestore", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.URL.Path == davPrefix || strings.HasPrefix(r.URL.Path, davPrefix+"/") {
+		s.serveDAV(w, r, strings.TrimPrefix(r.URL.Path, davPrefix))
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed, the snapshot is read only", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case r.URL.Path == "/":
+		http.Redirect(w, r, filesPrefix+"/", http.StatusFound)
+	case r.URL.Path == filesPrefix || strings.HasPrefix(r.URL.Path, filesPrefix+"/"):
+		s.serveBrowse(w, r, strings.TrimPrefix(r.URL.Path, filesPrefix))
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// Name inside the PXARFS of an URL path
+func fsName(urlPath string) string {
+	name := strings.Trim(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, fs.ErrInvalid):
+		http.Error(w, "Bad request", http.StatusBadRequest)
+	default:
+		fmt.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func (s *snapshotServer) serveBrowse(w http.ResponseWriter, r *http.Request, urlPath string) {
+	name := fsName(urlPath)
+	info, err := s.fsys.Stat(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if !info.IsDir() {
+		s.serveFile(w, r, name)
+		return
+	}
+	//Relative links in the listing need the trailing slash
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+		return
+	}
+	switch format := r.URL.Query().Get("download"); format {
+	case "":
+		s.serveListing(w, r, name)
+	case "zip", "tar":
+		s.serveArchive(w, r, name, format)
+	default:
+		http.Error(w, "download must be zip or tar", http.StatusBadRequest)
+	}
+}
+
+func (s *snapshotServer) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer f.Close()
+	info, _ := f.Stat()
+	//ServeContent answers Range and conditional requests, only the requested chunks are downloaded
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f.(io.ReadSeeker))
+}
+
+func (s *snapshotServer) serveArchive(w http.ResponseWriter, r *http.Request, name string, format string) {
+	info, err := s.fsys.Stat(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	root := info.Sys().(*pbscommon.PXAREntry)
+	sub, err := s.fsys.Subtree(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	base := path.Base(root.Path)
+	if root.Path == "" {
+		base = "snapshot"
+	}
+	w.Header().Set("Content-Type", "application/"+format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s.%s", url.PathEscape(base), format))
+	if r.Method == http.MethodHead {
+		return
+	}
+	//Errors can only be logged once the archive is streaming, the client gets a truncated download
+	if format == "zip" {
+		err = writeZip(w, sub, root.Path)
+	} else {
+		err = writeTar(w, sub, root.Path)
+	}
+	if err != nil {
+		fmt.Printf("Download of /%s failed: %v\n", root.Path, err)
+	}
+}
+
+type listingEntry struct {
+	Name   string
+	Href   string
+	Size   string
+	MTime  string
+	Target string //Symlinks only
+	IsDir  bool
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}} /{{.Path}}</title>
+<style>body{font-family:sans-serif}td{padding:0 1em}td.size{text-align:right}</style></head>
+<body><h1>{{.Title}}</h1><h2>/{{.Path}}</h2>
+<p>Download this directory as <a href="?download=zip">zip</a> or <a href="?download=tar">tar</a></p>
+<table><tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if .Path}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>{{end}}
+{{range .Entries}}<tr><td>{{if .Href}}<a href="{{.Href}}">{{.Name}}{{if .IsDir}}/{{end}}</a>{{else}}{{.Name}}{{end}}{{if .Target}} &rarr; {{.Target}}{{end}}</td><td class="size">{{.Size}}</td><td>{{.MTime}}</td></tr>
+{{end}}</table></body></html>
+`))
+
+func (s *snapshotServer) serveListing(w http.ResponseWriter, r *http.Request, name string) {
+	entries, err := s.fsys.ReadDir(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	items := make([]listingEntry, 0, len(entries))
+	for _, de := range entries {
+		info, err := de.Info()
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		item := listingEntry{Name: de.Name(), Href: url.PathEscape(de.Name())}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			item.Target, _ = s.fsys.ReadLink(path.Join(name, de.Name()))
+			//Symlinks leaving the archive cannot be opened
+			if info, err = s.fsys.Stat(path.Join(name, de.Name())); err != nil {
+				item.Href = ""
+				items = append(items, item)
+				continue
+			}
+		}
+		item.IsDir = info.IsDir()
+		item.MTime = info.ModTime().Format("2006-01-02 15:04:05")
+		if item.IsDir {
+			item.Href += "/"
+		} else {
+			item.Size = humanSize(info.Size())
+		}
+		items = append(items, item)
+	}
+	p := ""
+	if name != "." {
+		p = name
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	err = listingTemplate.Execute(w, map[string]any{"Title": s.title, "Path": p, "Entries": items})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// WebDAV class 1 subset needed to mount the snapshot read only: OPTIONS, PROPFIND, GET and HEAD
+func (s *snapshotServer) serveDAV(w http.ResponseWriter, r *http.Request, urlPath string) {
+	w.Header().Set("DAV", "1")
+	w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD")
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+	case "PROPFIND":
+		s.servePropfind(w, r, urlPath)
+	case http.MethodGet, http.MethodHead:
+		s.serveBrowse(w, r, urlPath)
+	default:
+		http.Error(w, "Method not allowed, the snapshot is read only", http.StatusMethodNotAllowed)
+	}
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+type davProp struct {
+	DisplayName      string          `xml:"D:displayname"`
+	ResourceType     davResourceType `xml:"D:resourcetype"`
+	GetContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	GetLastModified  string          `xml:"D:getlastmodified"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XMLNS     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+func davHref(name string, isDir bool) string {
+	href := davPrefix + "/"
+	if name != "." {
+		parts := strings.Split(name, "/")
+		for i := range parts {
+			parts[i] = url.PathEscape(parts[i])
+		}
+		href += strings.Join(parts, "/")
+		if isDir {
+			href += "/"
+		}
+	}
+	return href
+}
+
+func newDAVResponse(name string, info fs.FileInfo) davResponse {
+	prop := davProp{
+		DisplayName:     info.Name(),
+		GetLastModified: info.ModTime().UTC().Format(http.TimeFormat),
+	}
+	if name == "." {
+		prop.DisplayName = "/"
+	}
+	if info.IsDir() {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		size := info.Size()
+		prop.GetContentLength = &size
+	}
+	return davResponse{
+		Href:     davHref(name, info.IsDir()),
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}
+}
+
+// All properties are always returned, the request body is not parsed.
+// Depth infinity is answered like depth 1, walking a whole snapshot would take too long
+func (s *snapshotServer) servePropfind(w http.ResponseWriter, r *http.Request, urlPath string) {
+	name := fsName(urlPath)
+	info, err := s.fsys.Stat(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	ms := davMultistatus{XMLNS: "DAV:", Responses: []davResponse{newDAVResponse(name, info)}}
+	if info.IsDir() && r.Header.Get("Depth") != "0" {
+		entries, err := s.fsys.ReadDir(name)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		for _, de := range entries {
+			child := path.Join(name, de.Name())
+			//Clients cannot do anything with symlinks, they are shown as what they point to
+			ci, err := s.fsys.Stat(child)
+			if err != nil {
+				continue
+			}
+			ms.Responses = append(ms.Responses, newDAVResponse(child, ci))
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(ms); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Environment variable with the basic authentication password, overrides serve-password of the config file
+const servePasswordEnv = "DIRECTORYRESTORE_SERVE_PASSWORD"
+
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func cmdServe(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	conn := addConnectionFlags(flags)
+	listenFlag := flags.String("listen", "127.0.0.1:8080", "Address to listen on, only local connections are accepted by default")
+	userFlag := flags.String("user", "", "User name for basic authentication, the password is read from serve-password of the config file or "+servePasswordEnv+" (optional)")
+	flags.Parse(args)
+
+	cfg, err := conn.load()
+	if err != nil {
+		fmt.Println(err)
+		flags.PrintDefaults()
+		return exitFailure
+	}
+	//Not a flag, command lines are visible to every user of the machine
+	user, password := cfg.ServeUser, cfg.ServePassword
+	if *userFlag != "" {
+		user = *userFlag
+	}
+	if env := os.Getenv(servePasswordEnv); env != "" {
+		password = env
+	}
+	if (user == "") != (password == "") {
+		fmt.Printf("-user or serve-user and a password from serve-password or %s must be given together\n", servePasswordEnv)
+		return exitFailure
+	}
+	client := cfg.client()
+	snap, err := cfg.selectSnapshot(client)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	d, err := pbscommon.OpenSnapshotArchive(cfg.connect(snap), snap, cfg.Archive)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	fsys, err := pbscommon.NewPXARFS(d)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+
+	if !isLoopback(*listenFlag) && user == "" {
+		fmt.Printf("Warning: %s is reachable from other machines and no user is set, anyone who can connect can read the snapshot\n", *listenFlag)
+	}
+	server := &http.Server{
+		Addr: *listenFlag,
+		Handler: &snapshotServer{
+			fsys:     fsys,
+			title:    fmt.Sprintf("%s of %s", cfg.Archive, snapshotName(snap)),
+			user:     user,
+			password: password,
+		},
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	fmt.Printf("Serving %s of %s on http://%s%s/ , WebDAV at http://%s%s/\n", cfg.Archive, snapshotName(snap), *listenFlag, filesPrefix, *listenFlag, davPrefix)
+	if err := server.ListenAndServe(); err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	return 0
+}
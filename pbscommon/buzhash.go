@@ -73,6 +73,13 @@ func (self *Chunker) New(chunk_size_avg uint64) {
 	fmt.Printf("Chunk size min is %d , max %d\n", self.chunk_size_min, self.chunk_size_max)
 }
 
+// Starts a new chunk as if the stream began here, used when a chunk boundary is forced
+func (self *Chunker) Reset() {
+	self.h = 0
+	self.window_size = 0
+	self.chunk_size = 0
+}
+
 func (self *Chunker) Scan(data []byte) uint64 {
 	window_len := uint64(len(self.window))
 	data_len := uint64(len(data))
@@ -0,0 +1,70 @@
+package pbscommon
+
+import (
+	"encoding/binary"
+)
+
+// A snapshot has a single catalog.pcat1.didx even with several pxar archives, its root table
+// lists every archive as a directory, so it can only be written when all of them are done
+type PXARCatalog struct {
+	WriteCB  PXAROutCB
+	pos      uint64
+	archives []CatalogDir
+}
+
+// Magic is written lazily so that table positions are right from the first write
+func (c *PXARCatalog) start() {
+	if c.pos == 0 {
+		if c.WriteCB != nil {
+			c.WriteCB(catalog_magic)
+		}
+		c.pos = uint64(len(catalog_magic))
+	}
+}
+
+func (c *PXARCatalog) write(b []byte) {
+	c.start()
+	if c.WriteCB != nil {
+		c.WriteCB(b)
+	}
+	c.pos += uint64(len(b))
+}
+
+// Writes a directory table, every entry is already encoded, returns the table position
+func (c *PXARCatalog) writeTable(count int, entries []byte) uint64 {
+	tabledata := make([]byte, 0)
+	tabledata = append_u64_7bit(tabledata, uint64(count))
+	tabledata = append(tabledata, entries...)
+
+	catalog_outdata := make([]byte, 0)
+	catalog_outdata = append_u64_7bit(catalog_outdata, uint64(len(tabledata)))
+	catalog_outdata = append(catalog_outdata, tabledata...)
+
+	c.start()
+	pos := c.pos
+	c.write(catalog_outdata)
+	return pos
+}
+
+// Registers the root directory table of an archive
+func (c *PXARCatalog) AddArchive(name string, pos uint64) {
+	c.archives = append(c.archives, CatalogDir{Name: name, Pos: pos})
+}
+
+// We write special pointer to root dir here, after the table listing every archive
+func (c *PXARCatalog) Finish() {
+	c.start()
+	rootpos := c.pos
+	tabledata := make([]byte, 0)
+	for _, d := range c.archives {
+		tabledata = append(tabledata, 'd')
+		tabledata = append_u64_7bit(tabledata, uint64(len(d.Name)))
+		tabledata = append(tabledata, []byte(d.Name)...)
+		tabledata = append_u64_7bit(tabledata, rootpos-d.Pos)
+	}
+	c.writeTable(len(c.archives), tabledata)
+
+	ptr := make([]byte, 0)
+	ptr = binary.LittleEndian.AppendUint64(ptr, rootpos)
+	c.write(ptr)
+}
@@ -0,0 +1,230 @@
+package pbscommon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// One entry of a catalog directory table
+type CatalogEntry struct {
+	Kind  byte //Same letters as PXARCatalog writes: 'd', 'f', 'l', 'h', 'b', 'c', 'p', 's'
+	Name  string
+	Size  uint64 //Regular files only
+	MTime int64  //Regular files only, seconds since epoch
+	table uint64 //Position of the table of a directory
+}
+
+// Reads catalog.pcat1 files, every table is read on its own so through a DynamicIndexReader
+// only the chunks holding the visited directories are downloaded
+type CatalogReader struct {
+	r    io.ReaderAt
+	size uint64
+	root uint64
+}
+
+func NewCatalogReader(r io.ReaderAt, size uint64) (*CatalogReader, error) {
+	if size < uint64(len(catalog_magic))+8 {
+		return nil, fmt.Errorf("catalog: too short")
+	}
+	magic := make([]byte, len(catalog_magic))
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, catalog_magic) {
+		return nil, fmt.Errorf("catalog: invalid magic %+v", magic)
+	}
+	ptr := make([]byte, 8)
+	if _, err := r.ReadAt(ptr, int64(size-8)); err != nil {
+		return nil, err
+	}
+	root := binary.LittleEndian.Uint64(ptr)
+	if root >= size-8 {
+		return nil, fmt.Errorf("catalog: invalid root table position %d", root)
+	}
+	return &CatalogReader{r: r, size: size, root: root}, nil
+}
+
+func read_u64_7bit(b []byte) (uint64, []byte, error) {
+	v := uint64(0)
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * i)
+		if b[i] < 128 {
+			return v, b[i+1:], nil
+		}
+	}
+	return 0, nil, fmt.Errorf("catalog: invalid number")
+}
+
+// Non negative values are encoded like u64, negative ones get a trailing zero byte
+func read_i64_7bit(b []byte) (int64, []byte, error) {
+	v := uint64(0)
+	for i := 0; i < len(b) && i < 11; i++ {
+		if b[i] == 0 {
+			if i == 0 {
+				return 0, b[1:], nil
+			}
+			return -int64(v), b[i+1:], nil
+		}
+		v |= uint64(b[i]&0x7f) << (7 * i)
+		if b[i] < 128 {
+			return int64(v), b[i+1:], nil
+		}
+	}
+	return 0, nil, fmt.Errorf("catalog: invalid number")
+}
+
+func (c *CatalogReader) readTable(pos uint64) ([]CatalogEntry, error) {
+	head := make([]byte, min(10, c.size-pos))
+	if _, err := c.r.ReadAt(head, int64(pos)); err != nil {
+		return nil, err
+	}
+	tablelen, rest, err := read_u64_7bit(head)
+	if err != nil {
+		return nil, err
+	}
+	start := pos + uint64(len(head)-len(rest))
+	if start+tablelen > c.size {
+		return nil, fmt.Errorf("catalog: table at %d exceeds catalog size", pos)
+	}
+	data := make([]byte, tablelen)
+	if _, err := c.r.ReadAt(data, int64(start)); err != nil {
+		return nil, err
+	}
+
+	count, data, err := read_u64_7bit(data)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]CatalogEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if len(data) == 0 {
+			return nil, fmt.Errorf("catalog: truncated table at %d", pos)
+		}
+		e := CatalogEntry{Kind: data[0]}
+		namelen, rest, err := read_u64_7bit(data[1:])
+		if err != nil || namelen > uint64(len(rest)) {
+			return nil, fmt.Errorf("catalog: invalid entry in table at %d", pos)
+		}
+		e.Name = string(rest[:namelen])
+		data = rest[namelen:]
+		switch e.Kind {
+		case 'd':
+			var offset uint64
+			if offset, data, err = read_u64_7bit(data); err != nil {
+				return nil, err
+			}
+			if offset > pos {
+				return nil, fmt.Errorf("catalog: invalid directory offset in table at %d", pos)
+			}
+			e.table = pos - offset
+		case 'f':
+			if e.Size, data, err = read_u64_7bit(data); err != nil {
+				return nil, err
+			}
+			if e.MTime, data, err = read_i64_7bit(data); err != nil {
+				return nil, err
+			}
+		case 'l', 'h', 'b', 'c', 'p', 's':
+		default:
+			return nil, fmt.Errorf("catalog: unknown entry type %q in table at %d", e.Kind, pos)
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+// Archives of the snapshot, as directories named like the archive index, e.g. backup.pxar.didx
+func (c *CatalogReader) Archives() ([]CatalogEntry, error) {
+	return c.readTable(c.root)
+}
+
+func (c *CatalogReader) ReadDir(dir *CatalogEntry) ([]CatalogEntry, error) {
+	if dir.Kind != 'd' {
+		return nil, fmt.Errorf("catalog: %s is not a directory", dir.Name)
+	}
+	return c.readTable(dir.table)
+}
+
+// Entry at p inside archive, p is relative to the archive root and "" gives the archive itself.
+// Missing paths give an error wrapping fs.ErrNotExist
+func (c *CatalogReader) Lookup(archive string, p string) (*CatalogEntry, error) {
+	archives, err := c.Archives()
+	if err != nil {
+		return nil, err
+	}
+	var cur *CatalogEntry
+	for i := range archives {
+		if archives[i].Name == archive {
+			cur = &archives[i]
+		}
+	}
+	if cur == nil {
+		return nil, fmt.Errorf("catalog: archive %s: %w", archive, fs.ErrNotExist)
+	}
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return cur, nil
+	}
+	for _, name := range strings.Split(p, "/") {
+		if cur.Kind != 'd' {
+			return nil, fmt.Errorf("catalog: %s: %w", p, fs.ErrNotExist)
+		}
+		entries, err := c.ReadDir(cur)
+		if err != nil {
+			return nil, err
+		}
+		cur = nil
+		for i := range entries {
+			if entries[i].Name == name {
+				cur = &entries[i]
+				break
+			}
+		}
+		if cur == nil {
+			return nil, fmt.Errorf("catalog: %s: %w", p, fs.ErrNotExist)
+		}
+	}
+	return cur, nil
+}
+
+// Depth first walk below the entry at p of archive, children come in catalog order.
+// fn gets paths relative to archive root, returning fs.SkipDir for a directory skips its content
+func (c *CatalogReader) Walk(archive string, p string, fn func(p string, e *CatalogEntry) error) error {
+	e, err := c.Lookup(archive, p)
+	if err != nil {
+		return err
+	}
+	return c.walk(strings.Trim(path.Clean("/"+p), "/"), e, fn)
+}
+
+func (c *CatalogReader) walk(p string, dir *CatalogEntry, fn func(p string, e *CatalogEntry) error) error {
+	if dir.Kind != 'd' {
+		return nil
+	}
+	entries, err := c.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		child := entries[i].Name
+		if p != "" {
+			child = p + "/" + child
+		}
+		err := fn(child, &entries[i])
+		if err == fs.SkipDir {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.walk(child, &entries[i], fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+//go:build linux
+// +build linux
+
+package pbscommon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Catalog of two archives sharing one catalog like directorybackup writes it
+func writeTestCatalog(t *testing.T) []byte {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	first, second := t.TempDir(), t.TempDir()
+	for name, data := range map[string]string{
+		"etc/hosts":         "127.0.0.1 localhost\n",
+		"etc/ssh/sshd.conf": "Port 22\n",
+		"var/log/syslog":    "",
+		"top":               "1234567",
+	} {
+		if err := os.MkdirAll(filepath.Join(first, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(first, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(filepath.Join(first, name), mtime, mtime)
+	}
+	if err := os.Symlink("hosts", filepath.Join(first, "etc", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(second, "only"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filepath.Join(second, "only"), mtime, mtime)
+
+	var catalog bytes.Buffer
+	c := &PXARCatalog{WriteCB: func(b []byte) { catalog.Write(b) }}
+	for name, root := range map[string]string{"first.pxar.didx": first, "second.pxar.didx": second} {
+		a := &PXARArchive{ArchiveName: name, WriteCB: func(b []byte) {}, Catalog: c}
+		a.WriteDir(root, "", true)
+		if len(a.Warnings) > 0 {
+			t.Fatalf("warnings writing archive: %v", a.Warnings)
+		}
+	}
+	c.Finish()
+	return catalog.Bytes()
+}
+
+func TestCatalogReaderLookup(t *testing.T) {
+	data := writeTestCatalog(t)
+	c, err := NewCatalogReader(bytes.NewReader(data), uint64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archives, err := c.Archives()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, a := range archives {
+		names = append(names, a.Name)
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"first.pxar.didx", "second.pxar.didx"}) {
+		t.Errorf("archives %v", names)
+	}
+
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).Unix()
+	tests := []struct {
+		archive string
+		path    string
+		kind    byte //0 for a missing entry
+		size    uint64
+	}{
+		{"first.pxar.didx", "", 'd', 0},
+		{"first.pxar.didx", "etc", 'd', 0},
+		{"first.pxar.didx", "/etc/", 'd', 0},
+		{"first.pxar.didx", "etc/hosts", 'f', 20},
+		{"first.pxar.didx", "etc/./ssh/../hosts", 'f', 20},
+		{"first.pxar.didx", "etc/ssh/sshd.conf", 'f', 8},
+		{"first.pxar.didx", "etc/link", 'l', 0},
+		{"first.pxar.didx", "var/log/syslog", 'f', 0},
+		{"first.pxar.didx", "top", 'f', 7},
+		{"first.pxar.didx", "only", 0, 0},
+		{"first.pxar.didx", "etc/missing", 0, 0},
+		{"first.pxar.didx", "top/below", 0, 0},
+		{"first.pxar.didx", "etc/link/x", 0, 0},
+		{"second.pxar.didx", "only", 'f', 1},
+		{"second.pxar.didx", "top", 0, 0},
+		{"third.pxar.didx", "", 0, 0},
+	}
+	for _, tt := range tests {
+		e, err := c.Lookup(tt.archive, tt.path)
+		if tt.kind == 0 {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s %s: got %v, want %v", tt.archive, tt.path, err, fs.ErrNotExist)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.archive, tt.path, err)
+			continue
+		}
+		if e.Kind != tt.kind || e.Size != tt.size {
+			t.Errorf("%s %s is %c of %d bytes, want %c of %d", tt.archive, tt.path, e.Kind, e.Size, tt.kind, tt.size)
+		}
+		if e.Kind == 'f' && e.MTime != mtime {
+			t.Errorf("%s %s mtime %d, want %d", tt.archive, tt.path, e.MTime, mtime)
+		}
+	}
+}
+
+func TestCatalogReaderWalk(t *testing.T) {
+	data := writeTestCatalog(t)
+	c, err := NewCatalogReader(bytes.NewReader(data), uint64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		skip string
+		want []string //Catalog order, directories before the other entries
+	}{
+		{"", "", []string{"etc", "etc/ssh", "etc/ssh/sshd.conf", "etc/hosts", "etc/link", "var", "var/log", "var/log/syslog", "top"}},
+		{"", "etc", []string{"etc", "var", "var/log", "var/log/syslog", "top"}},
+		{"etc", "", []string{"etc/ssh", "etc/ssh/sshd.conf", "etc/hosts", "etc/link"}},
+		{"/etc/ssh/", "", []string{"etc/ssh/sshd.conf"}},
+		{"top", "", []string{}},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		err := c.Walk("first.pxar.didx", tt.path, func(p string, e *CatalogEntry) error {
+			got = append(got, p)
+			if p == tt.skip {
+				return fs.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("walk %q: %v", tt.path, err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("walk %q skipping %q = %v, want %v", tt.path, tt.skip, got, tt.want)
+		}
+	}
+
+	stop := errors.New("stop")
+	count := 0
+	err = c.Walk("first.pxar.didx", "", func(p string, e *CatalogEntry) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Errorf("walk returned %v after %d entries, want the error of the first call", err, count)
+	}
+}
+
+func TestCatalogReaderNumbers(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want int64
+		ok   bool
+	}{
+		{[]byte{0}, 0, true},
+		{[]byte{5}, 5, true},
+		{[]byte{0x80 | 0x2c, 0x02}, 300, true},
+		{[]byte{5, 0}, 5, true},
+		{[]byte{0x80 | 5, 0}, -5, true},
+		{[]byte{0x80 | 0x2c, 0x80 | 0x02, 0}, -300, true},
+		{[]byte{0x80}, 0, false},
+		{[]byte{}, 0, false},
+	}
+	for _, tt := range tests {
+		v, _, err := read_i64_7bit(tt.data)
+		if (err == nil) != tt.ok || (tt.ok && v != tt.want) {
+			t.Errorf("read_i64_7bit(%x) = %d %v, want %d", tt.data, v, err, tt.want)
+		}
+	}
+	for _, v := range []uint64{0, 1, 127, 128, 300, 1 << 40, ^uint64(0)} {
+		got, rest, err := read_u64_7bit(append_u64_7bit(nil, v))
+		if err != nil || got != v || len(rest) != 0 {
+			t.Errorf("u64 %d read back as %d %v, %d bytes left", v, got, err, len(rest))
+		}
+	}
+}
+
+func TestCatalogReaderInvalid(t *testing.T) {
+	data := writeTestCatalog(t)
+	rootAt := func(pos uint64) []byte {
+		return binary.LittleEndian.AppendUint64(bytes.Clone(data[:len(data)-8]), pos)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"magic only", bytes.Clone(catalog_magic)},
+		{"bad magic", append([]byte("not a catalog"), data[len(catalog_magic)+5:]...)},
+		{"root past the end", rootAt(uint64(len(data)))},
+		{"root in the magic", rootAt(1)},
+	}
+	for _, tt := range tests {
+		c, err := NewCatalogReader(bytes.NewReader(tt.data), uint64(len(tt.data)))
+		if err == nil {
+			_, err = c.Archives()
+		}
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
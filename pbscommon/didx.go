@@ -0,0 +1,157 @@
+package pbscommon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+var DIDX_MAGIC = []byte{28, 145, 78, 165, 25, 186, 179, 205}
+
+const DIDX_HEADER_SIZE = 4096
+
+// Number of chunks kept in memory by DynamicIndexReader, will be 8*4MB usage on average
+const DIDX_CACHE_CHUNKS = 8
+
+// Header as per proxmox documentation is fixed size of 4096 bytes,
+// then end offset of type uint64 and sha256 digest follow, so 40 byte each record until EOF
+type DynamicIndex struct {
+	Ends    []uint64 //End offset of each chunk in the archive stream
+	Digests []string //Hex sha256 of each chunk
+}
+
+func ParseDynamicIndex(data []byte) (*DynamicIndex, error) {
+	if !bytes.HasPrefix(data, DIDX_MAGIC) || len(data) < DIDX_HEADER_SIZE {
+		return nil, fmt.Errorf("DIDX: Invalid magic %+v", data[:min(8, len(data))])
+	}
+	data = data[DIDX_HEADER_SIZE:]
+	if len(data)%40 != 0 {
+		return nil, fmt.Errorf("DIDX: Short read")
+	}
+	ret := &DynamicIndex{
+		Ends:    make([]uint64, len(data)/40),
+		Digests: make([]string, len(data)/40),
+	}
+	for i := range ret.Ends {
+		ret.Ends[i] = binary.LittleEndian.Uint64(data[i*40 : i*40+8])
+		ret.Digests[i] = hex.EncodeToString(data[i*40+8 : i*40+40])
+	}
+	return ret, nil
+}
+
+func (d *DynamicIndex) Size() uint64 {
+	if len(d.Ends) == 0 {
+		return 0
+	}
+	return d.Ends[len(d.Ends)-1]
+}
+
+// Checksum of the index as listed in the snapshot manifest, sha256 over end offset and digest of every chunk
+func (d *DynamicIndex) Csum() string {
+	h := sha256.New()
+	for i := range d.Ends {
+		binary.Write(h, binary.LittleEndian, d.Ends[i])
+		digest, _ := hex.DecodeString(d.Digests[i])
+		h.Write(digest)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (d *DynamicIndex) ChunkStart(i int) uint64 {
+	if i == 0 {
+		return 0
+	}
+	return d.Ends[i-1]
+}
+
+// Index of the chunk holding offset, len(Ends) if it is past the end
+func (d *DynamicIndex) ChunkAt(offset uint64) int {
+	return sort.Search(len(d.Ends), func(i int) bool {
+		return d.Ends[i] > offset
+	})
+}
+
+type cachedDynamicChunk struct {
+	index int
+	data  []byte
+}
+
+// Random access to an archive of a snapshot opened in reader mode, chunks are downloaded on demand
+type DynamicIndexReader struct {
+	index  *DynamicIndex
+	client *PBSClient
+	lock   sync.Mutex
+	cached []cachedDynamicChunk //Most recently used last
+}
+
+func NewDynamicIndexReader(client *PBSClient, index *DynamicIndex) *DynamicIndexReader {
+	return &DynamicIndexReader{
+		index:  index,
+		client: client,
+	}
+}
+
+// Downloads index name of the snapshot the reader session of client is opened on
+func OpenDynamicIndexReader(client *PBSClient, name string) (*DynamicIndexReader, error) {
+	data, err := client.DownloadToBytes(name)
+	if err != nil {
+		return nil, err
+	}
+	index, err := ParseDynamicIndex(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return NewDynamicIndexReader(client, index), nil
+}
+
+func (r *DynamicIndexReader) Size() int64 {
+	return int64(r.index.Size())
+}
+
+func (r *DynamicIndexReader) chunk(i int) ([]byte, error) {
+	for k, c := range r.cached {
+		if c.index == i {
+			r.cached = append(append(r.cached[:k:k], r.cached[k+1:]...), c)
+			return c.data, nil
+		}
+	}
+	data, err := r.client.GetChunkData(r.index.Digests[i])
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) != r.index.Ends[i]-r.index.ChunkStart(i) {
+		return nil, fmt.Errorf("DIDX: chunk %s has size %d, index expects %d", r.index.Digests[i], len(data), r.index.Ends[i]-r.index.ChunkStart(i))
+	}
+	if len(r.cached) >= DIDX_CACHE_CHUNKS {
+		r.cached = r.cached[1:]
+	}
+	r.cached = append(r.cached, cachedDynamicChunk{index: i, data: data})
+	return data, nil
+}
+
+func (r *DynamicIndexReader) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	n := 0
+	pos := uint64(off)
+	for n < len(p) {
+		i := r.index.ChunkAt(pos)
+		if i >= len(r.index.Ends) {
+			return n, io.EOF
+		}
+		data, err := r.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], data[pos-r.index.ChunkStart(i):])
+		n += copied
+		pos += uint64(copied)
+	}
+	return n, nil
+}
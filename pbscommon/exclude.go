@@ -0,0 +1,139 @@
+package pbscommon
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Per directory exclusion file, same semantics as proxmox-backup-client
+const PXAR_EXCLUDE_FILENAME = ".pxarexclude"
+
+// Pattern syntax follows .pxarexclude files:
+//
+// # comment
+// *.tmp        matches in the directory of the pattern and every subdirectory
+// /build       anchored, matches only directly below the directory of the pattern
+// doc/build    a slash inside anchors the pattern as well, like in .gitignore
+// cache/       trailing slash, matches only directories
+// !keep.tmp    negated, re-includes a previously excluded path
+// a/**/b       ** matches any number of path components
+//
+// The last matching pattern wins, a directory that is excluded is not descended into
+// so its content can't be re-included
+
+type ExcludePattern struct {
+	Base     string   //Archive relative directory the pattern is evaluated from, "" for root
+	Parts    []string //Pattern split by path component
+	Anchored bool
+	DirOnly  bool
+	Negate   bool
+}
+
+// Returns false for empty lines and comments
+func ParseExcludePattern(line string, base string) (ExcludePattern, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+		return ExcludePattern{}, false
+	}
+	p := ExcludePattern{Base: base}
+	if strings.HasPrefix(line, "!") {
+		p.Negate = true
+		line = line[1:]
+	}
+	if strings.HasPrefix(line, "/") {
+		p.Anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+	if strings.HasSuffix(line, "/") {
+		p.DirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ExcludePattern{}, false
+	}
+	p.Parts = strings.Split(line, "/")
+	if len(p.Parts) > 1 {
+		p.Anchored = true
+	}
+	return p, true
+}
+
+// Reads a .pxarexclude file, patterns are relative to base
+func ReadExcludeFile(filename string, base string) ([]ExcludePattern, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseExcludeFile(f, base)
+}
+
+// Patterns of .pxarexclude content, relative to base
+func ParseExcludeFile(r io.Reader, base string) ([]ExcludePattern, error) {
+	ret := make([]ExcludePattern, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if p, ok := ParseExcludePattern(scanner.Text(), base); ok {
+			ret = append(ret, p)
+		}
+	}
+	return ret, scanner.Err()
+}
+
+// relpath is slash separated and relative to archive root
+func (p *ExcludePattern) Match(relpath string, isDir bool) bool {
+	if p.DirOnly && !isDir {
+		return false
+	}
+	if p.Base != "" {
+		if !strings.HasPrefix(relpath, p.Base+"/") {
+			return false
+		}
+		relpath = relpath[len(p.Base)+1:]
+	}
+	comps := strings.Split(relpath, "/")
+	if p.Anchored {
+		return matchComponents(p.Parts, comps)
+	}
+	for i := range comps {
+		if matchComponents(p.Parts, comps[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchComponents(pattern []string, comps []string) bool {
+	if len(pattern) == 0 {
+		return len(comps) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(comps); i++ {
+			if matchComponents(pattern[1:], comps[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(comps) == 0 {
+		return false
+	}
+	ok, err := path.Match(pattern[0], comps[0])
+	if err != nil || !ok {
+		return false
+	}
+	return matchComponents(pattern[1:], comps[1:])
+}
+
+// Last matching pattern decides, nothing matching means included
+func IsExcluded(patterns []ExcludePattern, relpath string, isDir bool) bool {
+	for i := len(patterns) - 1; i >= 0; i-- {
+		if patterns[i].Match(relpath, isDir) {
+			return !patterns[i].Negate
+		}
+	}
+	return false
+}
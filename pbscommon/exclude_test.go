@@ -0,0 +1,109 @@
+package pbscommon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseExcludePattern(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+		want ExcludePattern
+	}{
+		{"", false, ExcludePattern{}},
+		{"   ", false, ExcludePattern{}},
+		{"# comment", false, ExcludePattern{}},
+		{"!", false, ExcludePattern{}},
+		{"/", false, ExcludePattern{}},
+		{"*.tmp", true, ExcludePattern{Parts: []string{"*.tmp"}}},
+		{"/build", true, ExcludePattern{Parts: []string{"build"}, Anchored: true}},
+		{"cache/", true, ExcludePattern{Parts: []string{"cache"}, DirOnly: true}},
+		{"!keep.tmp", true, ExcludePattern{Parts: []string{"keep.tmp"}, Negate: true}},
+		{"doc/build", true, ExcludePattern{Parts: []string{"doc", "build"}, Anchored: true}},
+		{"!/a/b/\r\n", true, ExcludePattern{Parts: []string{"a", "b"}, Anchored: true, DirOnly: true, Negate: true}},
+	}
+	for _, tt := range tests {
+		p, ok := ParseExcludePattern(tt.line, "")
+		if ok != tt.ok || strings.Join(p.Parts, "/") != strings.Join(tt.want.Parts, "/") ||
+			p.Anchored != tt.want.Anchored || p.DirOnly != tt.want.DirOnly || p.Negate != tt.want.Negate {
+			t.Errorf("parse %q = %+v %v, want %+v %v", tt.line, p, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestExcludePatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		base    string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		//Unanchored patterns match at every depth
+		{"*.tmp", "", "a.tmp", false, true},
+		{"*.tmp", "", "x/y/a.tmp", false, true},
+		{"*.tmp", "", "a.tmpx", false, false},
+		//Anchored by a leading slash or a slash inside
+		{"/build", "", "build", true, true},
+		{"/build", "", "src/build", true, false},
+		{"doc/build", "", "doc/build", true, true},
+		{"doc/build", "", "x/doc/build", true, false},
+		{"doc/*.md", "", "doc/a.md", false, true},
+		{"doc/*.md", "", "doc/sub/a.md", false, false},
+		//** matches any number of components, also none
+		{"**/build", "", "build", true, true},
+		{"**/build", "", "x/y/build", true, true},
+		{"cache/**/*.bin", "", "cache/a.bin", false, true},
+		{"cache/**/*.bin", "", "cache/x/y/a.bin", false, true},
+		{"cache/**/*.bin", "", "other/cache/a.bin", false, false},
+		//Directories only
+		{"cache/", "", "cache", true, true},
+		{"cache/", "", "cache", false, false},
+		{"cache/", "", "x/cache", true, true},
+		//Relative to the directory of the .pxarexclude file
+		{"*.log", "var", "var/a.log", false, true},
+		{"*.log", "var", "a.log", false, false},
+		{"*.log", "var", "variable/a.log", false, false},
+		{"/run", "var", "var/run", true, true},
+		{"/run", "var", "var/x/run", true, false},
+		{"lib/cache", "var", "var/lib/cache", true, true},
+		{"lib/cache", "var", "var/x/lib/cache", true, false},
+	}
+	for _, tt := range tests {
+		p, ok := ParseExcludePattern(tt.pattern, tt.base)
+		if !ok {
+			t.Fatalf("pattern %q not parsed", tt.pattern)
+		}
+		if got := p.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("%q (base %q) matching %q dir %v = %v, want %v", tt.pattern, tt.base, tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	patterns, err := ParseExcludeFile(strings.NewReader("# temporary files\n*.tmp\n!keep.tmp\ncache/\n!/cache/\n\nbuild\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"a.tmp", false, true},
+		{"x/keep.tmp", false, false},
+		{"keep.txt", false, false},
+		//The last matching pattern wins
+		{"cache", true, false},
+		{"x/cache", true, true},
+		{"cache", false, false},
+		{"x/build", false, true},
+		{"x/build", true, true},
+	}
+	for _, tt := range tests {
+		if got := IsExcluded(patterns, tt.path, tt.isDir); got != tt.want {
+			t.Errorf("excluded %q dir %v = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
@@ -75,6 +75,15 @@ type BackupManifest struct {
 	Unprotected Unprotected `json:"unprotected"`
 }
 
+func (m *BackupManifest) HasFile(name string) bool {
+	for _, f := range m.Files {
+		if f.Filename == name {
+			return true
+		}
+	}
+	return false
+}
+
 type AuthErr struct {
 }
 
@@ -173,7 +182,7 @@ func (pbs *PBSClient) CreateFixedIndex(fic FixedIndexCreateReq) (uint64, error)
 	if resp2.StatusCode != http.StatusOK {
 		resp1, _ := io.ReadAll(resp2.Body)
 		fmt.Println("Error making request:", string(resp1), string(resp2.Proto))
-		return 0, fmt.Errorf("Error making request:", string(resp1), string(resp2.Proto))
+		return 0, fmt.Errorf("Error making request: %s %s", string(resp1), string(resp2.Proto))
 	}
 
 	resp1, err := io.ReadAll(resp2.Body)
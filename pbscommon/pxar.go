@@ -4,9 +4,14 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"io/fs"
 	"math/bits"
 	"os"
+	"path"
 	"sort"
+	"strings"
+	"time"
 
 	//	"io/ioutil"
 	"path/filepath"
@@ -33,8 +38,17 @@ const (
 	PXAR_PAYLOAD             uint64 = 0x28147a1b0b7c1a25
 	PXAR_GOODBYE             uint64 = 0x2fec4fa642d5731d
 	PXAR_GOODBYE_TAIL_MARKER uint64 = 0xef5eed5b753e1555
+
+	//Split archives, the metadata archive starts with the format version and refers to payloads by offset
+	PXAR_FORMAT_VERSION       uint64 = 0x730f6c75df16a40d
+	PXAR_PRELUDE              uint64 = 0xe309d79d9f7b771b
+	PXAR_PAYLOAD_REF          uint64 = 0x419d3d6bc4ba977e
+	PXAR_PAYLOAD_START_MARKER uint64 = 0x834c68c2194a4ed2
+	PXAR_PAYLOAD_TAIL_MARKER  uint64 = 0x6c72b78b984c81b5
 )
 
+const PXAR_FORMAT_VERSION_2 uint64 = 2
+
 var catalog_magic = []byte{145, 253, 96, 249, 196, 103, 88, 213}
 
 const (
@@ -67,6 +81,39 @@ type PXARFileEntry struct {
 	mtime MTime
 }
 
+type PXARXattr struct {
+	Name  string
+	Value []byte
+}
+
+// ACL permissions use the same bits as mode, read 4, write 2, execute 1
+type PXARACLEntry struct {
+	ID          uint64 //uid for user entries, gid for group entries
+	Permissions uint64
+}
+
+type PXARACLDefault struct {
+	UserObjPermissions  uint64
+	GroupObjPermissions uint64
+	OtherPermissions    uint64
+	MaskPermissions     uint64 //PXAR_ACL_NO_MASK if the default ACL has no mask
+}
+
+const PXAR_ACL_NO_MASK uint64 = 0xffffffffffffffff
+
+// Records following PXAR_ENTRY, nil or empty members are not written
+type PXARMetadata struct {
+	Xattrs           []PXARXattr
+	ACLUsers         []PXARACLEntry
+	ACLGroups        []PXARACLEntry
+	ACLGroupObj      *uint64
+	ACLDefault       *PXARACLDefault
+	ACLDefaultUsers  []PXARACLEntry
+	ACLDefaultGroups []PXARACLEntry
+	FCaps            []byte
+	QuotaProjID      *uint64
+}
+
 type PXARFilenameEntry struct {
 	hdr uint64
 	len uint64
@@ -138,6 +185,71 @@ func ca_make_bst(input []GoodByeItem, output *[]GoodByeItem) {
 	make_bst_inner(input, n, log_of_2(n)+1, output, 0)
 }
 
+func newEntry(fileInfo fs.FileInfo, attr PXARSourceAttr, filetype uint64) *PXARFileEntry {
+	return &PXARFileEntry{
+		hdr:   PXAR_ENTRY,
+		len:   56,
+		mode:  filetype | attr.Perm,
+		flags: 0,
+		uid:   attr.UID,
+		gid:   attr.GID,
+		mtime: MTime{
+			secs:    uint64(fileInfo.ModTime().Unix()),
+			nanos:   uint32(fileInfo.ModTime().Nanosecond()),
+			padding: 0,
+		},
+	}
+}
+
+// Entry as the archiver records the file at path, so local files can be compared with archived ones.
+// Hardlinks are not detected, every link is returned as a regular file
+func LocalEntry(path string) (*PXAREntry, error) {
+	fileInfo, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	var mode uint64
+	switch fm := fileInfo.Mode(); {
+	case fm.IsDir():
+		mode = IFDIR
+	case fm.IsRegular():
+		mode = IFREG
+	case fm&os.ModeSymlink != 0:
+		mode = IFLNK
+	case fm&os.ModeCharDevice != 0:
+		mode = IFCHR
+	case fm&os.ModeDevice != 0:
+		mode = IFBLK
+	case fm&os.ModeNamedPipe != 0:
+		mode = IFIFO
+	default:
+		mode = IFSOCK
+	}
+	perm, uid, gid := fileOwnership(fileInfo)
+	e := &PXAREntry{
+		Name:  filepath.Base(path),
+		Kind:  entryKind(mode),
+		Mode:  mode | perm,
+		UID:   uid,
+		GID:   gid,
+		MTime: fileInfo.ModTime(),
+	}
+	switch e.Kind {
+	case 'f':
+		e.Size = uint64(fileInfo.Size())
+	case 'l':
+		if e.LinkTarget, err = os.Readlink(path); err != nil {
+			return nil, err
+		}
+		//Symlinks carry no metadata records in the archive
+		return e, nil
+	case 'b', 'c':
+		e.DevMajor, e.DevMinor = fileDevice(fileInfo)
+	}
+	e.Metadata = readMetadata(path, fileInfo, &PXARArchive{})
+	return e, nil
+}
+
 type PXAROutCB func([]byte)
 
 type PXARArchive struct {
@@ -146,11 +258,59 @@ type PXARArchive struct {
 	//AddDirectory(dirname string)
 	WriteCB        PXAROutCB
 	CatalogWriteCB PXAROutCB
-	buffer         bytes.Buffer
-	pos            uint64
-	ArchiveName    string
+	//Shared catalog when a snapshot holds several archives, otherwise one is made around CatalogWriteCB
+	Catalog     *PXARCatalog
+	buffer      bytes.Buffer
+	pos         uint64
+	ArchiveName string
+	//When set symlinks are resolved and their target is archived in place of the link
+	FollowSymlinks bool
+	//Classes of metadata records to leave out of the archive
+	SkipXattrs      bool
+	SkipACLs        bool
+	SkipFCaps       bool
+	SkipQuotaProjID bool
+	//Patterns applied from archive root, .pxarexclude files found while walking are added on top
+	ExcludePatterns []ExcludePattern
+	//Regular files larger than this are skipped, 0 disables the filter
+	MaxFileSize int64
+	//Regular files modified more recently than this are skipped, 0 disables the filter
+	MinAge time.Duration
+	//Directories on a different device than their parent are archived empty, unless listed in IncludeMountPoints
+	OneFileSystem bool
+	//Mount points to descend into anyway, absolute or relative to the archived directory
+	IncludeMountPoints []string
+	//Number of paths left out by exclusion patterns and filters
+	Excluded uint64
+	//Per file problems, the archive stays consistent but these entries are skipped or incomplete
+	Warnings []string
+	//When set the archive is written split in format version 2, WriteCB gets the metadata archive
+	//and this the payload archive, which metadata entries refer to by offset
+	PayloadWriteCB PXAROutCB
+	//Unchanged files of the previous split archive, their payload is taken over instead of read again
+	Previous *PXARPrevious
+	//Number of files whose payload was taken from Previous
+	Reused uint64
+	//Directory for the temporary files of WriteTar and WriteStream, os.TempDir() when empty
+	SpoolDir string
+
+	source     PXARSource
+	walking    map[string]bool //Real paths of the directories being written, when following symlinks
+	hardlinks  map[HardlinkKey]HardlinkTarget
+	excludes   []ExcludePattern
+	currentdev uint64
+	payloadpos uint64
+}
+
+type HardlinkKey struct {
+	Dev uint64
+	Ino uint64
+}
 
-	catalog_pos uint64
+// First occurrence of a file with multiple links, later ones point back to it
+type HardlinkTarget struct {
+	Offset uint64 //Position of the PXAR_FILENAME header of the original entry
+	Path   string //Path relative to archive root
 }
 
 //This function will flush the internal buffer and update position
@@ -171,9 +331,14 @@ func (a *PXARArchive) Flush() {
 	//fmt.Printf("Flush %d bytes\n", count)
 }
 
+func (a *PXARArchive) warn(format string, args ...any) {
+	w := fmt.Sprintf(format, args...)
+	fmt.Println("Warning: " + w)
+	a.Warnings = append(a.Warnings, w)
+}
+
 func (a *PXARArchive) Create() {
 	a.pos = 0
-	a.catalog_pos = 8
 }
 
 type CatalogDir struct {
@@ -182,6 +347,7 @@ type CatalogDir struct {
 }
 
 type CatalogFile struct {
+	Kind  byte //Catalog entry type: 'f' regular file, 'l' symlink, 'h' hardlink, 'b'/'c' devices, 'p' fifo, 's' socket
 	Name  string
 	MTime uint64
 	Size  uint64
@@ -235,19 +401,84 @@ func append_u64_7bit(a []byte, v uint64) []byte {
 
 */
 
+// Archives the local directory path, which must not be a symlink, when toplevel is set.
+// Otherwise path is written as entry dirname of the directory being written, as WriteFile,
+// WriteSymlink and WriteSpecial do for their types
 func (a *PXARArchive) WriteDir(path string, dirname string, toplevel bool) CatalogDir {
-	//fmt.Printf("Write dir %s at %d\n", path, a.pos)
-	files, err := os.ReadDir(path)
-	if err != nil {
-		return CatalogDir{}
+	if toplevel {
+		return a.WriteSource(NewOSSource(path))
 	}
+	defer a.useOSSource(filepath.Dir(path))()
+	return a.writeDir(filepath.Base(path), dirname, false)
+}
 
-	fileInfo, err := os.Stat(path)
+func (a *PXARArchive) WriteFile(path string, basename string) CatalogFile {
+	defer a.useOSSource(filepath.Dir(path))()
+	return a.writeFile(filepath.Base(path), basename)
+}
+
+func (a *PXARArchive) WriteSymlink(path string, basename string) CatalogFile {
+	defer a.useOSSource(filepath.Dir(path))()
+	return a.writeSymlink(filepath.Base(path), basename)
+}
+
+func (a *PXARArchive) WriteSpecial(path string, basename string) CatalogFile {
+	defer a.useOSSource(filepath.Dir(path))()
+	return a.writeSpecial(filepath.Base(path), basename)
+}
+
+// Path based entry points read through a source on the parent directory, the returned func restores the previous one
+func (a *PXARArchive) useOSSource(dir string) func() {
+	parent := a.source
+	a.source = NewOSSource(dir)
+	return func() {
+		a.source = parent
+	}
+}
+
+// Archives everything src contains, the archive root is the src "." directory
+func (a *PXARArchive) WriteSource(src PXARSource) CatalogDir {
+	a.source = src
+	return a.writeDir(".", "", true)
+}
+
+func (a *PXARArchive) writeDir(name string, dirname string, toplevel bool) CatalogDir {
+	//fmt.Printf("Write dir %s at %d\n", name, a.pos)
+	fileInfo, err := a.source.Stat(name)
 	if err != nil {
-		fmt.Printf("Failed to stat %s\n", path)
+		a.warn("Failed to stat %s: %v", a.display(name), err)
 		return CatalogDir{}
 	}
 
+	//Mount points are kept as empty directories so the tree looks the same on restore
+	var files []fs.DirEntry
+	attr := a.sourceAttr(name, fileInfo)
+	if toplevel || !a.OneFileSystem || ((!attr.HasInode || attr.Dev == a.currentdev) && !a.isMountPoint(name)) || a.isIncludedMount(name) {
+		files, err = a.source.ReadDir(name)
+		if err != nil {
+			a.warn("Failed to read directory %s: %v", a.display(name), err)
+			return CatalogDir{}
+		}
+		parentdev := a.currentdev
+		a.currentdev = attr.Dev
+		defer func() {
+			a.currentdev = parentdev
+		}()
+	} else {
+		fmt.Printf("Not descending into mount point %s\n", a.display(name))
+	}
+
+	//Followed symlinks may lead back into any directory still being written, not only into a parent
+	if a.FollowSymlinks {
+		if real, err := a.evalSymlinks(name); err == nil {
+			if a.walking == nil {
+				a.walking = make(map[string]bool)
+			}
+			a.walking[real] = true
+			defer delete(a.walking, real)
+		}
+	}
+
 	//Avoid writing filename entry on root
 	if !toplevel {
 		fname_entry := &PXARFilenameEntry{
@@ -260,30 +491,34 @@ func (a *PXARArchive) WriteDir(path string, dirname string, toplevel bool) Catal
 		a.buffer.WriteString(dirname)
 		a.buffer.WriteByte(0x00)
 	} else {
-		if a.CatalogWriteCB != nil {
-			a.CatalogWriteCB(catalog_magic)
-			a.catalog_pos = 8
+		a.excludes = append([]ExcludePattern{}, a.ExcludePatterns...)
+		if a.Catalog == nil {
+			a.Catalog = &PXARCatalog{WriteCB: a.CatalogWriteCB}
+			defer a.Catalog.Finish()
 		}
+		a.Catalog.start()
+	}
+
+	//Patterns of a .pxarexclude file apply to this directory and below, so they are dropped when we leave it
+	excludes_len := len(a.excludes)
+	if patterns, err := a.readExcludeFile(name); err == nil && files != nil {
+		a.excludes = append(a.excludes, patterns...)
 	}
+	defer func() {
+		a.excludes = a.excludes[:excludes_len]
+	}()
 
 	a.Flush()
 
 	dir_start_pos := a.pos
 
-	entry := &PXARFileEntry{
-		hdr:   PXAR_ENTRY,
-		len:   56,
-		mode:  IFDIR | 0o777,
-		flags: 0,
-		uid:   1000, //This is fixed because this project for now targeting windows , on which execute, traverse etc permissions don't exist
-		gid:   1000,
-		mtime: MTime{
-			secs:    uint64(fileInfo.ModTime().Unix()),
-			nanos:   0,
-			padding: 0,
-		},
+	//Root goodbye table refers to the archive start, so the format version belongs to the root entry
+	if toplevel && a.PayloadWriteCB != nil {
+		a.startSplit()
 	}
-	binary.Write(&a.buffer, binary.LittleEndian, entry)
+
+	binary.Write(&a.buffer, binary.LittleEndian, newEntry(fileInfo, attr, IFDIR))
+	a.writeMetadata(name, fileInfo)
 
 	a.Flush()
 
@@ -293,57 +528,82 @@ func (a *PXARArchive) WriteDir(path string, dirname string, toplevel bool) Catal
 
 	for _, file := range files {
 		startpos := a.pos
-		if file.IsDir() {
-
-			D := a.WriteDir(filepath.Join(path, file.Name()), file.Name(), false)
-			catalog_dirs = append(catalog_dirs, D)
-			goodbyteitems = append(goodbyteitems, GoodByeItem{
-				offset: startpos,
-				hash:   siphash.Hash(0x83ac3f1cfbb450db, 0xaa4f1b6879369fbd, []byte(file.Name())),
-				len:    a.pos - startpos,
-			})
+		fullpath := path.Join(name, file.Name())
+		if a.isExcluded(file, fullpath) {
+			a.Excluded++
+			continue
+		}
+		if file.Type()&fs.ModeSymlink != 0 && !a.shouldFollow(name, fullpath) {
+			F := a.writeSymlink(fullpath, file.Name())
+			if F.Kind != 0 {
+				catalog_files = append(catalog_files, F)
+			}
+		} else if a.isDir(file, fullpath) {
+			D := a.writeDir(fullpath, file.Name(), false)
+			if a.pos != startpos {
+				catalog_dirs = append(catalog_dirs, D)
+			}
+		} else if a.isSpecial(file, fullpath) {
+			F := a.writeSpecial(fullpath, file.Name())
+			if F.Kind != 0 {
+				catalog_files = append(catalog_files, F)
+			}
 		} else {
-			F := a.WriteFile(filepath.Join(path, file.Name()), file.Name())
-
-			catalog_files = append(catalog_files, F)
-			goodbyteitems = append(goodbyteitems, GoodByeItem{
-				offset: startpos,
-				hash:   siphash.Hash(0x83ac3f1cfbb450db, 0xaa4f1b6879369fbd, []byte(file.Name())),
-				len:    a.pos - startpos,
-			})
+			F := a.writeFile(fullpath, file.Name())
+			if F.Kind != 0 {
+				catalog_files = append(catalog_files, F)
+			}
+		}
+		//Entries which failed before writing anything are left out of goodbye table too
+		if a.pos == startpos {
+			continue
 		}
+		goodbyteitems = append(goodbyteitems, GoodByeItem{
+			offset: startpos,
+			hash:   siphash.Hash(0x83ac3f1cfbb450db, 0xaa4f1b6879369fbd, []byte(file.Name())),
+			len:    a.pos - startpos,
+		})
+	}
+
+	oldpos := a.finishDir(dir_start_pos, goodbyteitems, catalog_files, catalog_dirs)
+
+	if toplevel {
+		if a.PayloadWriteCB != nil {
+			a.finishSplit()
+		}
+		a.Catalog.AddArchive(a.ArchiveName, oldpos)
+	}
+
+	return CatalogDir{
+		Name: dirname,
+		Pos:  oldpos,
 	}
+}
 
+// Writes the catalog table and the goodbye table of a directory whose entry starts at dir_start_pos,
+// once all its children are written. Returns the catalog table position for the parent table
+func (a *PXARArchive) finishDir(dir_start_pos uint64, goodbyteitems []GoodByeItem, catalog_files []CatalogFile, catalog_dirs []CatalogDir) uint64 {
 	//Here we can write AFTER the recursion so leaves get written first
 	//We need to write leaves first because otherwise we won't know offsets
-	oldpos := a.catalog_pos
 	tabledata := make([]byte, 0)
-	tabledata = append_u64_7bit(tabledata, uint64(len(catalog_files)+len(catalog_dirs)))
 	for _, d := range catalog_dirs {
 		tabledata = append(tabledata, 'd')
 		tabledata = append_u64_7bit(tabledata, uint64(len(d.Name)))
 		tabledata = append(tabledata, []byte(d.Name)...)
-		tabledata = append_u64_7bit(tabledata, oldpos-d.Pos)
+		tabledata = append_u64_7bit(tabledata, a.Catalog.pos-d.Pos)
 	}
 
 	for _, f := range catalog_files {
-		tabledata = append(tabledata, 'f')
+		tabledata = append(tabledata, f.Kind)
 		tabledata = append_u64_7bit(tabledata, uint64(len(f.Name)))
 		tabledata = append(tabledata, []byte(f.Name)...)
-		tabledata = append_u64_7bit(tabledata, f.Size)
-		tabledata = append_u64_7bit(tabledata, f.MTime)
-	}
-
-	catalog_outdata := make([]byte, 0)
-	catalog_outdata = append_u64_7bit(catalog_outdata, uint64(len(tabledata)))
-	catalog_outdata = append(catalog_outdata, tabledata...)
-
-	if a.CatalogWriteCB != nil {
-		a.CatalogWriteCB(catalog_outdata)
-
+		if f.Kind == 'f' {
+			tabledata = append_u64_7bit(tabledata, f.Size)
+			tabledata = append_u64_7bit(tabledata, f.MTime)
+		}
 	}
 
-	a.catalog_pos += uint64(len(catalog_outdata))
+	oldpos := a.Catalog.writeTable(len(catalog_files)+len(catalog_dirs), tabledata)
 
 	a.Flush()
 
@@ -383,50 +643,47 @@ func (a *PXARArchive) WriteDir(path string, dirname string, toplevel bool) Catal
 
 	a.Flush()
 
-	if toplevel {
-		//We write special pointer to root dir here
-
-		tabledata := make([]byte, 0)
-		tabledata = append_u64_7bit(tabledata, uint64(1))
-		tabledata = append(tabledata, 'd')
-		tabledata = append_u64_7bit(tabledata, uint64(len(a.ArchiveName)))
-		tabledata = append(tabledata, []byte(a.ArchiveName)...)
-		tabledata = append_u64_7bit(tabledata, a.catalog_pos-oldpos)
-		catalog_outdata := make([]byte, 0)
-		catalog_outdata = append_u64_7bit(catalog_outdata, uint64(len(tabledata)))
-		catalog_outdata = append(catalog_outdata, tabledata...)
-		ptr := make([]byte, 0)
-		ptr = binary.LittleEndian.AppendUint64(ptr, a.catalog_pos)
-		if a.CatalogWriteCB != nil {
-			a.CatalogWriteCB(catalog_outdata)
-			a.CatalogWriteCB(ptr)
-		}
-	}
-
-	return CatalogDir{
-		Name: dirname,
-		Pos:  oldpos,
-	}
+	return oldpos
 }
 
 // On pxar first item and consquently entry point must always be WriteDir , because toplevel is always a directory
 // So backing up single file is not possible
-func (a *PXARArchive) WriteFile(path string, basename string) CatalogFile {
-	//fmt.Printf("Write file %s at %d\n", path, a.pos)
-	fileInfo, err := os.Stat(path)
+func (a *PXARArchive) writeFile(name string, basename string) CatalogFile {
+	//fmt.Printf("Write file %s at %d\n", name, a.pos)
+	file, err := a.source.Open(name)
+
 	if err != nil {
-		fmt.Printf("Failed to stat %s\n", path)
+		a.warn("Failed to open %s: %v", a.display(name), err)
 		return CatalogFile{}
 	}
 
-	file, err := os.Open(path)
+	defer file.Close()
 
+	//Stat the opened file so the size we commit to matches what we are going to read
+	fileInfo, err := file.Stat()
 	if err != nil {
-		fmt.Printf("Failed to open %s\n", path)
+		a.warn("Failed to stat %s: %v", a.display(name), err)
+		return CatalogFile{}
+	}
+	if !fileInfo.Mode().IsRegular() {
+		a.warn("Skipping %s: no longer a regular file", a.display(name))
 		return CatalogFile{}
 	}
 
-	defer file.Close()
+	attr := a.sourceAttr(name, fileInfo)
+	if attr.HasInode && attr.Nlink > 1 {
+		if a.hardlinks == nil {
+			a.hardlinks = make(map[HardlinkKey]HardlinkTarget)
+		}
+		key := HardlinkKey{Dev: attr.Dev, Ino: attr.Ino}
+		if target, ok := a.hardlinks[key]; ok {
+			return a.WriteHardlink(basename, target)
+		}
+		a.hardlinks[key] = HardlinkTarget{
+			Offset: a.pos,
+			Path:   a.archivePath(name),
+		}
+	}
 
 	fname_entry := &PXARFilenameEntry{
 		hdr: PXAR_FILENAME,
@@ -438,46 +695,374 @@ func (a *PXARArchive) WriteFile(path string, basename string) CatalogFile {
 	a.buffer.WriteString(basename)
 	a.buffer.WriteByte(0x00)
 
-	entry := &PXARFileEntry{
-		hdr:   PXAR_ENTRY,
-		len:   56,
-		mode:  IFREG | 0o777,
-		flags: 0,
-		uid:   1000,
-		gid:   1000,
-		mtime: MTime{
-			secs:    uint64(fileInfo.ModTime().Unix()),
-			nanos:   0,
-			padding: 0,
-		},
-	}
+	entry := newEntry(fileInfo, attr, IFREG)
 	binary.Write(&a.buffer, binary.LittleEndian, entry)
+	a.writeMetadata(name, fileInfo)
 
-	binary.Write(&a.buffer, binary.LittleEndian, PXAR_PAYLOAD)
-	filesize := uint64(fileInfo.Size()) + 16 //File size + header size
-	binary.Write(&a.buffer, binary.LittleEndian, filesize)
+	catalog_file := CatalogFile{
+		Kind:  'f',
+		Name:  basename,
+		MTime: uint64(fileInfo.ModTime().Unix()),
+		Size:  uint64(fileInfo.Size()),
+	}
 
-	a.Flush()
+	if a.reusePayload(name, entry, uint64(fileInfo.Size())) {
+		return catalog_file
+	}
+
+	a.writePayloadHeader(uint64(fileInfo.Size()))
 
+	//Payload length is already written, so exactly that many bytes must follow whatever happens to the file
 	readbuffer := make([]byte, 1024*64)
+	remaining := uint64(fileInfo.Size())
 
-	for {
-		nread, err := file.Read(readbuffer)
-		if nread <= 0 {
+	for remaining > 0 {
+		nread, err := file.Read(readbuffer[:min(uint64(len(readbuffer)), remaining)])
+		if nread > 0 {
+			a.writePayload(readbuffer[:nread])
+			remaining -= uint64(nread)
+		}
+		if err == io.EOF {
+			a.warn("%s shrunk while reading, padding %d bytes with zeros", a.display(name), remaining)
 			break
 		}
 		if err != nil {
-			panic(err.Error())
+			a.warn("Read error on %s: %v, padding %d bytes with zeros", a.display(name), err, remaining)
+			break
+		}
+	}
+
+	clear(readbuffer)
+	for remaining > 0 {
+		n := min(uint64(len(readbuffer)), remaining)
+		a.writePayload(readbuffer[:n])
+		remaining -= n
+	}
+
+	if nread, _ := file.Read(readbuffer[:1]); nread > 0 {
+		a.warn("%s grew while reading, truncated to %d bytes", a.display(name), fileInfo.Size())
+	}
+
+	a.Flush()
+
+	return catalog_file
+}
+
+// Symlinks are stored as PXAR_SYMLINK with the link target as payload after the metadata records of the
+// link itself, the target is never followed here
+func (a *PXARArchive) writeSymlink(name string, basename string) CatalogFile {
+	fileInfo, err := a.source.Lstat(name)
+	if err != nil {
+		a.warn("Failed to stat %s: %v", a.display(name), err)
+		return CatalogFile{}
+	}
+
+	target, err := a.source.ReadLink(name)
+	if err != nil {
+		a.warn("Failed to read link %s: %v", a.display(name), err)
+		return CatalogFile{}
+	}
+
+	fname_entry := &PXARFilenameEntry{
+		hdr: PXAR_FILENAME,
+		len: uint64(16) + uint64(len(basename)) + 1,
+	}
+
+	binary.Write(&a.buffer, binary.LittleEndian, fname_entry)
+
+	a.buffer.WriteString(basename)
+	a.buffer.WriteByte(0x00)
+
+	binary.Write(&a.buffer, binary.LittleEndian, newEntry(fileInfo, a.sourceAttr(name, fileInfo), IFLNK))
+	a.writeMetadata(name, fileInfo)
+
+	//Target is NUL terminated like filenames
+	binary.Write(&a.buffer, binary.LittleEndian, PXAR_SYMLINK)
+	binary.Write(&a.buffer, binary.LittleEndian, uint64(16)+uint64(len(target))+1)
+	a.buffer.WriteString(target)
+	a.buffer.WriteByte(0x00)
+
+	a.Flush()
+
+	return CatalogFile{
+		Kind: 'l',
+		Name: basename,
+	}
+}
+
+// A symlink is only followed when explicitly requested, its target exists and it does not point
+// to the directory being archived, one of its parents or any other directory being written,
+// e.g. a/l -> x next to x/m -> a, which would recurse forever
+func (a *PXARArchive) shouldFollow(dir string, link string) bool {
+	if !a.FollowSymlinks {
+		return false
+	}
+	target, err := a.evalSymlinks(link)
+	if err != nil {
+		fmt.Printf("Dangling symlink %s, storing as link\n", a.display(link))
+		return false
+	}
+	realdir, err := a.evalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	if target == "." || target == realdir || strings.HasPrefix(realdir, strings.TrimSuffix(target, "/")+"/") {
+		fmt.Printf("Symlink %s points to a parent directory, storing as link\n", a.display(link))
+		return false
+	}
+	if a.walking[target] {
+		fmt.Printf("Symlink %s points to a directory being archived, storing as link\n", a.display(link))
+		return false
+	}
+	return true
+}
+
+func (a *PXARArchive) evalSymlinks(name string) (string, error) {
+	if s, ok := a.source.(interface {
+		EvalSymlinks(name string) (string, error)
+	}); ok {
+		return s.EvalSymlinks(name)
+	}
+	return resolveSymlinks(a.source, name)
+}
+
+// Devices, fifos and sockets must never be opened, reading them would block or fail
+func (a *PXARArchive) isSpecial(file fs.DirEntry, name string) bool {
+	mode := file.Type()
+	if mode&fs.ModeSymlink != 0 {
+		fileInfo, err := a.source.Stat(name)
+		if err != nil {
+			return false
 		}
-		a.buffer.Write(readbuffer[:nread])
-		a.Flush()
+		mode = fileInfo.Mode()
+	}
+	return mode&(fs.ModeDevice|fs.ModeNamedPipe|fs.ModeSocket) != 0
+}
+
+// DirEntry type is taken from lstat, so for followed symlinks we have to look at the target
+func (a *PXARArchive) isDir(file fs.DirEntry, name string) bool {
+	if file.Type()&fs.ModeSymlink == 0 {
+		return file.IsDir()
+	}
+	fileInfo, err := a.source.Stat(name)
+	return err == nil && fileInfo.IsDir()
+}
+
+// Hardlink entries have no PXAR_ENTRY, just the filename followed by offset and path of the original
+func (a *PXARArchive) WriteHardlink(basename string, target HardlinkTarget) CatalogFile {
+	fname_entry := &PXARFilenameEntry{
+		hdr: PXAR_FILENAME,
+		len: uint64(16) + uint64(len(basename)) + 1,
 	}
 
+	binary.Write(&a.buffer, binary.LittleEndian, fname_entry)
+
+	a.buffer.WriteString(basename)
+	a.buffer.WriteByte(0x00)
+
+	//Offset is relative to this entry filename header, which is the current position
+	binary.Write(&a.buffer, binary.LittleEndian, PXAR_HARDLINK)
+	binary.Write(&a.buffer, binary.LittleEndian, uint64(16+8)+uint64(len(target.Path))+1)
+	binary.Write(&a.buffer, binary.LittleEndian, a.pos-target.Offset)
+	a.buffer.WriteString(target.Path)
+	a.buffer.WriteByte(0x00)
+
 	a.Flush()
 
 	return CatalogFile{
-		Name:  basename,
-		MTime: uint64(fileInfo.ModTime().Unix()),
-		Size:  uint64(fileInfo.Size()),
+		Kind: 'h',
+		Name: basename,
+	}
+}
+
+func (a *PXARArchive) archivePath(name string) string {
+	if name == "." {
+		return ""
+	}
+	return name
+}
+
+// Name shown in messages, the local path for directories on disk
+func (a *PXARArchive) display(name string) string {
+	if s, ok := a.source.(*osSource); ok {
+		return s.path(name)
+	}
+	return name
+}
+
+func (a *PXARArchive) sourceAttr(name string, fileInfo fs.FileInfo) PXARSourceAttr {
+	if s, ok := a.source.(PXARMetadataSource); ok {
+		return s.Attr(name, fileInfo)
+	}
+	return fileAttr(fileInfo)
+}
+
+func (a *PXARArchive) sourceMetadata(name string, fileInfo fs.FileInfo) PXARMetadata {
+	if s, ok := a.source.(PXARMetadataSource); ok {
+		return s.Metadata(name, fileInfo, a)
+	}
+	if e, ok := fileInfo.Sys().(*PXAREntry); ok {
+		return e.Metadata
+	}
+	return PXARMetadata{}
+}
+
+// .pxarexclude of directory name, patterns are relative to it
+func (a *PXARArchive) readExcludeFile(name string) ([]ExcludePattern, error) {
+	f, err := a.source.Open(path.Join(name, PXAR_EXCLUDE_FILENAME))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseExcludeFile(f, a.archivePath(name))
+}
+
+// Only local directories have mount points, st_dev is all other sources can tell
+func (a *PXARArchive) isMountPoint(name string) bool {
+	s, ok := a.source.(*osSource)
+	return ok && s.isMountPoint(name)
+}
+
+// Absolute mount points only match local directories
+func (a *PXARArchive) isIncludedMount(name string) bool {
+	for _, m := range a.IncludeMountPoints {
+		if filepath.IsAbs(m) {
+			if s, ok := a.source.(*osSource); ok && filepath.Clean(m) == filepath.Clean(s.path(name)) {
+				return true
+			}
+			continue
+		}
+		if strings.Trim(filepath.ToSlash(filepath.Clean(m)), "/") == a.archivePath(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *PXARArchive) isExcluded(file fs.DirEntry, name string) bool {
+	symlink := file.Type()&fs.ModeSymlink != 0
+	isDir := a.isDir(file, name) && (!symlink || a.FollowSymlinks)
+	if IsExcluded(a.excludes, a.archivePath(name), isDir) {
+		return true
+	}
+	if isDir || (symlink && !a.FollowSymlinks) || (a.MaxFileSize <= 0 && a.MinAge <= 0) {
+		return false
+	}
+
+	fileInfo, err := a.source.Stat(name)
+	if err != nil || !fileInfo.Mode().IsRegular() {
+		return false
+	}
+	if a.MaxFileSize > 0 && fileInfo.Size() > a.MaxFileSize {
+		return true
+	}
+	if a.MinAge > 0 && time.Since(fileInfo.ModTime()) < a.MinAge {
+		return true
+	}
+	return false
+}
+
+// Device nodes get a PXAR_DEVICE record with major/minor, fifos and sockets are just the entry with their type in mode
+func (a *PXARArchive) writeSpecial(name string, basename string) CatalogFile {
+	fileInfo, err := a.source.Stat(name)
+	if err != nil {
+		a.warn("Failed to stat %s: %v", a.display(name), err)
+		return CatalogFile{}
+	}
+	attr := a.sourceAttr(name, fileInfo)
+
+	var kind byte
+	var mode uint64
+	switch {
+	case fileInfo.Mode()&fs.ModeCharDevice != 0:
+		kind, mode = 'c', IFCHR
+	case fileInfo.Mode()&fs.ModeDevice != 0:
+		kind, mode = 'b', IFBLK
+	case fileInfo.Mode()&fs.ModeNamedPipe != 0:
+		kind, mode = 'p', IFIFO
+	default:
+		kind, mode = 's', IFSOCK
+	}
+
+	fname_entry := &PXARFilenameEntry{
+		hdr: PXAR_FILENAME,
+		len: uint64(16) + uint64(len(basename)) + 1,
+	}
+
+	binary.Write(&a.buffer, binary.LittleEndian, fname_entry)
+
+	a.buffer.WriteString(basename)
+	a.buffer.WriteByte(0x00)
+
+	binary.Write(&a.buffer, binary.LittleEndian, newEntry(fileInfo, attr, mode))
+	a.writeMetadata(name, fileInfo)
+
+	if kind == 'c' || kind == 'b' {
+		binary.Write(&a.buffer, binary.LittleEndian, PXAR_DEVICE)
+		binary.Write(&a.buffer, binary.LittleEndian, uint64(16+16))
+		binary.Write(&a.buffer, binary.LittleEndian, attr.DevMajor)
+		binary.Write(&a.buffer, binary.LittleEndian, attr.DevMinor)
+	}
+
+	a.Flush()
+
+	return CatalogFile{
+		Kind: kind,
+		Name: basename,
+	}
+}
+
+// Metadata records follow PXAR_ENTRY in the same order the reference encoder writes them:
+// xattrs, ACLs (user, group, group obj, default, default user, default group), fcaps, quota project id
+func (a *PXARArchive) writeMetadata(name string, fileInfo fs.FileInfo) {
+	a.writeMetadataRecords(a.sourceMetadata(name, fileInfo))
+}
+
+func (a *PXARArchive) writeMetadataRecords(m PXARMetadata) {
+
+	if !a.SkipXattrs {
+		for _, x := range m.Xattrs {
+			binary.Write(&a.buffer, binary.LittleEndian, PXAR_XATTR)
+			binary.Write(&a.buffer, binary.LittleEndian, uint64(16)+uint64(len(x.Name))+1+uint64(len(x.Value)))
+			a.buffer.WriteString(x.Name)
+			a.buffer.WriteByte(0x00)
+			a.buffer.Write(x.Value)
+		}
+	}
+
+	if !a.SkipACLs {
+		writeACLEntries := func(hdr uint64, entries []PXARACLEntry) {
+			for _, e := range entries {
+				binary.Write(&a.buffer, binary.LittleEndian, hdr)
+				binary.Write(&a.buffer, binary.LittleEndian, uint64(16+16))
+				binary.Write(&a.buffer, binary.LittleEndian, e)
+			}
+		}
+		writeACLEntries(PXAR_ACL_USER, m.ACLUsers)
+		writeACLEntries(PXAR_ACL_GROUP, m.ACLGroups)
+		if m.ACLGroupObj != nil {
+			binary.Write(&a.buffer, binary.LittleEndian, PXAR_ACL_GROUP_OBJ)
+			binary.Write(&a.buffer, binary.LittleEndian, uint64(16+8))
+			binary.Write(&a.buffer, binary.LittleEndian, *m.ACLGroupObj)
+		}
+		if m.ACLDefault != nil {
+			binary.Write(&a.buffer, binary.LittleEndian, PXAR_ACL_DEFAULT)
+			binary.Write(&a.buffer, binary.LittleEndian, uint64(16+32))
+			binary.Write(&a.buffer, binary.LittleEndian, m.ACLDefault)
+		}
+		writeACLEntries(PXAR_ACL_DEFAULT_USER, m.ACLDefaultUsers)
+		writeACLEntries(PXAR_ACL_DEFAULT_GROUP, m.ACLDefaultGroups)
+	}
+
+	if !a.SkipFCaps && len(m.FCaps) > 0 {
+		binary.Write(&a.buffer, binary.LittleEndian, PXAR_FCAPS)
+		binary.Write(&a.buffer, binary.LittleEndian, uint64(16)+uint64(len(m.FCaps)))
+		a.buffer.Write(m.FCaps)
+	}
+
+	if !a.SkipQuotaProjID && m.QuotaProjID != nil {
+		binary.Write(&a.buffer, binary.LittleEndian, PXAR_QUOTA_PROJID)
+		binary.Write(&a.buffer, binary.LittleEndian, uint64(16+8))
+		binary.Write(&a.buffer, binary.LittleEndian, *m.QuotaProjID)
 	}
 }
@@ -0,0 +1,539 @@
+package pbscommon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dchest/siphash"
+)
+
+// One item of a pxar archive as found by PXARDecoder
+type PXAREntry struct {
+	Path  string //Relative to archive root, slash separated, "" for the root directory
+	Name  string
+	Kind  byte   //Same letters as the catalog: 'd', 'f', 'l', 'h', 'b', 'c', 'p', 's'
+	Mode  uint64 //File type and permission bits
+	Flags uint64
+	UID   uint32
+	GID   uint32
+	MTime time.Time
+
+	Metadata PXARMetadata
+
+	Offset        uint64 //Position of the PXAR_FILENAME header, or of the entry for the root
+	Size          uint64 //Payload size of regular files
+	PayloadOffset uint64 //Position of the PXAR_PAYLOAD header, in the payload archive for split archives
+
+	LinkTarget     string //Symlink target, or hardlink target relative to archive root
+	HardlinkOffset uint64 //Position of the PXAR_FILENAME header of the hardlink target
+	DevMajor       uint64
+	DevMinor       uint64
+}
+
+// Reads pxar archives front to back with Next, parents are returned before their children,
+// or by path with Lookup and ReadDir, which search the goodbye tables instead of walking the archive.
+// For split archives the decoder is given the metadata archive, payloads are read from the payload archive
+type PXARDecoder struct {
+	r       io.ReaderAt
+	size    uint64
+	payload io.ReaderAt
+	pos     uint64
+	Version uint64 //1 for plain archives, PXAR_FORMAT_VERSION_2 once the format version entry was read
+	dirs    []string
+	started bool
+}
+
+func NewPXARDecoder(r io.ReaderAt, size uint64) *PXARDecoder {
+	return &PXARDecoder{
+		r:       r,
+		size:    size,
+		Version: 1,
+	}
+}
+
+// Decoder for a split archive, the payload archive is only needed to read file contents
+func NewSplitPXARDecoder(metadata io.ReaderAt, size uint64, payload io.ReaderAt) *PXARDecoder {
+	d := NewPXARDecoder(metadata, size)
+	d.payload = payload
+	return d
+}
+
+func (d *PXARDecoder) readHeader() (uint64, uint64, error) {
+	hdr := make([]byte, 16)
+	if _, err := d.r.ReadAt(hdr, int64(d.pos)); err != nil {
+		return 0, 0, fmt.Errorf("pxar: reading header at %d: %w", d.pos, err)
+	}
+	htype := binary.LittleEndian.Uint64(hdr[0:8])
+	hsize := binary.LittleEndian.Uint64(hdr[8:16])
+	if hsize < 16 || d.pos+hsize > d.size {
+		return 0, 0, fmt.Errorf("pxar: invalid header size %d at %d", hsize, d.pos)
+	}
+	return htype, hsize, nil
+}
+
+// Content of the item whose header is at the current position, position is moved past it
+func (d *PXARDecoder) readContent(hsize uint64) ([]byte, error) {
+	content := make([]byte, hsize-16)
+	if _, err := d.r.ReadAt(content, int64(d.pos+16)); err != nil {
+		return nil, fmt.Errorf("pxar: reading content at %d: %w", d.pos, err)
+	}
+	d.pos += hsize
+	return content, nil
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+// Returns io.EOF after the goodbye table of the root directory
+func (d *PXARDecoder) Next() (*PXAREntry, error) {
+	for {
+		if d.pos >= d.size || (d.started && len(d.dirs) == 0) {
+			return nil, io.EOF
+		}
+		htype, hsize, err := d.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		switch htype {
+		case PXAR_FORMAT_VERSION:
+			content, err := d.readContent(hsize)
+			if err != nil {
+				return nil, err
+			}
+			if len(content) < 8 {
+				return nil, fmt.Errorf("pxar: short format version entry")
+			}
+			d.Version = binary.LittleEndian.Uint64(content)
+			if d.Version != PXAR_FORMAT_VERSION_2 {
+				return nil, fmt.Errorf("pxar: unsupported format version %d", d.Version)
+			}
+		case PXAR_PRELUDE:
+			d.pos += hsize
+		case PXAR_ENTRY:
+			if d.started {
+				return nil, fmt.Errorf("pxar: unexpected entry at %d", d.pos)
+			}
+			d.started = true
+			e := &PXAREntry{Offset: d.pos}
+			return e, d.readEntry(e)
+		case PXAR_FILENAME:
+			if !d.started {
+				return nil, fmt.Errorf("pxar: filename before root entry at %d", d.pos)
+			}
+			e := &PXAREntry{Offset: d.pos}
+			content, err := d.readContent(hsize)
+			if err != nil {
+				return nil, err
+			}
+			e.Name = cString(content)
+			e.Path = e.Name
+			if parent := d.dirs[len(d.dirs)-1]; parent != "" {
+				e.Path = parent + "/" + e.Name
+			}
+			htype, hsize, err = d.readHeader()
+			if err != nil {
+				return nil, err
+			}
+			if htype == PXAR_HARDLINK {
+				content, err := d.readContent(hsize)
+				if err != nil {
+					return nil, err
+				}
+				if len(content) < 8 {
+					return nil, fmt.Errorf("pxar: short hardlink entry at %d", e.Offset)
+				}
+				e.Kind = 'h'
+				e.HardlinkOffset = e.Offset - binary.LittleEndian.Uint64(content)
+				e.LinkTarget = cString(content[8:])
+				return e, nil
+			}
+			return e, d.readEntry(e)
+		case PXAR_GOODBYE:
+			d.pos += hsize
+			d.dirs = d.dirs[:len(d.dirs)-1]
+		default:
+			return nil, fmt.Errorf("pxar: unexpected item %x at %d", htype, d.pos)
+		}
+	}
+}
+
+func entryKind(mode uint64) byte {
+	switch mode & IFMT {
+	case IFDIR:
+		return 'd'
+	case IFREG:
+		return 'f'
+	case IFLNK:
+		return 'l'
+	case IFBLK:
+		return 'b'
+	case IFCHR:
+		return 'c'
+	case IFIFO:
+		return 'p'
+	case IFSOCK:
+		return 's'
+	}
+	return 0
+}
+
+// Reads PXAR_ENTRY and the records belonging to it, stops in front of the next filename or goodbye table
+func (d *PXARDecoder) readEntry(e *PXAREntry) error {
+	htype, hsize, err := d.readHeader()
+	if err != nil {
+		return err
+	}
+	if htype != PXAR_ENTRY || hsize != 56 {
+		return fmt.Errorf("pxar: expected entry at %d", d.pos)
+	}
+	content, err := d.readContent(hsize)
+	if err != nil {
+		return err
+	}
+	e.Mode = binary.LittleEndian.Uint64(content[0:8])
+	e.Flags = binary.LittleEndian.Uint64(content[8:16])
+	e.UID = binary.LittleEndian.Uint32(content[16:20])
+	e.GID = binary.LittleEndian.Uint32(content[20:24])
+	e.MTime = time.Unix(int64(binary.LittleEndian.Uint64(content[24:32])), int64(binary.LittleEndian.Uint32(content[32:36])))
+	e.Kind = entryKind(e.Mode)
+	if e.Kind == 0 {
+		return fmt.Errorf("pxar: unknown file type %o at %d", e.Mode, e.Offset)
+	}
+
+	aclEntry := func(b []byte) PXARACLEntry {
+		return PXARACLEntry{
+			ID:          binary.LittleEndian.Uint64(b[0:8]),
+			Permissions: binary.LittleEndian.Uint64(b[8:16]),
+		}
+	}
+
+	for d.pos < d.size {
+		htype, hsize, err := d.readHeader()
+		if err != nil {
+			return err
+		}
+		if htype == PXAR_FILENAME || htype == PXAR_GOODBYE {
+			break
+		}
+		if htype == PXAR_PAYLOAD {
+			e.PayloadOffset = d.pos
+			e.Size = hsize - 16
+			d.pos += hsize
+			return nil
+		}
+		content, err := d.readContent(hsize)
+		if err != nil {
+			return err
+		}
+		switch htype {
+		case PXAR_XATTR:
+			name, value, _ := bytes.Cut(content, []byte{0})
+			e.Metadata.Xattrs = append(e.Metadata.Xattrs, PXARXattr{Name: string(name), Value: value})
+		case PXAR_ACL_USER, PXAR_ACL_GROUP, PXAR_ACL_DEFAULT_USER, PXAR_ACL_DEFAULT_GROUP:
+			if len(content) < 16 {
+				return fmt.Errorf("pxar: short acl entry at %d", d.pos-hsize)
+			}
+			switch htype {
+			case PXAR_ACL_USER:
+				e.Metadata.ACLUsers = append(e.Metadata.ACLUsers, aclEntry(content))
+			case PXAR_ACL_GROUP:
+				e.Metadata.ACLGroups = append(e.Metadata.ACLGroups, aclEntry(content))
+			case PXAR_ACL_DEFAULT_USER:
+				e.Metadata.ACLDefaultUsers = append(e.Metadata.ACLDefaultUsers, aclEntry(content))
+			case PXAR_ACL_DEFAULT_GROUP:
+				e.Metadata.ACLDefaultGroups = append(e.Metadata.ACLDefaultGroups, aclEntry(content))
+			}
+		case PXAR_ACL_GROUP_OBJ:
+			if len(content) < 8 {
+				return fmt.Errorf("pxar: short acl entry at %d", d.pos-hsize)
+			}
+			perm := binary.LittleEndian.Uint64(content)
+			e.Metadata.ACLGroupObj = &perm
+		case PXAR_ACL_DEFAULT:
+			if len(content) < 32 {
+				return fmt.Errorf("pxar: short default acl at %d", d.pos-hsize)
+			}
+			e.Metadata.ACLDefault = &PXARACLDefault{
+				UserObjPermissions:  binary.LittleEndian.Uint64(content[0:8]),
+				GroupObjPermissions: binary.LittleEndian.Uint64(content[8:16]),
+				OtherPermissions:    binary.LittleEndian.Uint64(content[16:24]),
+				MaskPermissions:     binary.LittleEndian.Uint64(content[24:32]),
+			}
+		case PXAR_FCAPS:
+			e.Metadata.FCaps = content
+		case PXAR_QUOTA_PROJID:
+			if len(content) < 8 {
+				return fmt.Errorf("pxar: short quota project id at %d", d.pos-hsize)
+			}
+			projid := binary.LittleEndian.Uint64(content)
+			e.Metadata.QuotaProjID = &projid
+		case PXAR_PAYLOAD_REF:
+			if len(content) < 16 {
+				return fmt.Errorf("pxar: short payload reference at %d", d.pos-hsize)
+			}
+			e.PayloadOffset = binary.LittleEndian.Uint64(content[0:8])
+			e.Size = binary.LittleEndian.Uint64(content[8:16])
+			return nil
+		case PXAR_SYMLINK:
+			e.LinkTarget = cString(content)
+			return nil
+		case PXAR_DEVICE:
+			if len(content) < 16 {
+				return fmt.Errorf("pxar: short device entry at %d", d.pos-hsize)
+			}
+			e.DevMajor = binary.LittleEndian.Uint64(content[0:8])
+			e.DevMinor = binary.LittleEndian.Uint64(content[8:16])
+			return nil
+		default:
+			return fmt.Errorf("pxar: unexpected item %x at %d", htype, d.pos-hsize)
+		}
+	}
+
+	if e.Kind == 'd' {
+		d.dirs = append(d.dirs, e.Path)
+	}
+	return nil
+}
+
+// Content of a regular file, hardlinks have to be resolved first
+func (d *PXARDecoder) OpenPayload(e *PXAREntry) (*io.SectionReader, error) {
+	if e.Kind != 'f' {
+		return nil, fmt.Errorf("pxar: %s is not a regular file", e.Path)
+	}
+	r := d.r
+	if d.Version == PXAR_FORMAT_VERSION_2 {
+		if d.payload == nil {
+			return nil, fmt.Errorf("pxar: %s: payload archive not available", e.Path)
+		}
+		r = d.payload
+	}
+	hdr := make([]byte, 16)
+	if _, err := r.ReadAt(hdr, int64(e.PayloadOffset)); err != nil {
+		return nil, fmt.Errorf("pxar: reading payload of %s: %w", e.Path, err)
+	}
+	if binary.LittleEndian.Uint64(hdr[0:8]) != PXAR_PAYLOAD || binary.LittleEndian.Uint64(hdr[8:16]) != e.Size+16 {
+		return nil, fmt.Errorf("pxar: invalid payload header for %s at %d", e.Path, e.PayloadOffset)
+	}
+	return io.NewSectionReader(r, int64(e.PayloadOffset+16), int64(e.Size)), nil
+}
+
+// Decodes the single item at offset, parent is the path of the directory holding it
+func (d *PXARDecoder) decodeAt(offset uint64, parent string) (*PXAREntry, error) {
+	sub := &PXARDecoder{
+		r:       d.r,
+		size:    d.size,
+		payload: d.payload,
+		pos:     offset,
+		Version: d.Version,
+		dirs:    []string{parent},
+		started: offset != 0,
+	}
+	e, err := sub.Next()
+	if err == io.EOF {
+		err = fmt.Errorf("pxar: no entry at %d", offset)
+	}
+	if offset == 0 {
+		d.Version = sub.Version
+	}
+	return e, err
+}
+
+// Root directory entry, reading it also detects the format version
+func (d *PXARDecoder) Root() (*PXAREntry, error) {
+	return d.decodeAt(0, "")
+}
+
+// Goodbye table of the directory whose item ends at end, item offsets are relative to the table start
+func (d *PXARDecoder) readGoodbye(end uint64) (uint64, []GoodByeItem, error) {
+	if end < 16+24 || end > d.size {
+		return 0, nil, fmt.Errorf("pxar: invalid directory end %d", end)
+	}
+	tail := make([]byte, 24)
+	if _, err := d.r.ReadAt(tail, int64(end-24)); err != nil {
+		return 0, nil, fmt.Errorf("pxar: reading goodbye tail at %d: %w", end-24, err)
+	}
+	tablelen := binary.LittleEndian.Uint64(tail[16:24])
+	if binary.LittleEndian.Uint64(tail[0:8]) != PXAR_GOODBYE_TAIL_MARKER || tablelen < 16+24 || tablelen > end || (tablelen-16)%24 != 0 {
+		return 0, nil, fmt.Errorf("pxar: invalid goodbye table ending at %d", end)
+	}
+	start := end - tablelen
+	data := make([]byte, tablelen-16-24)
+	if _, err := d.r.ReadAt(data, int64(start+16)); err != nil {
+		return 0, nil, fmt.Errorf("pxar: reading goodbye table at %d: %w", start, err)
+	}
+	items := make([]GoodByeItem, len(data)/24)
+	for i := range items {
+		items[i] = GoodByeItem{
+			hash:   binary.LittleEndian.Uint64(data[i*24 : i*24+8]),
+			offset: binary.LittleEndian.Uint64(data[i*24+8 : i*24+16]),
+			len:    binary.LittleEndian.Uint64(data[i*24+16 : i*24+24]),
+		}
+	}
+	return start, items, nil
+}
+
+// Items are laid out as a binary search tree in an array, children of i are 2i+1 and 2i+2.
+// Equal hashes may end up in both subtrees, so on a collision the search goes on in both
+func goodbyeSearch(items []GoodByeItem, i int, hash uint64, visit func(GoodByeItem) bool) bool {
+	if i >= len(items) {
+		return false
+	}
+	if hash < items[i].hash {
+		return goodbyeSearch(items, 2*i+1, hash, visit)
+	}
+	if hash > items[i].hash {
+		return goodbyeSearch(items, 2*i+2, hash, visit)
+	}
+	return visit(items[i]) || goodbyeSearch(items, 2*i+1, hash, visit) || goodbyeSearch(items, 2*i+2, hash, visit)
+}
+
+// Entry at path and the end of its item, which for directories is the end of their goodbye table
+func (d *PXARDecoder) lookup(p string) (*PXAREntry, uint64, error) {
+	e, err := d.Root()
+	if err != nil {
+		return nil, 0, err
+	}
+	end := d.size
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return e, end, nil
+	}
+
+	for _, name := range strings.Split(p, "/") {
+		if e.Kind != 'd' {
+			return nil, 0, fmt.Errorf("pxar: %s: %w", p, fs.ErrNotExist)
+		}
+		start, items, err := d.readGoodbye(end)
+		if err != nil {
+			return nil, 0, err
+		}
+		var found *PXAREntry
+		hash := siphash.Hash(0x83ac3f1cfbb450db, 0xaa4f1b6879369fbd, []byte(name))
+		goodbyeSearch(items, 0, hash, func(item GoodByeItem) bool {
+			child, cerr := d.decodeAt(start-item.offset, e.Path)
+			if cerr != nil {
+				err = cerr
+				return true
+			}
+			if child.Name != name {
+				return false
+			}
+			found = child
+			end = start - item.offset + item.len
+			return true
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		if found == nil {
+			return nil, 0, fmt.Errorf("pxar: %s: %w", p, fs.ErrNotExist)
+		}
+		e = found
+	}
+	return e, end, nil
+}
+
+// Random access by path relative to archive root, missing paths give an error wrapping fs.ErrNotExist
+func (d *PXARDecoder) Lookup(p string) (*PXAREntry, error) {
+	e, _, err := d.lookup(p)
+	return e, err
+}
+
+// Decoder returning only the entry at path and, for directories, everything below it.
+// Entry paths stay relative to archive root
+func (d *PXARDecoder) Subtree(p string) (*PXARDecoder, error) {
+	e, end, err := d.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if e.Path == "" {
+		return &PXARDecoder{r: d.r, size: d.size, payload: d.payload, Version: d.Version}, nil
+	}
+	parent := ""
+	if i := strings.LastIndex(e.Path, "/"); i >= 0 {
+		parent = e.Path[:i]
+	}
+	return &PXARDecoder{
+		r:       d.r,
+		size:    end,
+		payload: d.payload,
+		pos:     e.Offset,
+		Version: d.Version,
+		dirs:    []string{parent},
+		started: true,
+	}, nil
+}
+
+// Entries of a directory sorted by name
+func (d *PXARDecoder) ReadDir(p string) ([]*PXAREntry, error) {
+	dir, end, err := d.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if dir.Kind != 'd' {
+		return nil, fmt.Errorf("pxar: %s is not a directory", dir.Path)
+	}
+	start, items, err := d.readGoodbye(end)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*PXAREntry, 0, len(items))
+	for _, item := range items {
+		e, err := d.decodeAt(start-item.offset, dir.Path)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, e)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// Relative, slash separated and without empty, "." or ".." components
+func validArchivePath(p string) bool {
+	if p == "" {
+		return false
+	}
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." || name == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Entry a hardlink points to, the original always comes first in the archive
+func (d *PXARDecoder) ResolveHardlink(e *PXAREntry) (*PXAREntry, error) {
+	if e.Kind != 'h' {
+		return e, nil
+	}
+	//The target path only names the parent of the target, it must stay inside the archive
+	if !validArchivePath(e.LinkTarget) {
+		return nil, fmt.Errorf("pxar: hardlink %s has invalid target %q", e.Path, e.LinkTarget)
+	}
+	parent := ""
+	if i := strings.LastIndex(e.LinkTarget, "/"); i >= 0 {
+		parent = e.LinkTarget[:i]
+	}
+	target, err := d.decodeAt(e.HardlinkOffset, parent)
+	if err != nil {
+		return nil, err
+	}
+	if target.Kind != 'f' {
+		return nil, fmt.Errorf("pxar: hardlink %s points to %s which is not a regular file", e.Path, target.Path)
+	}
+	return target, nil
+}
@@ -0,0 +1,323 @@
+//go:build linux
+// +build linux
+
+package pbscommon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+)
+
+// Tree with one entry of every kind the writer produces without root privileges
+func makeDecoderTestTree(t *testing.T) (string, bool) {
+	root := t.TempDir()
+	write := func(name string, data string) {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, "dir", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write("file.txt", "hello world")
+	write("empty", "")
+	write("dir/sub/nested.txt", "nested content")
+	if err := os.Symlink("file.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "file.txt"), filepath.Join(root, "hard")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(root, "fifo"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	//Not every file system used for temporary directories takes user xattrs
+	xattrs := syscall.Setxattr(filepath.Join(root, "file.txt"), "user.pxartest", []byte("value"), 0) == nil
+	return root, xattrs
+}
+
+// Archive of root as plain archive, or as metadata and payload archive when split is set
+func writeDecoderTestArchive(t *testing.T, root string, split bool) *PXARDecoder {
+	var archive, payload, catalog bytes.Buffer
+	a := &PXARArchive{
+		ArchiveName:    "test.pxar.didx",
+		WriteCB:        func(b []byte) { archive.Write(b) },
+		CatalogWriteCB: func(b []byte) { catalog.Write(b) },
+	}
+	if split {
+		a.ArchiveName = "test.mpxar.didx"
+		a.PayloadWriteCB = func(b []byte) { payload.Write(b) }
+	}
+	a.WriteDir(root, "", true)
+	if len(a.Warnings) > 0 {
+		t.Fatalf("warnings writing archive: %v", a.Warnings)
+	}
+	if split {
+		return NewSplitPXARDecoder(bytes.NewReader(archive.Bytes()), uint64(archive.Len()), bytes.NewReader(payload.Bytes()))
+	}
+	return NewPXARDecoder(bytes.NewReader(archive.Bytes()), uint64(archive.Len()))
+}
+
+func TestPXARDecoderRoundTrip(t *testing.T) {
+	root, xattrs := makeDecoderTestTree(t)
+
+	for _, split := range []bool{false, true} {
+		name := "plain"
+		if split {
+			name = "split"
+		}
+		t.Run(name, func(t *testing.T) {
+			testDecoderSequential(t, writeDecoderTestArchive(t, root, split), root, xattrs)
+			testDecoderRandomAccess(t, writeDecoderTestArchive(t, root, split))
+		})
+	}
+}
+
+func testDecoderSequential(t *testing.T, d *PXARDecoder, root string, xattrs bool) {
+	want := []struct {
+		path string
+		kind byte
+	}{
+		{"", 'd'},
+		{"dir", 'd'},
+		{"dir/sub", 'd'},
+		{"dir/sub/nested.txt", 'f'},
+		{"empty", 'f'},
+		{"fifo", 'p'},
+		{"file.txt", 'f'},
+		{"hard", 'h'},
+		{"link", 'l'},
+	}
+
+	entries := make([]*PXAREntry, 0)
+	for {
+		e, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(want))
+	}
+
+	for i, e := range entries {
+		if e.Path != want[i].path || e.Kind != want[i].kind {
+			t.Fatalf("entry %d is %q kind %c, want %q kind %c", i, e.Path, e.Kind, want[i].path, want[i].kind)
+		}
+		if e.Path != "" && e.Name != filepath.Base(e.Path) {
+			t.Errorf("%s: name %q", e.Path, e.Name)
+		}
+		if e.Kind == 'h' {
+			if e.LinkTarget != "file.txt" {
+				t.Errorf("hardlink target %q, want file.txt", e.LinkTarget)
+			}
+			continue
+		}
+
+		fileInfo, err := os.Lstat(filepath.Join(root, filepath.FromSlash(e.Path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := fileInfo.Sys().(*syscall.Stat_t)
+		if e.Mode != uint64(st.Mode) {
+			t.Errorf("%s: mode %o, want %o", e.Path, e.Mode, st.Mode)
+		}
+		if e.UID != st.Uid || e.GID != st.Gid {
+			t.Errorf("%s: owner %d:%d, want %d:%d", e.Path, e.UID, e.GID, st.Uid, st.Gid)
+		}
+		if !e.MTime.Equal(fileInfo.ModTime()) {
+			t.Errorf("%s: mtime %v, want %v", e.Path, e.MTime, fileInfo.ModTime())
+		}
+		if e.Kind == 'f' && e.Size != uint64(fileInfo.Size()) {
+			t.Errorf("%s: size %d, want %d", e.Path, e.Size, fileInfo.Size())
+		}
+		if e.Kind == 'l' && e.LinkTarget != "file.txt" {
+			t.Errorf("symlink target %q, want file.txt", e.LinkTarget)
+		}
+	}
+
+	if xattrs {
+		file := entries[6]
+		if !slices.ContainsFunc(file.Metadata.Xattrs, func(x PXARXattr) bool {
+			return x.Name == "user.pxartest" && string(x.Value) == "value"
+		}) {
+			t.Errorf("file.txt: xattr missing, got %v", file.Metadata.Xattrs)
+		}
+	}
+}
+
+func testDecoderRandomAccess(t *testing.T, d *PXARDecoder) {
+	payloads := map[string]string{
+		"file.txt":           "hello world",
+		"empty":              "",
+		"dir/sub/nested.txt": "nested content",
+	}
+	kinds := map[string]byte{
+		"":                   'd',
+		"dir":                'd',
+		"dir/sub":            'd',
+		"dir/sub/nested.txt": 'f',
+		"empty":              'f',
+		"fifo":               'p',
+		"file.txt":           'f',
+		"hard":               'h',
+		"link":               'l',
+	}
+	dirs := map[string][]string{
+		"":        {"dir", "empty", "fifo", "file.txt", "hard", "link"},
+		"dir":     {"sub"},
+		"dir/sub": {"nested.txt"},
+	}
+
+	for p, kind := range kinds {
+		e, err := d.Lookup(p)
+		if err != nil {
+			t.Fatalf("lookup %q: %v", p, err)
+		}
+		if e.Path != p || e.Kind != kind {
+			t.Errorf("lookup %q gave %q kind %c, want kind %c", p, e.Path, e.Kind, kind)
+		}
+		if data, ok := payloads[p]; ok {
+			r, err := d.OpenPayload(e)
+			if err != nil {
+				t.Fatalf("payload %q: %v", p, err)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil || string(b) != data {
+				t.Errorf("payload %q is %q (%v), want %q", p, b, err, data)
+			}
+		}
+
+		children, err := d.ReadDir(p)
+		if kind != 'd' {
+			if err == nil {
+				t.Errorf("readdir %q of kind %c did not fail", p, kind)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("readdir %q: %v", p, err)
+		}
+		names := make([]string, 0, len(children))
+		for _, c := range children {
+			names = append(names, c.Name)
+			if c.Kind != kinds[c.Path] {
+				t.Errorf("readdir %q: %q kind %c, want %c", p, c.Path, c.Kind, kinds[c.Path])
+			}
+		}
+		if !slices.Equal(names, dirs[p]) {
+			t.Errorf("readdir %q gave %v, want %v", p, names, dirs[p])
+		}
+	}
+
+	for _, p := range []string{"missing", "dir/missing", "dir/sub/nested.txt/below", "file.txt/below"} {
+		if _, err := d.Lookup(p); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("lookup %q: got %v, want fs.ErrNotExist", p, err)
+		}
+	}
+	if _, err := d.ReadDir("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("readdir of missing directory: got %v, want fs.ErrNotExist", err)
+	}
+
+	hard, err := d.Lookup("hard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := d.ResolveHardlink(hard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Path != "file.txt" || target.Kind != 'f' {
+		t.Fatalf("hardlink resolves to %q kind %c", target.Path, target.Kind)
+	}
+	r, err := d.OpenPayload(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); string(b) != "hello world" {
+		t.Errorf("hardlink payload %q", b)
+	}
+	if _, err := d.OpenPayload(hard); err == nil {
+		t.Error("payload of unresolved hardlink did not fail")
+	}
+}
+
+func TestPXARDecoderHardlinkOutsideArchive(t *testing.T) {
+	root, _ := makeDecoderTestTree(t)
+	var archive bytes.Buffer
+	a := &PXARArchive{
+		ArchiveName:    "test.pxar.didx",
+		WriteCB:        func(b []byte) { archive.Write(b) },
+		CatalogWriteCB: func(b []byte) {},
+	}
+	a.WriteDir(root, "", true)
+
+	//Same length as file.txt, so only the stored target changes
+	data := archive.Bytes()
+	i := bytes.Index(data, []byte("file.txt\x00"))
+	for i >= 0 && (i < 32 || binary.LittleEndian.Uint64(data[i-24:i-16]) != PXAR_HARDLINK) {
+		next := bytes.Index(data[i+1:], []byte("file.txt\x00"))
+		if next < 0 {
+			t.Fatal("hardlink record not found")
+		}
+		i += 1 + next
+	}
+	copy(data[i:], "../a.txt")
+
+	d := NewPXARDecoder(bytes.NewReader(data), uint64(len(data)))
+	hard, err := d.Lookup("hard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := d.ResolveHardlink(hard); err == nil {
+		t.Fatalf("hardlink to %q resolved to %q", hard.LinkTarget, target.Path)
+	}
+}
+
+func TestPXARSymlinkXattrs(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "target"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(root, "link")
+	if err := os.Symlink("target", link); err != nil {
+		t.Fatal(err)
+	}
+	//user xattrs are not allowed on symlinks, trusted ones need CAP_SYS_ADMIN
+	if err := lsetxattr(link, "trusted.pxartest", []byte("link"), 0); err != nil {
+		t.Skipf("cannot set xattrs on symlinks: %v", err)
+	}
+
+	d := writeDecoderTestArchive(t, root, false)
+	for _, tt := range []struct {
+		path string
+		want []PXARXattr
+	}{
+		{"link", []PXARXattr{{Name: "trusted.pxartest", Value: []byte("link")}}},
+		{"target", nil},
+	} {
+		e, err := d.Lookup(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(e.Metadata.Xattrs) != len(tt.want) || (len(tt.want) > 0 && (e.Metadata.Xattrs[0].Name != tt.want[0].Name ||
+			!bytes.Equal(e.Metadata.Xattrs[0].Value, tt.want[0].Value))) {
+			t.Errorf("%s: xattrs %v, want %v", tt.path, e.Metadata.Xattrs, tt.want)
+		}
+		if tt.path == "link" && e.LinkTarget != "target" {
+			t.Errorf("link target %q", e.LinkTarget)
+		}
+	}
+}
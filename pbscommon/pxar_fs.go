@@ -0,0 +1,340 @@
+package pbscommon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Read only io/fs view of a pxar archive, so fs.WalkDir, http.FileServer or io.Copy work on backups.
+// Open and Stat follow symlinks whose target stays inside the archive, Lstat and ReadLink do not follow
+// a final symlink but, like all methods, the ones in directory components of the name.
+// Hardlinks are seen as the file they point to. Contents are read through the decoder ReaderAt,
+// for a snapshot that is a DynamicIndexReader downloading chunks on demand
+type PXARFS struct {
+	decoder *PXARDecoder
+	//Lookups share the decoder, payload reads go straight to the ReaderAt which has its own locking
+	lock sync.Mutex
+}
+
+func NewPXARFS(decoder *PXARDecoder) (*PXARFS, error) {
+	//Reading the root once detects the format version, later lookups do not change the decoder anymore
+	if _, err := decoder.Root(); err != nil {
+		return nil, err
+	}
+	return &PXARFS{decoder: decoder}, nil
+}
+
+// Name of an archive without index and format suffix, backup for backup.pxar.didx or backup.mpxar.didx
+func PXARArchiveBase(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, ".didx"), ".pxar"), ".mpxar")
+}
+
+// Opens archive name, e.g. backup, of snapshot m, which the reader session of client is opened on.
+// Split archives are read from name.mpxar.didx and name.ppxar.didx, the others from name.pxar.didx
+func OpenSnapshotArchive(client *PBSClient, m *BackupManifest, name string) (*PXARDecoder, error) {
+	base := PXARArchiveBase(name)
+	if m.HasFile(base + ".mpxar.didx") {
+		metadata, err := OpenDynamicIndexReader(client, base+".mpxar.didx")
+		if err != nil {
+			return nil, err
+		}
+		payload, err := OpenDynamicIndexReader(client, base+".ppxar.didx")
+		if err != nil {
+			return nil, err
+		}
+		return NewSplitPXARDecoder(metadata, uint64(metadata.Size()), payload), nil
+	}
+	if !m.HasFile(base + ".pxar.didx") {
+		return nil, fmt.Errorf("snapshot %s/%s/%s has no archive %s", m.BackupType, m.BackupID, time.Unix(m.BackupTime, 0).UTC().Format(time.RFC3339), base)
+	}
+	archive, err := OpenDynamicIndexReader(client, base+".pxar.didx")
+	if err != nil {
+		return nil, err
+	}
+	return NewPXARDecoder(archive, uint64(archive.Size())), nil
+}
+
+// Mode with the type bits io/fs uses
+func (e *PXAREntry) FileMode() fs.FileMode {
+	ret := fs.FileMode(e.Mode & 0o777)
+	if e.Mode&ISUID != 0 {
+		ret |= fs.ModeSetuid
+	}
+	if e.Mode&ISGID != 0 {
+		ret |= fs.ModeSetgid
+	}
+	if e.Mode&ISVTX != 0 {
+		ret |= fs.ModeSticky
+	}
+	switch e.Kind {
+	case 'd':
+		ret |= fs.ModeDir
+	case 'l':
+		ret |= fs.ModeSymlink
+	case 'b':
+		ret |= fs.ModeDevice
+	case 'c':
+		ret |= fs.ModeDevice | fs.ModeCharDevice
+	case 'p':
+		ret |= fs.ModeNamedPipe
+	case 's':
+		ret |= fs.ModeSocket
+	}
+	return ret
+}
+
+// fs.FileInfo and fs.DirEntry of an entry, Sys returns the *PXAREntry
+type pxarFileInfo struct {
+	name  string
+	entry *PXAREntry
+}
+
+func (i *pxarFileInfo) Name() string               { return i.name }
+func (i *pxarFileInfo) Size() int64                { return int64(i.entry.Size) }
+func (i *pxarFileInfo) Mode() fs.FileMode          { return i.entry.FileMode() }
+func (i *pxarFileInfo) ModTime() time.Time         { return i.entry.MTime }
+func (i *pxarFileInfo) IsDir() bool                { return i.entry.Kind == 'd' }
+func (i *pxarFileInfo) Sys() any                   { return i.entry }
+func (i *pxarFileInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i *pxarFileInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+func (f *PXARFS) pathError(op string, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Entry at the symlink free path p, hardlinks are resolved
+func (f *PXARFS) lookup(op string, name string, p string) (*PXAREntry, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	e, err := f.decoder.Lookup(p)
+	if err == nil {
+		e, err = f.decoder.ResolveHardlink(e)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, f.pathError(op, name, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, f.pathError(op, name, err)
+	}
+	return e, nil
+}
+
+// Walks name component by component like the kernel does, symlinks in directory components are
+// always followed, a final one only with follow. Only relative targets are followed as absolute
+// ones refer to the machine the backup was made on
+func (f *PXARFS) resolve(op string, name string, follow bool) (*PXAREntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, f.pathError(op, name, fs.ErrInvalid)
+	}
+	rest := []string{}
+	if name != "." {
+		rest = strings.Split(name, "/")
+	}
+	dir := "" //Resolved directory of the next component, "" for the root
+	var e *PXAREntry
+	links := 0
+	for len(rest) > 0 {
+		p := path.Join(dir, rest[0])
+		rest = rest[1:]
+		var err error
+		e, err = f.lookup(op, name, p)
+		if err != nil {
+			return nil, err
+		}
+		if e.Kind != 'l' || (len(rest) == 0 && !follow) {
+			dir = p
+			continue
+		}
+		links++
+		if links > 40 {
+			return nil, f.pathError(op, name, fmt.Errorf("too many levels of symbolic links"))
+		}
+		if path.IsAbs(e.LinkTarget) {
+			return nil, f.pathError(op, name, fmt.Errorf("absolute symlink target %s: %w", e.LinkTarget, fs.ErrNotExist))
+		}
+		target := path.Join(dir, e.LinkTarget)
+		if !fs.ValidPath(target) {
+			return nil, f.pathError(op, name, fmt.Errorf("symlink target %s outside of archive: %w", e.LinkTarget, fs.ErrNotExist))
+		}
+		dir, e = "", nil
+		if target != "." {
+			rest = append(strings.Split(target, "/"), rest...)
+		}
+	}
+	if e == nil {
+		return f.lookup(op, name, dir)
+	}
+	return e, nil
+}
+
+// Entry at name without following a final symlink
+func (f *PXARFS) lstat(op string, name string) (*PXAREntry, error) {
+	return f.resolve(op, name, false)
+}
+
+// Entry at name with all symlinks followed
+func (f *PXARFS) stat(op string, name string) (*PXAREntry, error) {
+	return f.resolve(op, name, true)
+}
+
+func (f *PXARFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := f.stat("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return &pxarFileInfo{name: path.Base(name), entry: e}, nil
+}
+
+func (f *PXARFS) Lstat(name string) (fs.FileInfo, error) {
+	e, err := f.lstat("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return &pxarFileInfo{name: path.Base(name), entry: e}, nil
+}
+
+func (f *PXARFS) ReadLink(name string) (string, error) {
+	e, err := f.lstat("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if e.Kind != 'l' {
+		return "", f.pathError("readlink", name, fs.ErrInvalid)
+	}
+	return e.LinkTarget, nil
+}
+
+// Entries sorted by name, like os.ReadDir
+func (f *PXARFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	dir, err := f.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if dir.Kind != 'd' {
+		return nil, f.pathError("readdir", name, fmt.Errorf("not a directory"))
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	entries, err := f.decoder.ReadDir(dir.Path)
+	if err != nil {
+		return nil, f.pathError("readdir", name, err)
+	}
+	ret := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		target, err := f.decoder.ResolveHardlink(e)
+		if err != nil {
+			return nil, f.pathError("readdir", name, err)
+		}
+		ret = append(ret, &pxarFileInfo{name: e.Name, entry: target})
+	}
+	return ret, nil
+}
+
+// Decoder walking the entry at name, symlinks followed, and everything below it with Next.
+// The returned decoder is independent of the file system and can be used concurrently with it
+func (f *PXARFS) Subtree(name string) (*PXARDecoder, error) {
+	e, err := f.stat("subtree", name)
+	if err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	sub, err := f.decoder.Subtree(e.Path)
+	if err != nil {
+		return nil, f.pathError("subtree", name, err)
+	}
+	return sub, nil
+}
+
+func (f *PXARFS) Open(name string) (fs.File, error) {
+	e, err := f.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file := &PXARFile{fs: f, name: name, info: &pxarFileInfo{name: path.Base(name), entry: e}}
+	switch e.Kind {
+	case 'f':
+		f.lock.Lock()
+		file.payload, err = f.decoder.OpenPayload(e)
+		f.lock.Unlock()
+		if err != nil {
+			return nil, f.pathError("open", name, err)
+		}
+	case 'd':
+	default:
+		//Devices, fifos and sockets have no content in the archive, they read as empty files
+		file.payload = io.NewSectionReader(strings.NewReader(""), 0, 0)
+	}
+	return file, nil
+}
+
+// Open file of a PXARFS, regular files implement io.ReaderAt and io.Seeker, directories fs.ReadDirFile
+type PXARFile struct {
+	fs      *PXARFS
+	name    string
+	info    *pxarFileInfo
+	payload *io.SectionReader
+	entries []fs.DirEntry //Directories only, filled by the first ReadDir
+	listed  bool
+}
+
+func (f *PXARFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *PXARFile) Close() error {
+	return nil
+}
+
+func (f *PXARFile) Read(b []byte) (int, error) {
+	if f.payload == nil {
+		return 0, f.fs.pathError("read", f.name, fmt.Errorf("is a directory"))
+	}
+	return f.payload.Read(b)
+}
+
+func (f *PXARFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.payload == nil {
+		return 0, f.fs.pathError("read", f.name, fmt.Errorf("is a directory"))
+	}
+	return f.payload.ReadAt(b, off)
+}
+
+func (f *PXARFile) Seek(offset int64, whence int) (int64, error) {
+	if f.payload == nil {
+		return 0, f.fs.pathError("seek", f.name, fmt.Errorf("is a directory"))
+	}
+	return f.payload.Seek(offset, whence)
+}
+
+// Follows the fs.ReadDirFile contract: n > 0 returns at most n entries and io.EOF at the end
+func (f *PXARFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.info.entry.Kind != 'd' {
+		return nil, f.fs.pathError("readdir", f.name, fmt.Errorf("not a directory"))
+	}
+	if !f.listed {
+		entries, err := f.fs.ReadDir(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.entries, f.listed = entries, true
+	}
+	if n <= 0 {
+		ret := f.entries
+		f.entries = nil
+		return ret, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(f.entries))
+	ret := f.entries[:n]
+	f.entries = f.entries[n:]
+	return ret, nil
+}
@@ -0,0 +1,106 @@
+//go:build linux
+// +build linux
+
+package pbscommon
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPXARFSSymlinks(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a/b", "c"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "a", "b", "f"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"link":       "a",
+		"c/up":       "../a/b",
+		"c/chain":    "up",
+		"a/b/flink":  "f",
+		"a/b/self":   ".",
+		"c/top":      "..",
+		"c/outside":  "../../x",
+		"c/absolute": "/etc",
+		"loop":       "loop",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := NewPXARFS(writeDecoderTestArchive(t, root, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		stat  fs.FileMode //Type after following every symlink, ModeIrregular for an error
+		lstat fs.FileMode //Type with a final symlink not followed
+	}{
+		{"link", fs.ModeDir, fs.ModeSymlink},
+		{"link/b/f", 0, 0},
+		{"link/b/flink", 0, fs.ModeSymlink},
+		{"c/up/f", 0, 0},
+		{"c/chain/f", 0, 0},
+		{"c/chain/flink", 0, fs.ModeSymlink},
+		{"a/b/self/self/f", 0, 0},
+		{"c/top/link/b/f", 0, 0},
+		{"c/top", fs.ModeDir, fs.ModeSymlink},
+		{"c/outside/f", fs.ModeIrregular, fs.ModeIrregular},
+		{"c/absolute/passwd", fs.ModeIrregular, fs.ModeIrregular},
+		{"c/outside", fs.ModeIrregular, fs.ModeSymlink},
+		{"loop", fs.ModeIrregular, fs.ModeSymlink},
+		{"loop/f", fs.ModeIrregular, fs.ModeIrregular},
+		{"link/missing", fs.ModeIrregular, fs.ModeIrregular},
+		{"a/b/f/x", fs.ModeIrregular, fs.ModeIrregular},
+	}
+	check := func(op string, info fs.FileInfo, err error, name string, want fs.FileMode) {
+		if want == fs.ModeIrregular {
+			if err == nil {
+				t.Errorf("%s %s succeeded, want an error", op, name)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", op, name, err)
+			return
+		}
+		if info.Mode().Type() != want {
+			t.Errorf("%s %s is %v, want %v", op, name, info.Mode().Type(), want)
+		}
+		if info.Name() != filepath.Base(name) {
+			t.Errorf("%s %s is named %s", op, name, info.Name())
+		}
+	}
+	for _, tt := range tests {
+		info, err := f.Stat(tt.name)
+		check("stat", info, err, tt.name, tt.stat)
+		info, err = f.Lstat(tt.name)
+		check("lstat", info, err, tt.name, tt.lstat)
+	}
+
+	data, err := fs.ReadFile(f, "c/chain/flink")
+	if err != nil || string(data) != "content" {
+		t.Errorf("reading through symlinks = %q %v", data, err)
+	}
+	entries, err := fs.ReadDir(f, "c/top/link/b")
+	if err != nil || len(entries) != 3 {
+		t.Errorf("listing through symlinks = %d entries %v", len(entries), err)
+	}
+	if target, err := f.ReadLink("link/b/flink"); err != nil || target != "f" {
+		t.Errorf("readlink through symlinks = %q %v", target, err)
+	}
+	if _, err := f.Stat("link/../a"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("unclean name gives %v, want %v", err, fs.ErrInvalid)
+	}
+}
@@ -0,0 +1,341 @@
+//go:build linux
+// +build linux
+
+package pbscommon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Tags of the kernel posix_acl_xattr format, see <linux/posix_acl_xattr.h>
+const (
+	acl_xattr_version uint32 = 2
+
+	acl_user_obj  uint16 = 0x01
+	acl_user      uint16 = 0x02
+	acl_group_obj uint16 = 0x04
+	acl_group     uint16 = 0x08
+	acl_mask      uint16 = 0x10
+	acl_other     uint16 = 0x20
+
+	acl_undefined_id uint32 = 0xffffffff
+)
+
+const fs_ioc_fsgetxattr = 0x801c581f
+
+type aclXattrEntry struct {
+	Tag  uint16
+	Perm uint16
+	ID   uint32
+}
+
+type fsxattr struct {
+	XFlags     uint32
+	ExtSize    uint32
+	NExtents   uint32
+	ProjID     uint32
+	CowExtSize uint32
+	Pad        [8]byte
+}
+
+func readMetadata(path string, fileInfo os.FileInfo, a *PXARArchive) PXARMetadata {
+	m := PXARMetadata{}
+
+	for _, name := range listXattrs(path) {
+		switch {
+		case name == "system.posix_acl_access":
+			if !a.SkipACLs {
+				parseAccessACL(getXattr(path, name), &m)
+			}
+		case name == "system.posix_acl_default":
+			if !a.SkipACLs && fileInfo.IsDir() {
+				parseDefaultACL(getXattr(path, name), &m)
+			}
+		case name == "security.capability":
+			if !a.SkipFCaps {
+				m.FCaps = getXattr(path, name)
+			}
+		case strings.HasPrefix(name, "user.") || strings.HasPrefix(name, "trusted.") || strings.HasPrefix(name, "security."):
+			if !a.SkipXattrs {
+				if value := getXattr(path, name); value != nil {
+					m.Xattrs = append(m.Xattrs, PXARXattr{Name: name, Value: value})
+				}
+			}
+		}
+	}
+
+	sort.Slice(m.Xattrs, func(i, j int) bool {
+		return m.Xattrs[i].Name < m.Xattrs[j].Name
+	})
+
+	if !a.SkipQuotaProjID && (fileInfo.Mode().IsRegular() || fileInfo.IsDir()) {
+		m.QuotaProjID = quotaProjID(path)
+	}
+
+	return m
+}
+
+// The syscall package only has the variants following symlinks, a symlink has its own xattrs
+func xattrSyscall(trap uintptr, path string, name string, buf []byte, flags int) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var n *byte
+	if name != "" {
+		if n, err = syscall.BytePtrFromString(name); err != nil {
+			return 0, err
+		}
+	}
+	var b unsafe.Pointer
+	if len(buf) > 0 {
+		b = unsafe.Pointer(&buf[0])
+	}
+	var r uintptr
+	var errno syscall.Errno
+	if trap == syscall.SYS_LLISTXATTR {
+		r, _, errno = syscall.Syscall(trap, uintptr(unsafe.Pointer(p)), uintptr(b), uintptr(len(buf)))
+	} else {
+		r, _, errno = syscall.Syscall6(trap, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), uintptr(b), uintptr(len(buf)), uintptr(flags), 0)
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+func llistxattr(path string, buf []byte) (int, error) {
+	return xattrSyscall(syscall.SYS_LLISTXATTR, path, "", buf, 0)
+}
+
+func lgetxattr(path string, name string, buf []byte) (int, error) {
+	return xattrSyscall(syscall.SYS_LGETXATTR, path, name, buf, 0)
+}
+
+func lsetxattr(path string, name string, data []byte, flags int) error {
+	_, err := xattrSyscall(syscall.SYS_LSETXATTR, path, name, data, flags)
+	return err
+}
+
+func listXattrs(path string) []string {
+	size, err := llistxattr(path, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = llistxattr(path, buf)
+	if err != nil {
+		return nil
+	}
+	ret := make([]string, 0)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			ret = append(ret, string(name))
+		}
+	}
+	return ret
+}
+
+func getXattr(path string, name string) []byte {
+	size, err := lgetxattr(path, name, nil)
+	if err != nil {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = lgetxattr(path, name, buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:size]
+}
+
+func parseACLXattr(data []byte) []aclXattrEntry {
+	if len(data) < 4 || binary.LittleEndian.Uint32(data) != acl_xattr_version {
+		return nil
+	}
+	entries := make([]aclXattrEntry, (len(data)-4)/8)
+	if err := binary.Read(bytes.NewReader(data[4:]), binary.LittleEndian, entries); err != nil {
+		return nil
+	}
+	return entries
+}
+
+// user obj, other and mask are part of mode, so only named entries are stored,
+// plus the group obj permissions which mode can't hold when there is a mask
+func parseAccessACL(data []byte, m *PXARMetadata) {
+	var groupObj *uint64
+	hasMask := false
+	for _, e := range parseACLXattr(data) {
+		switch e.Tag {
+		case acl_user:
+			m.ACLUsers = append(m.ACLUsers, PXARACLEntry{ID: uint64(e.ID), Permissions: uint64(e.Perm)})
+		case acl_group:
+			m.ACLGroups = append(m.ACLGroups, PXARACLEntry{ID: uint64(e.ID), Permissions: uint64(e.Perm)})
+		case acl_group_obj:
+			perm := uint64(e.Perm)
+			groupObj = &perm
+		case acl_mask:
+			hasMask = true
+		}
+	}
+	if hasMask {
+		m.ACLGroupObj = groupObj
+	}
+}
+
+func parseDefaultACL(data []byte, m *PXARMetadata) {
+	entries := parseACLXattr(data)
+	if len(entries) == 0 {
+		return
+	}
+	def := &PXARACLDefault{MaskPermissions: PXAR_ACL_NO_MASK}
+	for _, e := range entries {
+		switch e.Tag {
+		case acl_user_obj:
+			def.UserObjPermissions = uint64(e.Perm)
+		case acl_group_obj:
+			def.GroupObjPermissions = uint64(e.Perm)
+		case acl_other:
+			def.OtherPermissions = uint64(e.Perm)
+		case acl_mask:
+			def.MaskPermissions = uint64(e.Perm)
+		case acl_user:
+			m.ACLDefaultUsers = append(m.ACLDefaultUsers, PXARACLEntry{ID: uint64(e.ID), Permissions: uint64(e.Perm)})
+		case acl_group:
+			m.ACLDefaultGroups = append(m.ACLDefaultGroups, PXARACLEntry{ID: uint64(e.ID), Permissions: uint64(e.Perm)})
+		}
+	}
+	m.ACLDefault = def
+}
+
+// Project id is only available through FS_IOC_FSGETXATTR on filesystems supporting project quotas
+func quotaProjID(path string) *uint64 {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil
+	}
+	defer syscall.Close(fd)
+
+	var attr fsxattr
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), fs_ioc_fsgetxattr, uintptr(unsafe.Pointer(&attr)))
+	if errno != 0 || attr.ProjID == 0 {
+		return nil
+	}
+	projid := uint64(attr.ProjID)
+	return &projid
+}
+
+const fs_ioc_fssetxattr = 0x401c5820
+
+// Applies xattrs, ACLs, file capabilities and quota project id of an entry to path.
+// Ownership and mode have to be restored before, chown clears file capabilities. Symlinks are not followed,
+// their own xattrs are set.
+// Every record is attempted, the first error is returned
+func RestoreMetadata(path string, e *PXAREntry) error {
+	var ret error
+	keep := func(err error) {
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+	m := &e.Metadata
+
+	for _, x := range m.Xattrs {
+		keep(lsetxattr(path, x.Name, x.Value, 0))
+	}
+
+	if len(m.ACLUsers) > 0 || len(m.ACLGroups) > 0 || m.ACLGroupObj != nil {
+		keep(lsetxattr(path, "system.posix_acl_access", accessACLXattr(e.Mode, m), 0))
+	}
+	if m.ACLDefault != nil && e.Kind == 'd' {
+		keep(lsetxattr(path, "system.posix_acl_default", defaultACLXattr(m), 0))
+	}
+
+	if len(m.FCaps) > 0 {
+		keep(lsetxattr(path, "security.capability", m.FCaps, 0))
+	}
+
+	if m.QuotaProjID != nil {
+		keep(setQuotaProjID(path, uint32(*m.QuotaProjID)))
+	}
+	return ret
+}
+
+// Inverse of parseAccessACL, with a mask the group bits of mode hold the mask permissions
+func accessACLXattr(mode uint64, m *PXARMetadata) []byte {
+	groupObj := (mode >> 3) & 7
+	if m.ACLGroupObj != nil {
+		groupObj = *m.ACLGroupObj
+	}
+	entries := []aclXattrEntry{{Tag: acl_user_obj, Perm: uint16((mode >> 6) & 7), ID: acl_undefined_id}}
+	entries = append(entries, aclEntries(acl_user, m.ACLUsers)...)
+	entries = append(entries, aclXattrEntry{Tag: acl_group_obj, Perm: uint16(groupObj), ID: acl_undefined_id})
+	entries = append(entries, aclEntries(acl_group, m.ACLGroups)...)
+	entries = append(entries, aclXattrEntry{Tag: acl_mask, Perm: uint16((mode >> 3) & 7), ID: acl_undefined_id})
+	entries = append(entries, aclXattrEntry{Tag: acl_other, Perm: uint16(mode & 7), ID: acl_undefined_id})
+	return encodeACLXattr(entries)
+}
+
+func defaultACLXattr(m *PXARMetadata) []byte {
+	def := m.ACLDefault
+	mask := def.MaskPermissions
+	//Named entries are not valid without a mask, use the union of group class permissions
+	if mask == PXAR_ACL_NO_MASK && (len(m.ACLDefaultUsers) > 0 || len(m.ACLDefaultGroups) > 0) {
+		mask = def.GroupObjPermissions
+		for _, e := range append(append([]PXARACLEntry{}, m.ACLDefaultUsers...), m.ACLDefaultGroups...) {
+			mask |= e.Permissions
+		}
+	}
+	entries := []aclXattrEntry{{Tag: acl_user_obj, Perm: uint16(def.UserObjPermissions), ID: acl_undefined_id}}
+	entries = append(entries, aclEntries(acl_user, m.ACLDefaultUsers)...)
+	entries = append(entries, aclXattrEntry{Tag: acl_group_obj, Perm: uint16(def.GroupObjPermissions), ID: acl_undefined_id})
+	entries = append(entries, aclEntries(acl_group, m.ACLDefaultGroups)...)
+	if mask != PXAR_ACL_NO_MASK {
+		entries = append(entries, aclXattrEntry{Tag: acl_mask, Perm: uint16(mask), ID: acl_undefined_id})
+	}
+	entries = append(entries, aclXattrEntry{Tag: acl_other, Perm: uint16(def.OtherPermissions), ID: acl_undefined_id})
+	return encodeACLXattr(entries)
+}
+
+// The kernel wants named entries sorted by id
+func aclEntries(tag uint16, entries []PXARACLEntry) []aclXattrEntry {
+	ret := make([]aclXattrEntry, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, aclXattrEntry{Tag: tag, Perm: uint16(e.Permissions), ID: uint32(e.ID)})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID < ret[j].ID
+	})
+	return ret
+}
+
+func encodeACLXattr(entries []aclXattrEntry) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, acl_xattr_version)
+	binary.Write(&buf, binary.LittleEndian, entries)
+	return buf.Bytes()
+}
+
+func setQuotaProjID(path string, projid uint32) error {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var attr fsxattr
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), fs_ioc_fsgetxattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return errno
+	}
+	attr.ProjID = projid
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), fs_ioc_fssetxattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
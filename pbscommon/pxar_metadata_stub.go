@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package pbscommon
+
+import (
+	"os"
+)
+
+// Extended attributes, ACLs and capabilities are only collected on linux
+func readMetadata(path string, fileInfo os.FileInfo, a *PXARArchive) PXARMetadata {
+	return PXARMetadata{}
+}
+
+// Extended attributes, ACLs and capabilities can only be restored on linux
+func RestoreMetadata(path string, e *PXAREntry) error {
+	return nil
+}
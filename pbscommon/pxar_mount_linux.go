@@ -0,0 +1,49 @@
+//go:build linux
+// +build linux
+
+package pbscommon
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Mount points of the current mount namespace, bind mounts of the same file system included
+func mountPoints() map[string]bool {
+	ret := make(map[string]bool)
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return ret
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		//36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw, the fifth field is the mount point
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 {
+			ret[unescapeMountPath(fields[4])] = true
+		}
+	}
+	return ret
+}
+
+// Spaces, tabs, newlines and backslashes are written as octal escapes like \040
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
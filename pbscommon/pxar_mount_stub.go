@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package pbscommon
+
+// Mount points are only known on linux, elsewhere one file system mode relies on st_dev alone
+func mountPoints() map[string]bool {
+	return make(map[string]bool)
+}
@@ -0,0 +1,168 @@
+package pbscommon
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Tree the archiver reads. Names are slash separated and relative to the archived directory, "." for the
+// directory itself, like io/fs. Lstat and ReadLink do not follow a final symlink, Stat does.
+// Owner, devices, hardlinks and xattrs come from PXARMetadataSource when implemented, otherwise from
+// FileInfo.Sys when it is a *syscall.Stat_t, as for os.DirFS, or a *PXAREntry, as for PXARFS
+type PXARSource interface {
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Open(name string) (fs.File, error)
+	ReadLink(name string) (string, error)
+}
+
+// What fs.FileInfo does not tell portably
+type PXARSourceAttr struct {
+	Perm     uint64 //Permission bits with setuid, setgid and sticky
+	UID      uint32
+	GID      uint32
+	DevMajor uint64 //Block and character devices
+	DevMinor uint64
+	//Files with more than one link and the same dev and inode are stored as hardlinks,
+	//directories on another dev than their parent are mount points for OneFileSystem
+	Dev      uint64
+	Ino      uint64
+	Nlink    uint64
+	HasInode bool
+}
+
+// Sources knowing more about their entries than fs.FileInfo
+type PXARMetadataSource interface {
+	PXARSource
+	Attr(name string, fileInfo fs.FileInfo) PXARSourceAttr
+	//Xattrs, ACLs, file capabilities and quota project id, classes skipped by a need not be read
+	Metadata(name string, fileInfo fs.FileInfo, a *PXARArchive) PXARMetadata
+}
+
+func fileAttr(fileInfo fs.FileInfo) PXARSourceAttr {
+	if e, ok := fileInfo.Sys().(*PXAREntry); ok {
+		return PXARSourceAttr{Perm: e.Mode & 0o7777, UID: e.UID, GID: e.GID, DevMajor: e.DevMajor, DevMinor: e.DevMinor}
+	}
+	ret := PXARSourceAttr{}
+	ret.Perm, ret.UID, ret.GID = fileOwnership(fileInfo)
+	ret.DevMajor, ret.DevMinor = fileDevice(fileInfo)
+	ret.Dev, ret.Ino, ret.Nlink, ret.HasInode = fileInode(fileInfo)
+	return ret
+}
+
+// Follows symlinks of name inside src. Only relative targets are followed, absolute ones refer to
+// a tree the source does not know
+func resolveSymlinks(src PXARSource, name string) (string, error) {
+	for i := 0; i < 40; i++ {
+		fileInfo, err := src.Lstat(name)
+		if err != nil {
+			return "", err
+		}
+		if fileInfo.Mode()&fs.ModeSymlink == 0 {
+			return name, nil
+		}
+		target, err := src.ReadLink(name)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			return "", fmt.Errorf("absolute symlink target %s: %w", target, fs.ErrNotExist)
+		}
+		name = path.Join(path.Dir(name), target)
+		if !fs.ValidPath(name) {
+			return "", fmt.Errorf("symlink target %s outside of source: %w", target, fs.ErrNotExist)
+		}
+	}
+	return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+}
+
+// Local directory, what WriteDir archives
+type osSource struct {
+	root string
+
+	mounts   map[string]bool //Loaded on first use, with realroot the absolute real path of root
+	realroot string
+}
+
+func NewOSSource(root string) PXARSource {
+	return &osSource{root: root}
+}
+
+func (s *osSource) path(name string) string {
+	if name == "." {
+		return s.root
+	}
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *osSource) Stat(name string) (fs.FileInfo, error)      { return os.Stat(s.path(name)) }
+func (s *osSource) Lstat(name string) (fs.FileInfo, error)     { return os.Lstat(s.path(name)) }
+func (s *osSource) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(s.path(name)) }
+func (s *osSource) Open(name string) (fs.File, error)          { return os.Open(s.path(name)) }
+func (s *osSource) ReadLink(name string) (string, error)       { return os.Readlink(s.path(name)) }
+
+func (s *osSource) Attr(name string, fileInfo fs.FileInfo) PXARSourceAttr {
+	return fileAttr(fileInfo)
+}
+
+func (s *osSource) Metadata(name string, fileInfo fs.FileInfo, a *PXARArchive) PXARMetadata {
+	return readMetadata(s.path(name), fileInfo, a)
+}
+
+// Bind mounts keep the st_dev of the file system they come from, so mount points are looked up too
+func (s *osSource) isMountPoint(name string) bool {
+	if s.mounts == nil {
+		s.mounts = mountPoints()
+		s.realroot = s.root
+		if real, err := filepath.EvalSymlinks(s.root); err == nil {
+			s.realroot = real
+		}
+		if abs, err := filepath.Abs(s.realroot); err == nil {
+			s.realroot = abs
+		}
+	}
+	return s.mounts[filepath.Join(s.realroot, filepath.FromSlash(name))]
+}
+
+// Absolute symlinks point outside the archived directory too, so the real path is used
+func (s *osSource) EvalSymlinks(name string) (string, error) {
+	p, err := filepath.EvalSymlinks(s.path(name))
+	return filepath.ToSlash(p), err
+}
+
+type fsSource struct {
+	fsys fs.FS
+}
+
+// Archives an fs.FS, e.g. an embed.FS, a zip.Reader or a PXARFS.
+// Symlinks are only stored when fsys has Lstat and ReadLink methods as PXARFS does, os.DirFS has them
+// from Go 1.25 on only, NewOSSource is the source for local directories
+func NewFSSource(fsys fs.FS) PXARSource {
+	return &fsSource{fsys: fsys}
+}
+
+func (s *fsSource) Stat(name string) (fs.FileInfo, error)      { return fs.Stat(s.fsys, name) }
+func (s *fsSource) ReadDir(name string) ([]fs.DirEntry, error) { return fs.ReadDir(s.fsys, name) }
+func (s *fsSource) Open(name string) (fs.File, error)          { return s.fsys.Open(name) }
+
+func (s *fsSource) Lstat(name string) (fs.FileInfo, error) {
+	if l, ok := s.fsys.(interface {
+		Lstat(name string) (fs.FileInfo, error)
+	}); ok {
+		return l.Lstat(name)
+	}
+	return fs.Stat(s.fsys, name)
+}
+
+func (s *fsSource) ReadLink(name string) (string, error) {
+	if l, ok := s.fsys.(interface {
+		ReadLink(name string) (string, error)
+	}); ok {
+		return l.ReadLink(name)
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
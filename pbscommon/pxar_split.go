@@ -0,0 +1,126 @@
+package pbscommon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Split archives (format version 2) keep file contents out of the metadata archive:
+//
+//	metadata archive                      payload archive
+//	PXAR_FORMAT_VERSION(2)                PXAR_PAYLOAD_START_MARKER
+//	PXAR_ENTRY(DIR)                       PXAR_PAYLOAD(file.txt)
+//		PXAR_FILENAME(file.txt)             ...
+//		PXAR_ENTRY(file, attributes etc)    PXAR_PAYLOAD_TAIL_MARKER
+//		PXAR_PAYLOAD_REF(offset, size)
+//		...
+//	PXAR_GOODBYE
+//
+// The reference offset points to the PXAR_PAYLOAD header in the payload archive, so the payload
+// archive may hold data no entry refers to, which is what allows reusing whole chunks of a previous one
+
+// Regular files of the previous metadata archive, by path relative to archive root
+type PXARPrevious struct {
+	Files map[string]PXAREntry
+	//Makes the range [offset, offset+length) of the previous payload archive part of the new one
+	//without the data passing through, returns where the range starts in the new payload archive
+	//and the new payload archive size
+	ReuseCB func(offset uint64, length uint64) (uint64, uint64, error)
+}
+
+// Walks a previous metadata archive, which is usually read through a DynamicIndexReader
+func NewPXARPrevious(metadata io.ReaderAt, size uint64) (*PXARPrevious, error) {
+	ret := &PXARPrevious{Files: make(map[string]PXAREntry)}
+	d := NewPXARDecoder(metadata, size)
+	for {
+		e, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e.Kind == 'f' {
+			ret.Files[e.Path] = *e
+		}
+	}
+	if d.Version != PXAR_FORMAT_VERSION_2 {
+		return nil, fmt.Errorf("pxar: previous archive is not a metadata archive")
+	}
+	return ret, nil
+}
+
+func (a *PXARArchive) startSplit() {
+	binary.Write(&a.buffer, binary.LittleEndian, PXAR_FORMAT_VERSION)
+	binary.Write(&a.buffer, binary.LittleEndian, uint64(16+8))
+	binary.Write(&a.buffer, binary.LittleEndian, PXAR_FORMAT_VERSION_2)
+
+	a.payloadpos = 0
+	a.writePayloadMarker(PXAR_PAYLOAD_START_MARKER)
+}
+
+func (a *PXARArchive) finishSplit() {
+	a.writePayloadMarker(PXAR_PAYLOAD_TAIL_MARKER)
+}
+
+func (a *PXARArchive) writePayloadMarker(marker uint64) {
+	hdr := make([]byte, 16)
+	binary.LittleEndian.PutUint64(hdr[0:8], marker)
+	binary.LittleEndian.PutUint64(hdr[8:16], 16)
+	a.writePayload(hdr)
+}
+
+// File content goes after the entry in plain archives, in split archives it goes to the payload
+// archive and the entry gets a reference to it
+func (a *PXARArchive) writePayloadHeader(size uint64) {
+	if a.PayloadWriteCB != nil {
+		a.writePayloadRef(a.payloadpos, size)
+	}
+	hdr := make([]byte, 16)
+	binary.LittleEndian.PutUint64(hdr[0:8], PXAR_PAYLOAD)
+	binary.LittleEndian.PutUint64(hdr[8:16], size+16) //File size + header size
+	a.writePayload(hdr)
+}
+
+func (a *PXARArchive) writePayloadRef(offset uint64, size uint64) {
+	binary.Write(&a.buffer, binary.LittleEndian, PXAR_PAYLOAD_REF)
+	binary.Write(&a.buffer, binary.LittleEndian, uint64(16+16))
+	binary.Write(&a.buffer, binary.LittleEndian, offset)
+	binary.Write(&a.buffer, binary.LittleEndian, size)
+	a.Flush()
+}
+
+func (a *PXARArchive) writePayload(b []byte) {
+	if a.PayloadWriteCB == nil {
+		a.buffer.Write(b)
+		a.Flush()
+		return
+	}
+	a.PayloadWriteCB(b)
+	a.payloadpos += uint64(len(b))
+}
+
+// A file whose size, mtime, type, permissions and owner match the previous entry is taken as
+// unchanged. Metadata records are always written fresh, only the payload is reused.
+// The inode cannot be compared, PXAR_ENTRY does not store it, as with proxmox-backup-client.
+func (a *PXARArchive) reusePayload(name string, entry *PXARFileEntry, size uint64) bool {
+	if a.PayloadWriteCB == nil || a.Previous == nil || size == 0 {
+		return false
+	}
+	prev, ok := a.Previous.Files[a.archivePath(name)]
+	if !ok || prev.Size != size || prev.Mode != entry.mode || prev.UID != entry.uid || prev.GID != entry.gid ||
+		uint64(prev.MTime.Unix()) != entry.mtime.secs || uint32(prev.MTime.Nanosecond()) != entry.mtime.nanos {
+		return false
+	}
+
+	offset, pos, err := a.Previous.ReuseCB(prev.PayloadOffset, size+16)
+	if err != nil {
+		a.warn("Cannot reuse previous payload of %s, reading it again: %v", a.display(name), err)
+		return false
+	}
+	a.payloadpos = pos
+	a.writePayloadRef(offset, size)
+	a.Reused++
+	return true
+}
@@ -0,0 +1,166 @@
+//go:build linux
+// +build linux
+
+package pbscommon
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes root as split archive, taking unchanged files from previous when set. Reused ranges are copied
+// with a few bytes around them, as injecting whole chunks of the previous payload archive does
+func writeSplitTestArchive(t *testing.T, root string, previous *PXARPrevious, previousPayload []byte, reuseErr error) (*PXARArchive, []byte, []byte) {
+	var metadata, payload bytes.Buffer
+	a := &PXARArchive{
+		ArchiveName:    "test.mpxar.didx",
+		WriteCB:        func(b []byte) { metadata.Write(b) },
+		PayloadWriteCB: func(b []byte) { payload.Write(b) },
+		CatalogWriteCB: func(b []byte) {},
+		Previous:       previous,
+	}
+	if previous != nil {
+		previous.ReuseCB = func(offset uint64, length uint64) (uint64, uint64, error) {
+			if reuseErr != nil {
+				return 0, 0, reuseErr
+			}
+			start := offset - min(offset, 3)
+			end := min(offset+length+5, uint64(len(previousPayload)))
+			pos := uint64(payload.Len()) + offset - start
+			payload.Write(previousPayload[start:end])
+			return pos, uint64(payload.Len()), nil
+		}
+	}
+	a.WriteDir(root, "", true)
+	return a, metadata.Bytes(), payload.Bytes()
+}
+
+func TestPXARSplitReuse(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]string{"a": "first file", "b": "second file", "empty": "", "sub/d": "nested file"}
+	write := func(t *testing.T, root string, name string, data string) {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(filepath.Join(root, name), mtime, mtime)
+	}
+
+	tests := []struct {
+		name     string
+		change   func(t *testing.T, root string)
+		reuseErr error
+		reused   uint64
+		warnings int
+	}{
+		{
+			name:   "unchanged",
+			change: func(t *testing.T, root string) {},
+			reused: 3,
+		},
+		{
+			name: "content and mtime changed",
+			change: func(t *testing.T, root string) {
+				write(t, root, "a", "first FILE")
+				os.Chtimes(filepath.Join(root, "a"), mtime, mtime.Add(time.Second))
+			},
+			reused: 2,
+		},
+		{
+			name: "only the nanoseconds of mtime changed",
+			change: func(t *testing.T, root string) {
+				os.Chtimes(filepath.Join(root, "sub", "d"), mtime, mtime.Add(time.Nanosecond))
+			},
+			reused: 2,
+		},
+		{
+			name:   "size changed",
+			change: func(t *testing.T, root string) { write(t, root, "b", "second, longer file") },
+			reused: 2,
+		},
+		{
+			name:   "permissions changed",
+			change: func(t *testing.T, root string) { os.Chmod(filepath.Join(root, "a"), 0o600) },
+			reused: 2,
+		},
+		{
+			name:   "renamed",
+			change: func(t *testing.T, root string) { os.Rename(filepath.Join(root, "sub"), filepath.Join(root, "moved")) },
+			reused: 2,
+		},
+		{
+			name:     "previous payload not usable",
+			change:   func(t *testing.T, root string) {},
+			reuseErr: errors.New("chunk not known"),
+			warnings: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, data := range files {
+				write(t, root, name, data)
+			}
+			_, metadata, payload := writeSplitTestArchive(t, root, nil, nil, nil)
+			previous, err := NewPXARPrevious(bytes.NewReader(metadata), uint64(len(metadata)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(previous.Files) != len(files) {
+				t.Errorf("previous has %d files, want %d", len(previous.Files), len(files))
+			}
+
+			tt.change(t, root)
+			a, metadata, payload := writeSplitTestArchive(t, root, previous, payload, tt.reuseErr)
+			if a.Reused != tt.reused || len(a.Warnings) != tt.warnings {
+				t.Errorf("reused %d with warnings %v, want %d and %d warnings", a.Reused, a.Warnings, tt.reused, tt.warnings)
+			}
+
+			d := NewSplitPXARDecoder(bytes.NewReader(metadata), uint64(len(metadata)), bytes.NewReader(payload))
+			if problems, err := d.Verify(); err != nil || len(problems) > 0 {
+				t.Fatalf("invalid archive: %v %v", problems, err)
+			}
+			d = NewSplitPXARDecoder(bytes.NewReader(metadata), uint64(len(metadata)), bytes.NewReader(payload))
+			count := 0
+			for {
+				e, err := d.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.Kind != 'f' {
+					continue
+				}
+				count++
+				r, err := d.OpenPayload(e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, _ := io.ReadAll(r)
+				if want, _ := os.ReadFile(filepath.Join(root, e.Path)); !bytes.Equal(got, want) {
+					t.Errorf("%s holds %q, want %q", e.Path, got, want)
+				}
+			}
+			if count != len(files) {
+				t.Errorf("archive has %d files, want %d", count, len(files))
+			}
+		})
+	}
+
+	//A plain previous archive cannot be used, its payloads are not in a payload archive
+	root := t.TempDir()
+	write(t, root, "a", "content")
+	plain := decoderTestBytes(t, writeDecoderTestArchive(t, root, false))
+	if _, err := NewPXARPrevious(bytes.NewReader(plain), uint64(len(plain))); err == nil {
+		t.Errorf("plain archive taken as previous metadata archive")
+	}
+}
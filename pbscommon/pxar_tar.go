@@ -0,0 +1,379 @@
+package pbscommon
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry of a tar stream. Entries are kept until the stream ends because pxar needs the children of a
+// directory written together and tar streams may list them in any order
+type tarNode struct {
+	hdr      *tar.Header
+	children map[string]*tarNode //Directories only
+	payload  int64               //Offset of the content in the spool file, regular files only
+	link     *tarNode            //Hardlinks, the regular file holding the content
+	linked   bool                //Regular files other entries are hardlinks to
+}
+
+func isTarRegular(typeflag byte) bool {
+	return typeflag == tar.TypeReg || typeflag == tar.TypeCont || typeflag == tar.TypeGNUSparse
+}
+
+// Path relative to archive root, leading / and ./ are removed and .. cannot leave the root, like tar does
+func tarPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func newTarDir(mtime time.Time) *tarNode {
+	return &tarNode{
+		hdr:      &tar.Header{Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime},
+		children: make(map[string]*tarNode),
+	}
+}
+
+// Parent directory node of p, directories missing from the stream, or replaced by a non directory, are created
+func (n *tarNode) parent(p string, mtime time.Time) *tarNode {
+	dir := path.Dir(p)
+	if dir == "." {
+		return n
+	}
+	for _, name := range strings.Split(dir, "/") {
+		child := n.children[name]
+		if child == nil || child.children == nil {
+			child = newTarDir(mtime)
+			n.children[name] = child
+		}
+		n = child
+	}
+	return n
+}
+
+func (n *tarNode) lookup(p string) *tarNode {
+	if p == "" {
+		return n
+	}
+	for _, name := range strings.Split(p, "/") {
+		if n.children == nil {
+			return nil
+		}
+		if n = n.children[name]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// Reads a tar stream, for example from tar c or docker export, and writes its entries as archive and
+// catalog, the same way WriteDir does for a directory. File contents are spooled to a temporary file
+// in SpoolDir while the stream is read, the archive is written once the stream ended, so a broken stream writes nothing.
+// Directories missing from the stream are created with mode 0755, later entries replace earlier ones
+// with the same path. Xattrs and file capabilities are taken from PAX SCHILY.xattr records,
+// filters and .pxarexclude files apply as for WriteDir, ACLs are not supported
+func (a *PXARArchive) WriteTar(r io.Reader) error {
+	spool, err := os.CreateTemp(a.SpoolDir, "pxar-tar-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	now := time.Now()
+	root := newTarDir(now)
+	var spooled int64
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar stream: %w", err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		p := tarPath(hdr.Name)
+		isDir := hdr.Typeflag == tar.TypeDir
+		if p == "" {
+			if isDir {
+				root.hdr = hdr
+			}
+			continue
+		}
+		//Parents may be missing from the stream, so they are matched too, as WriteDir never enters excluded directories
+		skip := false
+		for q := p; q != "." && !skip; q = path.Dir(q) {
+			skip = IsExcluded(a.ExcludePatterns, q, q != p || isDir)
+		}
+		if skip {
+			a.Excluded++
+			continue
+		}
+
+		parent := root.parent(p, now)
+		name := path.Base(p)
+		node := &tarNode{hdr: hdr}
+		switch {
+		case isDir:
+			//Metadata of a directory listed again, its children stay
+			if old := parent.children[name]; old != nil && old.children != nil {
+				old.hdr = hdr
+				continue
+			}
+			node.children = make(map[string]*tarNode)
+		case isTarRegular(hdr.Typeflag):
+			node.payload = spooled
+			n, err := io.Copy(spool, tr)
+			if err != nil {
+				return fmt.Errorf("reading tar stream: %s: %w", hdr.Name, err)
+			}
+			spooled += n
+			hdr.Size = n
+		case hdr.Typeflag == tar.TypeLink:
+			target := root.lookup(tarPath(hdr.Linkname))
+			if target != nil && target.link != nil {
+				target = target.link
+			}
+			if target == nil || !isTarRegular(target.hdr.Typeflag) {
+				a.warn("Skipping hardlink %s: target %s is not a regular file of the stream", hdr.Name, hdr.Linkname)
+				continue
+			}
+			target.linked = true
+			node.link = target
+		case hdr.Typeflag == tar.TypeSymlink, hdr.Typeflag == tar.TypeChar, hdr.Typeflag == tar.TypeBlock, hdr.Typeflag == tar.TypeFifo:
+		default:
+			a.warn("Skipping %s: unsupported tar entry type %c", hdr.Name, hdr.Typeflag)
+			continue
+		}
+		parent.children[name] = node
+	}
+
+	a.WriteSource(&tarSource{root: root, spool: spool})
+	return nil
+}
+
+// Writes an archive holding a single regular file name with the content of r, so a stream such as a database
+// dump shows up as a file in every pxar browser and the catalog. pxar needs the size before the content,
+// the stream is spooled to a temporary file in SpoolDir until it ends. The file is owned by the user running the backup
+func (a *PXARArchive) WriteStream(r io.Reader, name string, mode fs.FileMode, mtime time.Time) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	spool, err := os.CreateTemp(a.SpoolDir, "pxar-stream-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return fmt.Errorf("reading stream: %w", err)
+	}
+	uid, gid := max(os.Getuid(), 0), max(os.Getgid(), 0)
+	root := newTarDir(mtime)
+	root.hdr.Uid, root.hdr.Gid = uid, gid
+	root.children[name] = &tarNode{hdr: &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(mode.Perm()),
+		Uid:      uid,
+		Gid:      gid,
+		Size:     size,
+		ModTime:  mtime,
+	}}
+	a.WriteSource(&tarSource{root: root, spool: spool})
+	return nil
+}
+
+// The tree of a tar stream as PXARSource. Regular files and their hardlinks share an inode, so the
+// archiver stores whichever comes first with the content and the others as hardlinks to it
+type tarSource struct {
+	root  *tarNode
+	spool io.ReaderAt
+	inos  map[*tarNode]uint64
+}
+
+type tarFileInfo struct {
+	name string
+	node *tarNode
+}
+
+func (fi tarFileInfo) Name() string       { return fi.name }
+func (fi tarFileInfo) ModTime() time.Time { return fi.node.hdr.ModTime }
+func (fi tarFileInfo) IsDir() bool        { return fi.node.children != nil }
+func (fi tarFileInfo) Sys() any           { return fi.node.hdr }
+
+func (fi tarFileInfo) Size() int64 {
+	if fi.node.children != nil {
+		return 0
+	}
+	return fi.node.hdr.Size
+}
+
+func (fi tarFileInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(fi.node.hdr.Mode & 0o777)
+	switch {
+	case fi.node.children != nil:
+		mode |= fs.ModeDir
+	case fi.node.hdr.Typeflag == tar.TypeSymlink:
+		mode |= fs.ModeSymlink
+	case fi.node.hdr.Typeflag == tar.TypeChar:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case fi.node.hdr.Typeflag == tar.TypeBlock:
+		mode |= fs.ModeDevice
+	case fi.node.hdr.Typeflag == tar.TypeFifo:
+		mode |= fs.ModeNamedPipe
+	}
+	return mode
+}
+
+// Hardlinks look like the file they link to
+func (s *tarSource) node(name string) (*tarNode, error) {
+	n := s.root
+	if name != "." {
+		n = s.root.lookup(name)
+	}
+	if n == nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.link != nil {
+		n = n.link
+	}
+	return n, nil
+}
+
+func (s *tarSource) Lstat(name string) (fs.FileInfo, error) {
+	n, err := s.node(name)
+	if err != nil {
+		return nil, err
+	}
+	return tarFileInfo{name: path.Base(name), node: n}, nil
+}
+
+func (s *tarSource) Stat(name string) (fs.FileInfo, error) {
+	real, err := resolveSymlinks(s, name)
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.node(real)
+	if err != nil {
+		return nil, err
+	}
+	return tarFileInfo{name: path.Base(name), node: n}, nil
+}
+
+func (s *tarSource) ReadDir(name string) ([]fs.DirEntry, error) {
+	real, err := resolveSymlinks(s, name)
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.node(real)
+	if err != nil {
+		return nil, err
+	}
+	if n.children == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	ret := make([]fs.DirEntry, 0, len(n.children))
+	for childname, child := range n.children {
+		if child.link != nil {
+			child = child.link
+		}
+		ret = append(ret, fs.FileInfoToDirEntry(tarFileInfo{name: childname, node: child}))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name() < ret[j].Name()
+	})
+	return ret, nil
+}
+
+type tarFile struct {
+	*io.SectionReader
+	fi tarFileInfo
+}
+
+func (f tarFile) Stat() (fs.FileInfo, error) { return f.fi, nil }
+func (f tarFile) Close() error               { return nil }
+
+func (s *tarSource) Open(name string) (fs.File, error) {
+	fi, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	n := fi.(tarFileInfo).node
+	return tarFile{SectionReader: io.NewSectionReader(s.spool, n.payload, n.hdr.Size), fi: fi.(tarFileInfo)}, nil
+}
+
+func (s *tarSource) ReadLink(name string) (string, error) {
+	n, err := s.node(name)
+	if err != nil {
+		return "", err
+	}
+	if n.hdr.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return n.hdr.Linkname, nil
+}
+
+func (s *tarSource) Attr(name string, fileInfo fs.FileInfo) PXARSourceAttr {
+	n := fileInfo.(tarFileInfo).node
+	if s.inos == nil {
+		s.inos = make(map[*tarNode]uint64)
+	}
+	ino, ok := s.inos[n]
+	if !ok {
+		ino = uint64(len(s.inos)) + 1
+		s.inos[n] = ino
+	}
+	ret := PXARSourceAttr{
+		Perm:     uint64(n.hdr.Mode) & 0o7777,
+		UID:      uint32(n.hdr.Uid),
+		GID:      uint32(n.hdr.Gid),
+		DevMajor: uint64(n.hdr.Devmajor),
+		DevMinor: uint64(n.hdr.Devminor),
+		Ino:      ino,
+		Nlink:    1,
+		HasInode: true,
+	}
+	if n.linked {
+		ret.Nlink = 2
+	}
+	return ret
+}
+
+// Xattrs and file capabilities from PAX records, the same classes readMetadata keeps for local files
+func (s *tarSource) Metadata(name string, fileInfo fs.FileInfo, a *PXARArchive) PXARMetadata {
+	hdr := fileInfo.(tarFileInfo).node.hdr
+	m := PXARMetadata{}
+	for key, value := range hdr.PAXRecords {
+		name, ok := strings.CutPrefix(key, "SCHILY.xattr.")
+		if !ok {
+			continue
+		}
+		switch {
+		case name == "security.capability":
+			if !a.SkipFCaps {
+				m.FCaps = []byte(value)
+			}
+		case strings.HasPrefix(name, "user.") || strings.HasPrefix(name, "trusted.") || strings.HasPrefix(name, "security."):
+			if !a.SkipXattrs {
+				m.Xattrs = append(m.Xattrs, PXARXattr{Name: name, Value: []byte(value)})
+			}
+		}
+	}
+	sort.Slice(m.Xattrs, func(i, j int) bool {
+		return m.Xattrs[i].Name < m.Xattrs[j].Name
+	})
+	return m
+}
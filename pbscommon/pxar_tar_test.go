@@ -0,0 +1,236 @@
+//go:build linux
+// +build linux
+
+package pbscommon
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Entry of a test tar stream, content is the file content or the link target
+type tarTestEntry struct {
+	typeflag byte
+	name     string
+	mode     int64
+	content  string
+}
+
+func writeTestTar(t *testing.T, entries []tarTestEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, e := range entries {
+		hdr := &tar.Header{Typeflag: e.typeflag, Name: e.name, Mode: e.mode, ModTime: mtime}
+		switch e.typeflag {
+		case tar.TypeReg:
+			hdr.Size = int64(len(e.content))
+		case tar.TypeSymlink, tar.TypeLink:
+			hdr.Linkname = e.content
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			tw.Write([]byte(e.content))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Archive entries in archive order as "path kind mode content", content is the file content
+// for regular files and hardlinks and the target for symlinks and hardlinks
+func listTestArchive(t *testing.T, data []byte) []string {
+	d := NewPXARDecoder(bytes.NewReader(data), uint64(len(data)))
+	problems, err := d.Verify()
+	if err != nil || len(problems) > 0 {
+		t.Fatalf("invalid archive: %v %v", problems, err)
+	}
+	d = NewPXARDecoder(bytes.NewReader(data), uint64(len(data)))
+	ret := []string{}
+	for {
+		e, err := d.Next()
+		if err == io.EOF {
+			return ret
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, kind, linkTarget := e.Path, e.Kind, e.LinkTarget
+		if e.Kind == 'h' {
+			//Hardlinks have no metadata of their own
+			if e, err = d.ResolveHardlink(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		line := fmt.Sprintf("%s %c %o", p, kind, e.Mode&0o7777)
+		switch {
+		case kind == 'l':
+			line += " " + linkTarget
+		case kind == 'h':
+			line += " " + linkTarget
+			fallthrough
+		case e.Kind == 'f':
+			r, err := d.OpenPayload(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := io.ReadAll(r)
+			line += " " + string(content)
+		}
+		ret = append(ret, line)
+	}
+}
+
+func TestPXARWriteTar(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []tarTestEntry
+		excludes []string
+		want     []string
+		warnings int
+	}{
+		{
+			name: "missing parents",
+			entries: []tarTestEntry{
+				{tar.TypeReg, "a/b/f", 0o600, "data"},
+				{tar.TypeDir, "a/b/", 0o700, ""},
+			},
+			want: []string{" d 755", "a d 755", "a/b d 700", "a/b/f f 600 data"},
+		},
+		{
+			name: "leading slash, dot and dot dot",
+			entries: []tarTestEntry{
+				{tar.TypeDir, "./", 0o750, ""},
+				{tar.TypeReg, "./a", 0o644, "1"},
+				{tar.TypeReg, "/b", 0o644, "2"},
+				{tar.TypeReg, "../../c", 0o644, "3"},
+			},
+			want: []string{" d 750", "a f 644 1", "b f 644 2", "c f 644 3"},
+		},
+		{
+			name: "hardlink to an earlier file",
+			entries: []tarTestEntry{
+				{tar.TypeReg, "d/f", 0o644, "data"},
+				{tar.TypeLink, "d/h", 0o644, "d/f"},
+			},
+			want: []string{" d 755", "d d 755", "d/f f 644 data", "d/h h 644 d/f data"},
+		},
+		{
+			name: "hardlink sorting before its target",
+			entries: []tarTestEntry{
+				{tar.TypeReg, "z", 0o644, "data"},
+				{tar.TypeLink, "a", 0o644, "./z"},
+			},
+			want: []string{" d 755", "a f 644 data", "z h 644 a data"},
+		},
+		{
+			name: "hardlink to a hardlink",
+			entries: []tarTestEntry{
+				{tar.TypeReg, "f", 0o644, "data"},
+				{tar.TypeLink, "g", 0o644, "f"},
+				{tar.TypeLink, "h", 0o644, "g"},
+			},
+			want: []string{" d 755", "f f 644 data", "g h 644 f data", "h h 644 f data"},
+		},
+		{
+			name: "hardlink to a missing file or a directory",
+			entries: []tarTestEntry{
+				{tar.TypeDir, "d", 0o755, ""},
+				{tar.TypeLink, "h", 0o644, "missing"},
+				{tar.TypeLink, "i", 0o644, "d"},
+				{tar.TypeReg, "later", 0o644, "data"},
+				{tar.TypeLink, "j", 0o644, "/later/"},
+			},
+			want:     []string{" d 755", "d d 755", "j f 644 data", "later h 644 j data"},
+			warnings: 2,
+		},
+		{
+			name: "later entries replace earlier ones",
+			entries: []tarTestEntry{
+				{tar.TypeReg, "f", 0o644, "old"},
+				{tar.TypeSymlink, "l", 0o777, "f"},
+				{tar.TypeReg, "f", 0o600, "new"},
+				{tar.TypeReg, "l", 0o644, "file"},
+			},
+			want: []string{" d 755", "f f 600 new", "l f 644 file"},
+		},
+		{
+			name: "directory listed again keeps its children",
+			entries: []tarTestEntry{
+				{tar.TypeDir, "d", 0o755, ""},
+				{tar.TypeReg, "d/f", 0o644, "data"},
+				{tar.TypeDir, "d", 0o700, ""},
+			},
+			want: []string{" d 755", "d d 700", "d/f f 644 data"},
+		},
+		{
+			name: "file replaced by a directory",
+			entries: []tarTestEntry{
+				{tar.TypeReg, "d", 0o644, "file"},
+				{tar.TypeReg, "d/f", 0o644, "data"},
+			},
+			want: []string{" d 755", "d d 755", "d/f f 644 data"},
+		},
+		{
+			name: "excluded parents missing from the stream",
+			entries: []tarTestEntry{
+				{tar.TypeReg, "cache/x/f", 0o644, "data"},
+				{tar.TypeReg, "keep/f", 0o644, "data"},
+				{tar.TypeLink, "h", 0o644, "cache/x/f"},
+			},
+			excludes: []string{"cache/"},
+			want:     []string{" d 755", "keep d 755", "keep/f f 644 data"},
+			warnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var archive bytes.Buffer
+			a := &PXARArchive{
+				ArchiveName:    "test.pxar.didx",
+				WriteCB:        func(b []byte) { archive.Write(b) },
+				CatalogWriteCB: func(b []byte) {},
+				SpoolDir:       t.TempDir(),
+			}
+			for _, line := range tt.excludes {
+				p, _ := ParseExcludePattern(line, "")
+				a.ExcludePatterns = append(a.ExcludePatterns, p)
+			}
+			if err := a.WriteTar(bytes.NewReader(writeTestTar(t, tt.entries))); err != nil {
+				t.Fatal(err)
+			}
+			if len(a.Warnings) != tt.warnings {
+				t.Errorf("warnings %v, want %d", a.Warnings, tt.warnings)
+			}
+			if got := listTestArchive(t, archive.Bytes()); !slices.Equal(got, tt.want) {
+				t.Errorf("archive holds\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPXARWriteTarBroken(t *testing.T) {
+	data := writeTestTar(t, []tarTestEntry{{tar.TypeReg, "f", 0o644, "some content"}})
+	written := 0
+	a := &PXARArchive{
+		ArchiveName:    "test.pxar.didx",
+		WriteCB:        func(b []byte) { written += len(b) },
+		CatalogWriteCB: func(b []byte) { written += len(b) },
+		SpoolDir:       t.TempDir(),
+	}
+	if err := a.WriteTar(bytes.NewReader(data[:512+4])); err == nil {
+		t.Errorf("truncated stream gave no error")
+	}
+	if written > 0 {
+		t.Errorf("%d bytes written for a broken stream", written)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || solaris
+// +build linux darwin freebsd openbsd netbsd solaris
+
+package pbscommon
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// Returns device, inode and link count used to detect hardlinks
+func fileInode(fileInfo os.FileInfo) (uint64, uint64, uint64, bool) {
+	st, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), uint64(st.Nlink), true
+}
+
+// Splits st_rdev in major and minor using the platform encoding
+func fileDevice(fileInfo os.FileInfo) (uint64, uint64) {
+	st, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	dev := uint64(st.Rdev)
+	switch runtime.GOOS {
+	case "linux":
+		return ((dev >> 8) & 0xfff) | ((dev >> 32) & 0xfffff000), (dev & 0xff) | ((dev >> 12) & 0xffffff00)
+	case "darwin":
+		return (dev >> 24) & 0xff, dev & 0xffffff
+	default:
+		return (dev >> 8) & 0xff, dev & 0xffff00ff
+	}
+}
+
+func fileOwnership(fileInfo os.FileInfo) (uint64, uint32, uint32) {
+	st, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return uint64(fileInfo.Mode().Perm()), 0, 0
+	}
+	return uint64(st.Mode) & 0o7777, st.Uid, st.Gid
+}
+
+// Inverse of fileDevice, st_rdev for mknod
+func MakeDevice(major uint64, minor uint64) uint64 {
+	switch runtime.GOOS {
+	case "linux":
+		return (minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32)
+	case "darwin":
+		return (major << 24) | (minor & 0xffffff)
+	default:
+		return (major << 8) | (minor & 0xffff00ff)
+	}
+}
@@ -0,0 +1,446 @@
+package pbscommon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dchest/siphash"
+)
+
+// One record of a pxar archive as stored, reported by PXARDecoder.Walk
+type PXARItem struct {
+	Offset   uint64
+	Type     uint64
+	Size     uint64 //Including the 16 byte header
+	Depth    int    //Directory nesting, 0 for the root directory and the records before it
+	Path     string //Entry the record belongs to, "" for the root directory
+	Value    string //Short description of the content, file name, mode, link target...
+	Goodbye  []PXARGoodbyeItem
+	Problems []string //Structural errors found at this record
+}
+
+// Goodbye table item as stored, the last one of a table is the tail
+type PXARGoodbyeItem struct {
+	Hash   uint64
+	Offset uint64 //Distance back from the start of the table
+	Len    uint64
+}
+
+var pxarTypeNames = map[uint64]string{
+	PXAR_ENTRY:             "ENTRY",
+	PXAR_ENTRY_V1:          "ENTRY_V1",
+	PXAR_FILENAME:          "FILENAME",
+	PXAR_SYMLINK:           "SYMLINK",
+	PXAR_DEVICE:            "DEVICE",
+	PXAR_XATTR:             "XATTR",
+	PXAR_ACL_USER:          "ACL_USER",
+	PXAR_ACL_GROUP:         "ACL_GROUP",
+	PXAR_ACL_GROUP_OBJ:     "ACL_GROUP_OBJ",
+	PXAR_ACL_DEFAULT:       "ACL_DEFAULT",
+	PXAR_ACL_DEFAULT_USER:  "ACL_DEFAULT_USER",
+	PXAR_ACL_DEFAULT_GROUP: "ACL_DEFAULT_GROUP",
+	PXAR_FCAPS:             "FCAPS",
+	PXAR_QUOTA_PROJID:      "QUOTA_PROJID",
+	PXAR_HARDLINK:          "HARDLINK",
+	PXAR_PAYLOAD:           "PAYLOAD",
+	PXAR_GOODBYE:           "GOODBYE",
+	PXAR_FORMAT_VERSION:    "FORMAT_VERSION",
+	PXAR_PRELUDE:           "PRELUDE",
+	PXAR_PAYLOAD_REF:       "PAYLOAD_REF",
+}
+
+// Name of a record type without the PXAR_ prefix, the hex value for unknown ones
+func PXARTypeName(htype uint64) string {
+	if name, ok := pxarTypeNames[htype]; ok {
+		return name
+	}
+	return fmt.Sprintf("%016x", htype)
+}
+
+type pxarWalker struct {
+	d     *PXARDecoder
+	visit func(*PXARItem) error
+	split bool
+	//Filename header offsets of regular files, hardlinks must point to one of them
+	files map[uint64]string
+}
+
+type pxarChild struct {
+	name  string
+	start uint64
+	end   uint64
+}
+
+func (w *pxarWalker) header(pos uint64) (uint64, uint64, error) {
+	hdr := make([]byte, 16)
+	if _, err := w.d.r.ReadAt(hdr, int64(pos)); err != nil {
+		return 0, 0, fmt.Errorf("pxar: reading header at %d: %w", pos, err)
+	}
+	htype := binary.LittleEndian.Uint64(hdr[0:8])
+	hsize := binary.LittleEndian.Uint64(hdr[8:16])
+	if hsize < 16 || pos+hsize > w.d.size {
+		return 0, 0, fmt.Errorf("pxar: invalid header size %d at %d", hsize, pos)
+	}
+	return htype, hsize, nil
+}
+
+func (w *pxarWalker) content(pos uint64, hsize uint64) ([]byte, error) {
+	content := make([]byte, hsize-16)
+	if _, err := w.d.r.ReadAt(content, int64(pos+16)); err != nil {
+		return nil, fmt.Errorf("pxar: reading content at %d: %w", pos, err)
+	}
+	return content, nil
+}
+
+// Checks a reference into the payload archive, when there is one
+func (w *pxarWalker) checkPayloadRef(item *PXARItem, offset uint64, size uint64) {
+	if w.d.payload == nil {
+		return
+	}
+	hdr := make([]byte, 16)
+	if _, err := w.d.payload.ReadAt(hdr, int64(offset)); err != nil {
+		item.Problems = append(item.Problems, fmt.Sprintf("payload at %d not readable: %v", offset, err))
+		return
+	}
+	if binary.LittleEndian.Uint64(hdr[0:8]) != PXAR_PAYLOAD || binary.LittleEndian.Uint64(hdr[8:16]) != size+16 {
+		item.Problems = append(item.Problems, fmt.Sprintf("no payload header for %d bytes at %d of the payload archive", size, offset))
+		return
+	}
+	if size == 0 {
+		return
+	}
+	if _, err := w.d.payload.ReadAt(hdr[:1], int64(offset+16+size-1)); err != nil {
+		item.Problems = append(item.Problems, fmt.Sprintf("payload at %d truncated: %v", offset, err))
+	}
+}
+
+// PXAR_ENTRY at pos and its records, directories with their children and goodbye table.
+// Returns where the entry ends and its file type
+func (w *pxarWalker) entry(pos uint64, p string, depth int) (uint64, byte, error) {
+	htype, hsize, err := w.header(pos)
+	if err != nil {
+		return 0, 0, err
+	}
+	if htype != PXAR_ENTRY || hsize != 56 {
+		return 0, 0, fmt.Errorf("pxar: expected entry at %d, found %s", pos, PXARTypeName(htype))
+	}
+	content, err := w.content(pos, hsize)
+	if err != nil {
+		return 0, 0, err
+	}
+	mode := binary.LittleEndian.Uint64(content[0:8])
+	mtime := time.Unix(int64(binary.LittleEndian.Uint64(content[24:32])), int64(binary.LittleEndian.Uint32(content[32:36])))
+	kind := entryKind(mode)
+	item := &PXARItem{Offset: pos, Type: htype, Size: hsize, Depth: depth, Path: p,
+		Value: fmt.Sprintf("mode %o uid %d gid %d mtime %s", mode, binary.LittleEndian.Uint32(content[16:20]),
+			binary.LittleEndian.Uint32(content[20:24]), mtime.UTC().Format(time.RFC3339Nano))}
+	if kind == 0 {
+		item.Problems = append(item.Problems, fmt.Sprintf("unknown file type %o", mode&IFMT))
+	}
+	if err := w.visit(item); err != nil {
+		return 0, 0, err
+	}
+	dirStart := pos
+	pos += hsize
+
+	//Metadata records, for everything but directories the last one tells the type
+	done := false
+	for !done {
+		htype, hsize, err := w.header(pos)
+		if err != nil {
+			return 0, 0, err
+		}
+		if htype == PXAR_FILENAME || htype == PXAR_GOODBYE {
+			break
+		}
+		content, err := w.content(pos, hsize)
+		if err != nil {
+			return 0, 0, err
+		}
+		item := &PXARItem{Offset: pos, Type: htype, Size: hsize, Depth: depth, Path: p}
+		expect := func(kinds string, min int) {
+			if strings.IndexByte(kinds, kind) < 0 {
+				item.Problems = append(item.Problems, fmt.Sprintf("not allowed for file type %o", mode&IFMT))
+			}
+			if len(content) < min {
+				item.Problems = append(item.Problems, "record too short")
+			}
+			done = true
+		}
+		switch htype {
+		case PXAR_XATTR:
+			name, _, _ := bytes.Cut(content, []byte{0})
+			item.Value = string(name)
+		case PXAR_ACL_USER, PXAR_ACL_GROUP, PXAR_ACL_DEFAULT_USER, PXAR_ACL_DEFAULT_GROUP, PXAR_ACL_GROUP_OBJ, PXAR_ACL_DEFAULT, PXAR_FCAPS, PXAR_QUOTA_PROJID:
+			item.Value = fmt.Sprintf("%d bytes", len(content))
+		case PXAR_SYMLINK:
+			item.Value = cString(content)
+			expect("l", 1)
+		case PXAR_DEVICE:
+			expect("bc", 16)
+			if len(content) >= 16 {
+				item.Value = fmt.Sprintf("%d,%d", binary.LittleEndian.Uint64(content[0:8]), binary.LittleEndian.Uint64(content[8:16]))
+			}
+		case PXAR_PAYLOAD:
+			item.Value = fmt.Sprintf("%d bytes", len(content))
+			expect("f", 0)
+			if w.split {
+				item.Problems = append(item.Problems, "inline payload in a split archive")
+			}
+		case PXAR_PAYLOAD_REF:
+			expect("f", 16)
+			if !w.split {
+				item.Problems = append(item.Problems, "payload reference in an archive which is not split")
+			}
+			if len(content) >= 16 {
+				offset, size := binary.LittleEndian.Uint64(content[0:8]), binary.LittleEndian.Uint64(content[8:16])
+				item.Value = fmt.Sprintf("offset %d size %d", offset, size)
+				w.checkPayloadRef(item, offset, size)
+			}
+		default:
+			return 0, 0, fmt.Errorf("pxar: unexpected item %s at %d", PXARTypeName(htype), pos)
+		}
+		if err := w.visit(item); err != nil {
+			return 0, 0, err
+		}
+		pos += hsize
+	}
+	if strings.IndexByte("flbc", kind) >= 0 && !done {
+		return 0, 0, fmt.Errorf("pxar: entry /%s at %d lacks its payload, link target or device", p, dirStart)
+	}
+	if kind != 'd' {
+		return pos, kind, nil
+	}
+
+	children := make([]pxarChild, 0)
+	names := make(map[string]bool)
+	for {
+		htype, hsize, err := w.header(pos)
+		if err != nil {
+			return 0, 0, err
+		}
+		if htype == PXAR_GOODBYE {
+			end, err := w.goodbye(pos, hsize, dirStart, children, p, depth)
+			return end, kind, err
+		}
+		if htype != PXAR_FILENAME {
+			return 0, 0, fmt.Errorf("pxar: unexpected item %s at %d in directory /%s", PXARTypeName(htype), pos, p)
+		}
+		content, err := w.content(pos, hsize)
+		if err != nil {
+			return 0, 0, err
+		}
+		child := pxarChild{name: cString(content), start: pos}
+		childpath := child.name
+		if p != "" {
+			childpath = p + "/" + child.name
+		}
+		item := &PXARItem{Offset: pos, Type: htype, Size: hsize, Depth: depth + 1, Path: childpath, Value: child.name}
+		if child.name == "" || child.name == "." || child.name == ".." || strings.Contains(child.name, "/") {
+			item.Problems = append(item.Problems, fmt.Sprintf("invalid file name %q", child.name))
+		}
+		if len(content) == 0 || content[len(content)-1] != 0 || bytes.IndexByte(content, 0) != len(content)-1 {
+			item.Problems = append(item.Problems, "file name not terminated by a single NUL")
+		}
+		if names[child.name] {
+			item.Problems = append(item.Problems, "duplicate file name")
+		}
+		names[child.name] = true
+		if err := w.visit(item); err != nil {
+			return 0, 0, err
+		}
+		pos += hsize
+
+		htype, hsize, err = w.header(pos)
+		if err != nil {
+			return 0, 0, err
+		}
+		if htype == PXAR_HARDLINK {
+			content, err := w.content(pos, hsize)
+			if err != nil {
+				return 0, 0, err
+			}
+			item := &PXARItem{Offset: pos, Type: htype, Size: hsize, Depth: depth + 1, Path: childpath}
+			if len(content) < 9 {
+				item.Problems = append(item.Problems, "record too short")
+			} else {
+				offset := binary.LittleEndian.Uint64(content[0:8])
+				item.Value = cString(content[8:])
+				if target, ok := w.files[child.start-offset]; offset > child.start || !ok {
+					item.Problems = append(item.Problems, fmt.Sprintf("offset %d does not point back to a regular file", offset))
+				} else if target != item.Value {
+					item.Problems = append(item.Problems, fmt.Sprintf("points to %s, not %s", target, item.Value))
+				}
+			}
+			if err := w.visit(item); err != nil {
+				return 0, 0, err
+			}
+			pos += hsize
+		} else {
+			var kind byte
+			if pos, kind, err = w.entry(pos, childpath, depth+1); err != nil {
+				return 0, 0, err
+			}
+			if kind == 'f' {
+				w.files[child.start] = childpath
+			}
+		}
+		child.end = pos
+		children = append(children, child)
+	}
+}
+
+// Goodbye table at pos closing the directory whose PXAR_ENTRY is at dirStart
+func (w *pxarWalker) goodbye(pos uint64, hsize uint64, dirStart uint64, children []pxarChild, p string, depth int) (uint64, error) {
+	item := &PXARItem{Offset: pos, Type: PXAR_GOODBYE, Size: hsize, Depth: depth, Path: p}
+	if (hsize-16)%24 != 0 || hsize < 16+24 {
+		item.Problems = append(item.Problems, fmt.Sprintf("size %d is not a whole number of items", hsize))
+		return pos + hsize, w.visit(item)
+	}
+	content, err := w.content(pos, hsize)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i+24 <= len(content); i += 24 {
+		item.Goodbye = append(item.Goodbye, PXARGoodbyeItem{
+			Hash:   binary.LittleEndian.Uint64(content[i : i+8]),
+			Offset: binary.LittleEndian.Uint64(content[i+8 : i+16]),
+			Len:    binary.LittleEndian.Uint64(content[i+16 : i+24]),
+		})
+	}
+	items := item.Goodbye[:len(item.Goodbye)-1]
+	item.Value = fmt.Sprintf("%d items", len(items))
+
+	tail := item.Goodbye[len(item.Goodbye)-1]
+	if tail.Hash != PXAR_GOODBYE_TAIL_MARKER {
+		item.Problems = append(item.Problems, fmt.Sprintf("tail marker %016x", tail.Hash))
+	}
+	//The root of split archives counts from the format version header
+	if tail.Offset != pos-dirStart && !(depth == 0 && w.split && tail.Offset == pos) {
+		item.Problems = append(item.Problems, fmt.Sprintf("tail offset %d, the directory entry is %d bytes back", tail.Offset, pos-dirStart))
+	}
+	if tail.Len != hsize {
+		item.Problems = append(item.Problems, fmt.Sprintf("tail length %d, the table has %d bytes", tail.Len, hsize))
+	}
+	if len(items) != len(children) {
+		item.Problems = append(item.Problems, fmt.Sprintf("%d items for %d directory entries", len(items), len(children)))
+	}
+
+	byStart := make(map[uint64]*pxarChild, len(children))
+	for j := range children {
+		byStart[children[j].start] = &children[j]
+	}
+	seen := make(map[uint64]bool)
+	for i, gi := range items {
+		start := pos - gi.Offset
+		child := byStart[start]
+		if child == nil || gi.Offset > pos {
+			item.Problems = append(item.Problems, fmt.Sprintf("item %d points to %d where no entry starts", i, start))
+			continue
+		}
+		if seen[start] {
+			item.Problems = append(item.Problems, fmt.Sprintf("item %d: %s is listed twice", i, child.name))
+		}
+		seen[start] = true
+		if gi.Len != child.end-child.start {
+			item.Problems = append(item.Problems, fmt.Sprintf("item %d: length %d, %s has %d bytes", i, gi.Len, child.name, child.end-child.start))
+		}
+		if hash := siphash.Hash(0x83ac3f1cfbb450db, 0xaa4f1b6879369fbd, []byte(child.name)); gi.Hash != hash {
+			item.Problems = append(item.Problems, fmt.Sprintf("item %d: hash %016x, %s hashes to %016x", i, gi.Hash, child.name, hash))
+		}
+	}
+	for _, c := range children {
+		if !seen[c.start] {
+			item.Problems = append(item.Problems, fmt.Sprintf("%s is missing", c.name))
+		}
+	}
+
+	//Lookups search the table as a binary search tree, in order the hashes must be sorted
+	var inorder []uint64
+	var walk func(i int)
+	walk = func(i int) {
+		if i >= len(items) {
+			return
+		}
+		walk(2*i + 1)
+		inorder = append(inorder, items[i].Hash)
+		walk(2*i + 2)
+	}
+	walk(0)
+	for i := 1; i < len(inorder); i++ {
+		if inorder[i] < inorder[i-1] {
+			item.Problems = append(item.Problems, "hashes are not in binary search tree order")
+			break
+		}
+	}
+	return pos + hsize, w.visit(item)
+}
+
+// Visits every record of the archive in the order they are stored and checks the structure on the way:
+// record sizes and order, goodbye table offsets, lengths, hashes and ordering, hardlink offsets and,
+// when the payload archive is known, payload references. Problems are reported in the items and the walk
+// goes on, records which cannot be parsed end it with an error, as does an error returned by visit
+func (d *PXARDecoder) Walk(visit func(item *PXARItem) error) error {
+	w := &pxarWalker{d: d, visit: visit, files: make(map[uint64]string)}
+	pos := uint64(0)
+	htype, hsize, err := w.header(pos)
+	if err != nil {
+		return err
+	}
+	if htype == PXAR_FORMAT_VERSION {
+		content, err := w.content(pos, hsize)
+		if err != nil {
+			return err
+		}
+		if len(content) < 8 || binary.LittleEndian.Uint64(content) != PXAR_FORMAT_VERSION_2 {
+			return fmt.Errorf("pxar: unsupported format version entry")
+		}
+		w.split = true
+		if err := visit(&PXARItem{Offset: pos, Type: htype, Size: hsize, Value: "2"}); err != nil {
+			return err
+		}
+		pos += hsize
+		if htype, hsize, err = w.header(pos); err != nil {
+			return err
+		}
+		if htype == PXAR_PRELUDE {
+			if err := visit(&PXARItem{Offset: pos, Type: htype, Size: hsize, Value: fmt.Sprintf("%d bytes", hsize-16)}); err != nil {
+				return err
+			}
+			pos += hsize
+		}
+	}
+	if w.split && d.payload != nil {
+		hdr := make([]byte, 16)
+		if _, err := d.payload.ReadAt(hdr, 0); err != nil || binary.LittleEndian.Uint64(hdr[0:8]) != PXAR_PAYLOAD_START_MARKER {
+			return fmt.Errorf("pxar: payload archive does not start with the start marker")
+		}
+	}
+
+	end, kind, err := w.entry(pos, "", 0)
+	if err != nil {
+		return err
+	}
+	if kind != 'd' {
+		return fmt.Errorf("pxar: root entry is not a directory")
+	}
+	if end != d.size {
+		return fmt.Errorf("pxar: %d bytes after the root directory", d.size-end)
+	}
+	return nil
+}
+
+// Structural problems of the archive, see Walk
+func (d *PXARDecoder) Verify() ([]string, error) {
+	problems := make([]string, 0)
+	err := d.Walk(func(item *PXARItem) error {
+		for _, p := range item.Problems {
+			problems = append(problems, fmt.Sprintf("%s at %d (/%s): %s", PXARTypeName(item.Type), item.Offset, item.Path, p))
+		}
+		return nil
+	})
+	return problems, err
+}
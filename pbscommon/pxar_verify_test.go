@@ -0,0 +1,141 @@
+//go:build linux
+// +build linux
+
+package pbscommon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Archive content of a decoder the tests wrote into memory
+func decoderTestBytes(t *testing.T, d *PXARDecoder) []byte {
+	data := make([]byte, d.size)
+	if _, err := d.r.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Record offsets by type and path, goodbye tables of directories and hardlink records
+func verifyTestOffsets(t *testing.T, data []byte) map[string]uint64 {
+	ret := make(map[string]uint64)
+	d := NewPXARDecoder(bytes.NewReader(data), uint64(len(data)))
+	err := d.Walk(func(item *PXARItem) error {
+		ret[PXARTypeName(item.Type)+" /"+item.Path] = item.Offset
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestPXARVerify(t *testing.T) {
+	root, _ := makeDecoderTestTree(t)
+	for _, split := range []bool{false, true} {
+		d := writeDecoderTestArchive(t, root, split)
+		problems, err := d.Verify()
+		if err != nil || len(problems) > 0 {
+			t.Errorf("split %v: valid archive has problems %v %v", split, problems, err)
+		}
+	}
+
+	valid := decoderTestBytes(t, writeDecoderTestArchive(t, root, false))
+	offsets := verifyTestOffsets(t, valid)
+	rootGoodbye, subGoodbye := offsets["GOODBYE /"], offsets["GOODBYE /dir/sub"]
+	//Field f, 0 hash, 1 offset or 2 length, of goodbye item i of the table at pos, the tail is the last item
+	field := func(data []byte, pos uint64, i int, f int) []byte {
+		start := pos + 16 + uint64(i)*24 + uint64(f)*8
+		return data[start : start+8]
+	}
+	add := func(b []byte, v int64) {
+		binary.LittleEndian.PutUint64(b, uint64(int64(binary.LittleEndian.Uint64(b))+v))
+	}
+	rootItems := int(binary.LittleEndian.Uint64(valid[rootGoodbye+8:])-16)/24 - 1
+
+	tests := []struct {
+		name    string
+		corrupt func(data []byte)
+		want    []string //Parts of the problems reported
+	}{
+		{
+			name:    "tail marker",
+			corrupt: func(data []byte) { add(field(data, rootGoodbye, rootItems, 0), 1) },
+			want:    []string{"GOODBYE at " + fmt.Sprint(rootGoodbye) + " (/): tail marker"},
+		},
+		{
+			name:    "tail offset",
+			corrupt: func(data []byte) { add(field(data, subGoodbye, 1, 1), 8) },
+			want:    []string{"(/dir/sub): tail offset"},
+		},
+		{
+			name:    "tail length",
+			corrupt: func(data []byte) { add(field(data, rootGoodbye, rootItems, 2), 24) },
+			want:    []string{"tail length"},
+		},
+		{
+			name:    "item hash",
+			corrupt: func(data []byte) { add(field(data, subGoodbye, 0, 0), 1) },
+			want:    []string{"(/dir/sub): item 0: hash", "hashes to"},
+		},
+		{
+			name:    "item length",
+			corrupt: func(data []byte) { add(field(data, rootGoodbye, 1, 2), -1) },
+			want:    []string{"item 1: length"},
+		},
+		{
+			name:    "item pointing between entries",
+			corrupt: func(data []byte) { add(field(data, rootGoodbye, 2, 1), -8) },
+			want:    []string{"item 2 points to", "where no entry starts", "is missing"},
+		},
+		{
+			name: "item listed twice",
+			corrupt: func(data []byte) {
+				//Offsets count back from the table start, so the copy points to the same entry
+				copy(data[rootGoodbye+16+24:], data[rootGoodbye+16:rootGoodbye+16+24])
+			},
+			want: []string{"item 1:", "is listed twice", "is missing"},
+		},
+		{
+			name: "items out of search tree order",
+			corrupt: func(data []byte) {
+				first := bytes.Clone(data[rootGoodbye+16 : rootGoodbye+16+24])
+				copy(data[rootGoodbye+16:], data[rootGoodbye+16+24:rootGoodbye+16+48])
+				copy(data[rootGoodbye+16+24:], first)
+			},
+			want: []string{"not in binary search tree order"},
+		},
+		{
+			name:    "hardlink offset",
+			corrupt: func(data []byte) { add(data[offsets["HARDLINK /hard"]+16:], 8) },
+			want:    []string{"HARDLINK", "(/hard): offset", "does not point back to a regular file"},
+		},
+		{
+			name: "hardlink target name",
+			corrupt: func(data []byte) {
+				i := offsets["HARDLINK /hard"] + 16 + 8
+				copy(data[i:], "x")
+			},
+			want: []string{"(/hard): points to file.txt, not xile.txt"},
+		},
+	}
+	for _, tt := range tests {
+		data := bytes.Clone(valid)
+		tt.corrupt(data)
+		problems, err := NewPXARDecoder(bytes.NewReader(data), uint64(len(data))).Verify()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		all := strings.Join(problems, "\n")
+		for _, w := range tt.want {
+			if !strings.Contains(all, w) {
+				t.Errorf("%s: problems %q lack %q", tt.name, problems, w)
+			}
+		}
+	}
+}
@@ -3,13 +3,17 @@
 
 package snapshot
 
-import "log"
+import (
+	"log"
+	"path/filepath"
+)
 
 func CreateVSSSnapshot(paths []string, backup_callback func(sn map[string]SnapShot) error) error {
 	log.Printf("\033[31;1mWarning, on linux snapshots are not supported builtin, proceeding without!\033[0m")
 	ret := make(map[string]SnapShot)
 	for _, x := range paths {
-		ret[x] = SnapShot{
+		abs, _ := filepath.Abs(x)
+		ret[abs] = SnapShot{
 			FullPath: x,
 			Valid:    true,
 		}
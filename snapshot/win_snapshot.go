@@ -52,10 +52,24 @@ func getAppDataFolder() (string, error) {
 	return appDataFolder, nil
 }
 
+// VSS snapshot of one volume with the snapshotter holding it, go-vss takes one snapshot per Snapshotter
+type volumeSnapshot struct {
+	sn   *vss.Snapshotter
+	snap SnapShot
+}
+
 func CreateVSSSnapshot(paths []string, backup_callback func(sn map[string]SnapShot) error) error {
 
-	sn := vss.Snapshotter{}
 	snapshots := make(map[string]SnapShot)
+	//Several paths can live on the same volume, which has to be snapshotted only once
+	volumes := make(map[string]*volumeSnapshot)
+	defer func() {
+		for volName, vol := range volumes {
+			if err := vol.sn.Release(); err != nil {
+				fmt.Printf("Releasing VSS snapshot of %s: %v\n", volName, err)
+			}
+		}
+	}()
 
 	for _, path := range paths {
 		path, _ = filepath.Abs(path)
@@ -69,22 +83,27 @@ func CreateVSSSnapshot(paths []string, backup_callback func(sn map[string]SnapSh
 			return err
 		}
 
-		defer sn.Release()
+		vol, ok := volumes[volName]
+		if !ok {
+			sn := &vss.Snapshotter{}
 
-		fmt.Printf("Creating VSS Snapshot...")
-		snapshot, err := sn.CreateSnapshot(volName, false, 180)
-		if err != nil {
-			return err
-		}
-		fmt.Printf("Snapshot created: %s\n", snapshot.Id)
+			fmt.Printf("Creating VSS Snapshot of %s...", volName)
+			snapshot, err := sn.CreateSnapshot(volName, false, 180)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Snapshot created: %s\n", snapshot.Id)
+			vol = &volumeSnapshot{sn: sn, snap: SnapShot{Id: snapshot.Id, ObjectPath: snapshot.DeviceObjectPath, Valid: true}}
+			volumes[volName] = vol
 
-		_, err = SymlinkSnapshot(filepath.Join(appDataFolder, "VSS"), snapshot.Id, snapshot.DeviceObjectPath)
+			_, err = SymlinkSnapshot(filepath.Join(appDataFolder, "VSS"), snapshot.Id, snapshot.DeviceObjectPath)
 
-		if err != nil {
-			return err
+			if err != nil {
+				return err
+			}
 		}
 
-		snapshots[path] = SnapShot{FullPath: filepath.Join(appDataFolder, "VSS", snapshot.Id, subPath), Id: snapshot.Id, ObjectPath: snapshot.DeviceObjectPath, Valid: true}
+		snapshots[path] = SnapShot{FullPath: filepath.Join(appDataFolder, "VSS", vol.snap.Id, subPath), Id: vol.snap.Id, ObjectPath: vol.snap.ObjectPath, Valid: true}
 
 	}
 